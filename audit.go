@@ -0,0 +1,216 @@
+package grbac
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Auditor records the changes of roles and the permission checks.
+//
+// The methods are called synchronously by the audited roles, so they should
+// be fast. They must not change the audited roles.
+type Auditor interface {
+	AuditChange(e Event)
+	AuditDecision(d AuditDecision)
+}
+
+// AuditDecision describes a permission check.
+//
+// A check of a role has Role set. A check of a subject, reported by
+// a registry, has Subject set and Roles listing the roles it was made
+// against: the assigned roles for Registry.Can and the active roles for
+// Session.IsAllowed.
+type AuditDecision struct {
+	Role        string    `json:"role,omitempty"`
+	Subject     string    `json:"subject,omitempty"`
+	Roles       []string  `json:"roles,omitempty"`
+	Permissions []string  `json:"permissions"`
+	Allowed     bool      `json:"allowed"`
+	Time        time.Time `json:"time"`
+
+	// Actor is who asked for the check, see WithActor. Empty if unknown.
+	Actor string `json:"actor,omitempty"`
+}
+
+// AuditedRole is a Roler that reports its changes and the checks of
+// IsAllowed to an Auditor.
+//
+// The changes are made and published like by NotifyingRole, so they have
+// context variants, such as PermitContext, that take the actor from
+// the context.
+type AuditedRole struct {
+	*NotifyingRole
+	auditor Auditor
+}
+
+// NewAuditedRole wraps the role.
+func NewAuditedRole(role Roler, auditor Auditor) *AuditedRole {
+	r := &AuditedRole{
+		NotifyingRole: NewNotifyingRole(role, nil),
+		auditor:       auditor,
+	}
+
+	r.bus.Subscribe(auditor.AuditChange)
+	return r
+}
+
+// IsAllowed checks the permissions like the wrapped role and reports
+// the decision.
+func (r *AuditedRole) IsAllowed(perms ...string) bool {
+	return r.IsAllowedContext(context.Background(), perms...)
+}
+
+// IsAllowedContext is like IsAllowed, the decision has the actor of ctx.
+func (r *AuditedRole) IsAllowedContext(ctx context.Context, perms ...string) bool {
+	allowed := r.Roler.IsAllowed(perms...)
+
+	r.auditor.AuditDecision(AuditDecision{
+		Role:        r.Roler.Name(),
+		Permissions: append([]string(nil), perms...),
+		Allowed:     allowed,
+		Time:        time.Now(),
+		Actor:       ActorFrom(ctx),
+	})
+	return allowed
+}
+
+// SetAuditor makes the registry report to auditor the checks of Can and of
+// the sessions and the changes of the assignments, including those made by
+// batches. A nil auditor stops the reports.
+//
+// Registry.IsAllowed checks a single role and is reported by the role
+// itself if it is an AuditedRole. The changes of the assignments are
+// reported in their order, after the registry is unlocked, so the auditor
+// may read the registry.
+func (reg *Registry) SetAuditor(auditor Auditor) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	reg.auditor = auditor
+}
+
+// auditCheck reports a check of the subject against the roles.
+func auditCheck(ctx context.Context, auditor Auditor, subject string, roles map[string]Roler, perms []string, allowed bool) {
+	if auditor == nil {
+		return
+	}
+
+	names := make([]string, 0, len(roles))
+	for name := range roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	auditor.AuditDecision(AuditDecision{
+		Subject:     subject,
+		Roles:       names,
+		Permissions: append([]string(nil), perms...),
+		Allowed:     allowed,
+		Time:        time.Now(),
+		Actor:       ActorFrom(ctx),
+	})
+}
+
+// auditAssignment reports a change of the assignments.
+func auditAssignment(ctx context.Context, auditor Auditor, kind EventKind, subject, role string) {
+	if auditor == nil {
+		return
+	}
+
+	auditor.AuditChange(Event{
+		Role:    role,
+		Kind:    kind,
+		Subject: subject,
+		Time:    time.Now(),
+		Actor:   ActorFrom(ctx),
+	})
+}
+
+// sampledAuditor passes a part of the allowed decisions to an auditor.
+type sampledAuditor struct {
+	Auditor
+	rate float64
+
+	allowed uint64
+	mutex   sync.Mutex
+}
+
+// SampleAllowed returns an Auditor that passes all the changes and denied
+// decisions to auditor, but only the rate part of the allowed decisions,
+// from 0 (none) to 1 (all). The sampling is deterministic: with rate 0.25
+// every fourth allowed decision is passed.
+func SampleAllowed(auditor Auditor, rate float64) Auditor {
+	return &sampledAuditor{Auditor: auditor, rate: rate}
+}
+
+func (a *sampledAuditor) AuditDecision(d AuditDecision) {
+	if !d.Allowed {
+		a.Auditor.AuditDecision(d)
+		return
+	}
+
+	a.mutex.Lock()
+	a.allowed++
+	n := float64(a.allowed)
+	pass := int64(n*a.rate) > int64((n-1)*a.rate)
+	a.mutex.Unlock()
+
+	if pass {
+		a.Auditor.AuditDecision(d)
+	}
+}
+
+// AuditRecord is a line of the JSON audit log. Exactly one of its fields is
+// set.
+type AuditRecord struct {
+	Change   *Event         `json:"change,omitempty"`
+	Decision *AuditDecision `json:"decision,omitempty"`
+}
+
+// JSONAuditor is an Auditor that writes an AuditRecord per line, known as
+// JSON lines.
+//
+// Write errors cannot be returned to the audited roles, so the first of them
+// is kept and reported by Err; nothing is written after it.
+type JSONAuditor struct {
+	enc *json.Encoder
+	err error
+
+	mutex sync.Mutex
+}
+
+// NewJSONAuditor creates a JSONAuditor that writes to w.
+func NewJSONAuditor(w io.Writer) *JSONAuditor {
+	return &JSONAuditor{enc: json.NewEncoder(w)}
+}
+
+// AuditChange writes the change.
+func (a *JSONAuditor) AuditChange(e Event) {
+	a.write(&AuditRecord{Change: &e})
+}
+
+// AuditDecision writes the decision.
+func (a *JSONAuditor) AuditDecision(d AuditDecision) {
+	a.write(&AuditRecord{Decision: &d})
+}
+
+func (a *JSONAuditor) write(rec *AuditRecord) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.err == nil {
+		a.err = a.enc.Encode(rec)
+	}
+}
+
+// Err returns the first write error.
+func (a *JSONAuditor) Err() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.err
+}
@@ -0,0 +1,217 @@
+package grbac
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type auditLog struct {
+	changes   []Event
+	decisions []AuditDecision
+}
+
+func (a *auditLog) AuditChange(e Event) {
+	a.changes = append(a.changes, e)
+}
+
+func (a *auditLog) AuditDecision(d AuditDecision) {
+	a.decisions = append(a.decisions, d)
+}
+
+func auditRoles(newFunc NewFunc, t *testing.T) {
+	var buf bytes.Buffer
+	auditor := NewJSONAuditor(&buf)
+
+	reg := NewRegistry(func(name string) Roler {
+		return NewAuditedRole(newFunc(name), auditor)
+	})
+
+	ctx := WithActor(context.Background(), "alice")
+
+	roleUser, _ := reg.Create("User")
+	roleUser.(*AuditedRole).PermitContext(ctx, "ReadMsg")
+	reg.Create("Admin")
+	reg.SetParent("Admin", "User")
+
+	if !reg.IsAllowedContext(ctx, "Admin", "ReadMsg") {
+		t.Errorf("expected that Admin role inherits ReadMsg")
+	}
+
+	if reg.IsAllowed("User", "DelMsg") {
+		t.Errorf("expected that User role does not have DelMsg")
+	}
+
+	if err := auditor.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(&buf)
+	for scanner.Scan() {
+		var rec AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("incorrect line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(records))
+	}
+
+	if c := records[0].Change; c == nil || c.Kind != EventPermit || c.Role != "User" || c.Actor != "alice" {
+		t.Errorf("incorrect record of Permit: %+v", c)
+	}
+
+	if c := records[1].Change; c == nil || c.Kind != EventSetParent || c.Parent != "User" {
+		t.Errorf("incorrect record of SetParent: %+v", c)
+	}
+
+	if d := records[2].Decision; d == nil || !d.Allowed || d.Role != "Admin" || d.Actor != "alice" {
+		t.Errorf("incorrect record of the allowed check: %+v", d)
+	}
+
+	if d := records[3].Decision; d == nil || d.Allowed || d.Permissions[0] != "DelMsg" || d.Actor != "" {
+		t.Errorf("incorrect record of the denied check: %+v", d)
+	}
+}
+
+func TestDefaultRoleAudit(t *testing.T) {
+	auditRoles(newRole, t)
+}
+
+func TestCachedRoleAudit(t *testing.T) {
+	auditRoles(newCachedRole, t)
+}
+
+func auditRegistry(newFunc NewFunc, t *testing.T) {
+	log := &auditLog{}
+	reg := NewRegistry(RoleFactory(newFunc))
+	reg.SetAuditor(log)
+
+	ctx := WithActor(context.Background(), "bob")
+
+	roleUser, _ := reg.Create("User")
+	roleUser.Permit("ReadMsg")
+	reg.Create("Admin")
+
+	reg.AssignContext(ctx, "alice", "User")
+	reg.Assign("alice", "Admin")
+
+	if !reg.CanContext(ctx, "alice", "ReadMsg") {
+		t.Errorf("expected that alice can ReadMsg")
+	}
+
+	session := reg.NewSession("alice", 0)
+	session.Activate("Admin")
+	if session.IsAllowed("ReadMsg") {
+		t.Errorf("expected that the session does not allow ReadMsg")
+	}
+
+	reg.UnassignContext(ctx, "alice", "Admin")
+	reg.Update(func(b *Batch) error {
+		b.Assign("carol", "User")
+		return nil
+	})
+
+	if len(log.decisions) != 2 {
+		t.Fatalf("expected 2 decisions, got %d", len(log.decisions))
+	}
+
+	if d := log.decisions[0]; !d.Allowed || d.Subject != "alice" || d.Role != "" || d.Actor != "bob" ||
+		!reflect.DeepEqual(d.Roles, []string{"Admin", "User"}) {
+		t.Errorf("incorrect decision of Can: %+v", d)
+	}
+
+	if d := log.decisions[1]; d.Allowed || d.Subject != "alice" || d.Actor != "" ||
+		!reflect.DeepEqual(d.Roles, []string{"Admin"}) {
+		t.Errorf("incorrect decision of the session: %+v", d)
+	}
+
+	expected := []Event{
+		{Role: "User", Kind: EventAssign, Subject: "alice", Actor: "bob"},
+		{Role: "Admin", Kind: EventAssign, Subject: "alice"},
+		{Role: "Admin", Kind: EventUnassign, Subject: "alice", Actor: "bob"},
+		{Role: "User", Kind: EventAssign, Subject: "carol"},
+	}
+	if len(log.changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %d", len(expected), len(log.changes))
+	}
+	for i, e := range log.changes {
+		e.Time = time.Time{}
+		if e != expected[i] {
+			t.Errorf("incorrect change %d: %+v, expected %+v", i, e, expected[i])
+		}
+	}
+
+	// Failed changes are not reported.
+	if err := reg.Assign("alice", "User"); err != ErrRoleAssigned {
+		t.Errorf("expected \"%v\", got \"%v\"", ErrRoleAssigned, err)
+	}
+
+	reg.SetAuditor(nil)
+	reg.Can("alice", "ReadMsg")
+	reg.Unassign("alice", "User")
+	if len(log.decisions) != 2 || len(log.changes) != len(expected) {
+		t.Errorf("expected that a nil auditor stops the reports")
+	}
+}
+
+func TestDefaultRoleAuditRegistry(t *testing.T) {
+	auditRegistry(newRole, t)
+}
+
+func TestCachedRoleAuditRegistry(t *testing.T) {
+	auditRegistry(newCachedRole, t)
+}
+
+func TestSampleAllowed(t *testing.T) {
+	log := &auditLog{}
+	role := NewAuditedRole(NewRole("User"), SampleAllowed(log, 0.25))
+	role.Permit("ReadMsg")
+
+	for i := 0; i < 8; i++ {
+		role.IsAllowed("ReadMsg")
+		role.IsAllowed("DelMsg")
+	}
+
+	allowed := 0
+	for _, d := range log.decisions {
+		if d.Allowed {
+			allowed++
+		}
+	}
+
+	if allowed != 2 || len(log.decisions)-allowed != 8 {
+		t.Errorf("expected 2 allowed and 8 denied decisions, got %d and %d", allowed, len(log.decisions)-allowed)
+	}
+
+	if len(log.changes) != 1 {
+		t.Errorf("expected that all the changes are passed")
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk is full")
+}
+
+func TestJSONAuditorError(t *testing.T) {
+	auditor := NewJSONAuditor(failingWriter{})
+	role := NewAuditedRole(NewRole("User"), auditor)
+
+	if err := role.Permit("ReadMsg"); err != nil {
+		t.Errorf("expected that audit errors do not fail the changes: %v", err)
+	}
+
+	if auditor.Err() == nil {
+		t.Errorf("expected that the write error is kept")
+	}
+}
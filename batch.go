@@ -0,0 +1,784 @@
+package grbac
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrBatchDone is returned by Commit of a batch that is already committed
+// or rolled back.
+var ErrBatchDone = errors.New("batch is already committed or rolled back")
+
+type batchKind int
+
+const (
+	batchCreate batchKind = iota
+	batchRemove
+	batchPermit
+	batchRevoke
+	batchDeny
+	batchUndeny
+	batchSetParent
+	batchRemoveParent
+	batchAssign
+	batchUnassign
+)
+
+var batchKindNames = [...]string{
+	batchCreate:       "create",
+	batchRemove:       "remove",
+	batchPermit:       "permit",
+	batchRevoke:       "revoke",
+	batchDeny:         "deny",
+	batchUndeny:       "undeny",
+	batchSetParent:    "set-parent",
+	batchRemoveParent: "remove-parent",
+	batchAssign:       "assign",
+	batchUnassign:     "unassign",
+}
+
+func (k batchKind) String() string {
+	return batchKindNames[k]
+}
+
+// batchOp is a change of a batch. role is the changed role, the child of
+// a parent change or the assigned role; arg is the permission, the parent or
+// the subject.
+type batchOp struct {
+	kind batchKind
+	role string
+	arg  string
+}
+
+// BatchError is returned by Commit when a change of the batch fails.
+type BatchError struct {
+	// Index is the number of the change in the order the changes were
+	// made, starting from zero.
+	Index int
+
+	// Op is the kind of the change, such as "permit" or "set-parent".
+	Op string
+
+	Err error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("batch: change %d (%s): %v", e.Index, e.Op, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// Batch is a group of changes of a registry applied at once by Commit.
+//
+// The changes are only recorded until Commit. Commit tries them on a copy of
+// the registry first, so a failing change leaves the registry as it was.
+// Then the changes are made to the registered roles themselves, so the roles
+// keep their wrappers and the roles got from the registry before Commit see
+// the changes; the removed roles leave their parents, see Registry.Remove.
+//
+// The snapshot of the registry is replaced once, and the caches of
+// CachedRole are held meanwhile and recounted once, every role after its
+// parents. So the snapshot and a cached role without live parents answer
+// either with all the changes or none of them. Other roles, such as Role,
+// are changed one change at a time, and their readers may see a part of
+// the batch.
+type Batch struct {
+	reg  *Registry
+	ops  []batchOp
+	done bool
+
+	mutex sync.Mutex
+}
+
+// Batch starts a new batch of changes of the registry.
+func (reg *Registry) Batch() *Batch {
+	return &Batch{reg: reg}
+}
+
+// Update runs fn with a new batch and commits the batch if fn returns nil.
+// Otherwise the batch is rolled back and the error of fn is returned.
+func (reg *Registry) Update(fn func(*Batch) error) error {
+	b := reg.Batch()
+	if err := fn(b); err != nil {
+		b.Rollback()
+		return err
+	}
+	return b.Commit()
+}
+
+func (b *Batch) add(kind batchKind, role, arg string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.done {
+		b.ops = append(b.ops, batchOp{kind: kind, role: role, arg: arg})
+	}
+}
+
+// Create makes a new role with the name, see Registry.Create.
+func (b *Batch) Create(name string) {
+	b.add(batchCreate, name, "")
+}
+
+// Remove deletes the role, see Registry.Remove.
+func (b *Batch) Remove(name string) {
+	b.add(batchRemove, name, "")
+}
+
+// Permit adds the permission to the role.
+func (b *Batch) Permit(role, perm string) {
+	b.add(batchPermit, role, perm)
+}
+
+// Revoke revokes the permission from the role.
+func (b *Batch) Revoke(role, perm string) {
+	b.add(batchRevoke, role, perm)
+}
+
+// Deny adds the denial of the permission to the role.
+func (b *Batch) Deny(role, perm string) {
+	b.add(batchDeny, role, perm)
+}
+
+// Undeny removes the denial of the permission from the role.
+func (b *Batch) Undeny(role, perm string) {
+	b.add(batchUndeny, role, perm)
+}
+
+// SetParent makes the role named parent a parent of the role named child,
+// see Registry.SetParent.
+func (b *Batch) SetParent(child, parent string) {
+	b.add(batchSetParent, child, parent)
+}
+
+// RemoveParent removes the role named parent from the parents of the role
+// named child.
+func (b *Batch) RemoveParent(child, parent string) {
+	b.add(batchRemoveParent, child, parent)
+}
+
+// Assign assigns the role to the subject, see Registry.Assign.
+func (b *Batch) Assign(subject, role string) {
+	b.add(batchAssign, role, subject)
+}
+
+// Unassign takes the role away from the subject, see Registry.Unassign.
+func (b *Batch) Unassign(subject, role string) {
+	b.add(batchUnassign, role, subject)
+}
+
+// Rollback drops the changes of the batch.
+func (b *Batch) Rollback() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.done = true
+	b.ops = nil
+}
+
+// Commit applies the changes of the batch to the registry.
+//
+// Returns ErrBatchDone if the batch is already committed or rolled back,
+// a BatchError if a change fails, or an error of the roles or the store of
+// the registry. In any case of an error the registry is left unchanged.
+//
+// Roles that notify of their changes, such as NotifyingRole, publish
+// the changes of the batch before Commit returns, once the registry is
+// unlocked, so the subscribers may read it. The changes made through
+// the roles wait meanwhile, so the events of a role keep the order of its
+// changes.
+func (b *Batch) Commit() error {
+	b.mutex.Lock()
+	if b.done {
+		b.mutex.Unlock()
+		return ErrBatchDone
+	}
+
+	ops := b.ops
+	b.done = true
+	b.ops = nil
+	b.mutex.Unlock()
+
+	return b.reg.commit(ops)
+}
+
+var batchEventKinds = map[batchKind]EventKind{
+	batchPermit:       EventPermit,
+	batchRevoke:       EventRevoke,
+	batchDeny:         EventDeny,
+	batchUndeny:       EventUndeny,
+	batchSetParent:    EventSetParent,
+	batchRemoveParent: EventRemoveParent,
+}
+
+func (reg *Registry) commit(ops []batchOp) error {
+	defer reg.refreshSnapshot()
+
+	reg.writeMutex.Lock()
+	defer reg.writeMutex.Unlock()
+
+	prep, err := reg.prepare(ops)
+	if err != nil {
+		return err
+	}
+
+	// The changes made through the notifying roles wait for the events of
+	// the batch, so the events of a role keep the order of its changes.
+	for _, n := range notifyingRoles(prep.roles, prep.touched) {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+	}
+
+	var held []*CachedRole
+	for _, name := range rebuiltRoles(prep.scratch, prep.touched) {
+		if r, ok := unwrapRole(prep.roles[name]).(*CachedRole); ok {
+			r.hold()
+			held = append(held, r)
+		}
+	}
+
+	before := make(map[string]roleState, len(prep.touched))
+	after := make(map[string]roleState, len(prep.touched))
+	for name := range prep.touched {
+		role, ok := prep.roles[name]
+		if !ok {
+			continue
+		}
+
+		// The new roles start empty.
+		before[name] = roleState{}
+		if _, ok := prep.created[name]; !ok {
+			before[name] = stateOf(unwrapRole(role))
+		}
+		after[name] = targetState(prep.scratch, prep.roles, name)
+	}
+
+	// The removed roles leave their parents, so the parents neither keep
+	// them as children nor push their changes to them.
+	removedBefore := make(map[string]roleState, len(prep.removed))
+	removedAfter := make(map[string]roleState, len(prep.removed))
+	for name, role := range prep.removed {
+		state := stateOf(unwrapRole(role))
+		removedBefore[name] = state
+
+		state.parents = nil
+		removedAfter[name] = state
+	}
+
+	err = syncRoles(prep.removed, removedAfter)
+	if err == nil {
+		err = syncRoles(prep.roles, after)
+	}
+	if err != nil {
+		// The new roles are emptied, so their parents drop them as well.
+		syncRoles(prep.roles, before)
+		syncRoles(prep.removed, removedBefore)
+		prep.undoSave()
+
+		for _, r := range held {
+			r.release()
+		}
+		return err
+	}
+
+	reg.mutex.Lock()
+	for name := range prep.removed {
+		delete(reg.roles, name)
+	}
+	for name, role := range prep.created {
+		reg.roles[name] = role
+	}
+	reg.assignments = prep.scratch.assignments
+
+	reg.rebindSessions(prep.created)
+	auditor := reg.auditor
+	reg.mutex.Unlock()
+
+	// The registry is not locked, so the subscribers and the auditor may
+	// read it.
+	for _, r := range held {
+		r.release()
+	}
+
+	for _, e := range batchEvents(ops, prep.roles) {
+		e.bus.Publish(e.event)
+	}
+
+	for _, op := range ops {
+		switch op.kind {
+		case batchAssign:
+			auditAssignment(context.Background(), auditor, EventAssign, op.arg, op.role)
+		case batchUnassign:
+			auditAssignment(context.Background(), auditor, EventUnassign, op.arg, op.role)
+		}
+	}
+	return nil
+}
+
+// preparedBatch is a batch tried on the scratch registry and written to
+// the store, but not yet applied to the roles of the registry.
+type preparedBatch struct {
+	scratch *Registry
+
+	// roles are the roles after the commit: the kept registered roles and
+	// the created ones, which replace the removed roles of the same names.
+	roles   map[string]Roler
+	created map[string]Roler
+
+	// touched are the names of the roles the batch changes and removed
+	// the registered roles it removes.
+	touched map[string]bool
+	removed map[string]Roler
+
+	undoSave func()
+}
+
+// prepare tries the changes of a batch on a scratch registry and writes
+// them to the store of the registry.
+// The caller must hold writeMutex.
+func (reg *Registry) prepare(ops []batchOp) (*preparedBatch, error) {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	prep := &preparedBatch{
+		scratch: reg.scratch(),
+		created: make(map[string]Roler),
+		touched: make(map[string]bool),
+		removed: make(map[string]Roler),
+	}
+
+	for i, op := range ops {
+		if op.kind == batchRemove {
+			for name, role := range prep.scratch.roles {
+				if role.HasParent(op.role) {
+					prep.touched[name] = true
+				}
+			}
+
+			if role, ok := reg.roles[op.role]; ok {
+				prep.removed[op.role] = role
+			}
+		}
+
+		if err := prep.scratch.apply(op); err != nil {
+			return nil, &BatchError{Index: i, Op: op.kind.String(), Err: err}
+		}
+
+		if op.kind != batchAssign && op.kind != batchUnassign {
+			prep.touched[op.role] = true
+		}
+	}
+
+	prep.roles = make(map[string]Roler, len(prep.scratch.roles))
+	for name := range prep.scratch.roles {
+		role, ok := reg.roles[name]
+		if _, removed := prep.removed[name]; ok && !removed {
+			prep.roles[name] = role
+			continue
+		}
+
+		prep.roles[name] = reg.factory(name)
+		prep.created[name] = prep.roles[name]
+	}
+
+	var err error
+	if prep.undoSave, err = reg.saveBatch(prep.scratch, prep.touched); err != nil {
+		return nil, err
+	}
+	return prep, nil
+}
+
+// batchEvent is an event of a batch and the bus to publish it to.
+type batchEvent struct {
+	bus   *EventBus
+	event Event
+}
+
+// batchEvents returns the events of the changes of a batch made to
+// the roles, which are the roles after the commit, in the order of
+// the changes.
+func batchEvents(ops []batchOp, roles map[string]Roler) []batchEvent {
+	// The changes of a removed role are lost with it.
+	lastRemove := make(map[string]int)
+	for i, op := range ops {
+		if op.kind == batchRemove {
+			lastRemove[op.role] = i
+		}
+	}
+
+	var events []batchEvent
+	for i, op := range ops {
+		kind, ok := batchEventKinds[op.kind]
+		if !ok {
+			continue
+		}
+
+		if last, ok := lastRemove[op.role]; ok && i < last {
+			continue
+		}
+
+		role, ok := roles[op.role]
+		if !ok {
+			continue
+		}
+
+		if bus := notifierOf(role); bus != nil {
+			e := Event{Role: op.role, Kind: kind}
+			if kind == EventSetParent || kind == EventRemoveParent {
+				e.Parent = op.arg
+			} else {
+				e.Permission = op.arg
+			}
+			events = append(events, batchEvent{bus: bus, event: e})
+		}
+	}
+	return events
+}
+
+// notifyingRoles returns the NotifyingRoles of the touched roles, sorted by
+// the names of the roles.
+func notifyingRoles(roles map[string]Roler, touched map[string]bool) []*NotifyingRole {
+	names := make([]string, 0, len(touched))
+	for name := range touched {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var list []*NotifyingRole
+	seen := make(map[*NotifyingRole]bool)
+	for _, name := range names {
+		if n := notifyingOf(roles[name]); n != nil && !seen[n] {
+			seen[n] = true
+			list = append(list, n)
+		}
+	}
+	return list
+}
+
+// scratch copies the roles, assignments and constraints of the registry
+// into a new registry of plain roles, so changes can be tried on it.
+// The caller must hold the lock of the registry.
+func (reg *Registry) scratch() *Registry {
+	s := NewRegistry(nil)
+	copies := make(map[string]*Role)
+
+	var copyOf func(role Roler) *Role
+	copyOf = func(role Roler) *Role {
+		if c, ok := copies[role.Name()]; ok {
+			return c
+		}
+
+		c := NewRole(role.Name())
+		copies[role.Name()] = c
+
+		for perm := range role.Permissions() {
+			c.Permit(perm)
+		}
+		for perm := range denialsOf(role) {
+			c.Deny(perm)
+		}
+		for _, parent := range role.Parents() {
+			c.setParent(copyOf(parent))
+		}
+		return c
+	}
+
+	for name, role := range reg.roles {
+		s.roles[name] = copyOf(role)
+	}
+
+	for subject, roles := range reg.assignments {
+		s.assignments[subject] = make(map[string]bool, len(roles))
+		for name := range roles {
+			s.assignments[subject][name] = true
+		}
+	}
+
+	s.ssd = copyConstraints(reg.ssd)
+	s.dsd = copyConstraints(reg.dsd)
+	return s
+}
+
+// apply makes the change of a batch.
+func (reg *Registry) apply(op batchOp) error {
+	switch op.kind {
+	case batchCreate:
+		_, err := reg.Create(op.role)
+		return err
+	case batchRemove:
+		return reg.Remove(op.role)
+	case batchSetParent:
+		return reg.SetParent(op.role, op.arg)
+	case batchRemoveParent:
+		return reg.RemoveParent(op.role, op.arg)
+	case batchAssign:
+		return reg.Assign(op.arg, op.role)
+	case batchUnassign:
+		return reg.Unassign(op.arg, op.role)
+	}
+
+	role := reg.Get(op.role)
+	if role == nil {
+		return ErrNoRole
+	}
+
+	switch op.kind {
+	case batchPermit:
+		return role.Permit(op.arg)
+	case batchRevoke:
+		return role.Revoke(op.arg)
+	case batchDeny:
+		return deny(role, op.arg)
+	default:
+		return undeny(role, op.arg)
+	}
+}
+
+// rebuiltRoles returns the names of the roles of the scratch registry that
+// are touched or inherit a touched role, every role after its parents.
+func rebuiltRoles(scratch *Registry, touched map[string]bool) []string {
+	names := make([]string, 0, len(scratch.roles))
+	for name := range scratch.roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rebuilt := make(map[string]bool)
+	for _, name := range names {
+		if touched[name] {
+			rebuilt[name] = true
+			continue
+		}
+
+		for parent := range scratch.roles[name].AllParents() {
+			if touched[parent] {
+				rebuilt[name] = true
+				break
+			}
+		}
+	}
+
+	var order []string
+	visited := make(map[string]bool)
+
+	var visit func(name string)
+	visit = func(name string) {
+		if visited[name] || !rebuilt[name] {
+			return
+		}
+		visited[name] = true
+
+		for parent := range scratch.roles[name].Parents() {
+			visit(parent)
+		}
+		order = append(order, name)
+	}
+
+	for _, name := range names {
+		visit(name)
+	}
+	return order
+}
+
+// roleState is the own rules and the parents of a role.
+type roleState struct {
+	perms   map[string]bool
+	denials map[string]bool
+	parents map[string]Roler
+}
+
+func stateOf(role Roler) roleState {
+	return roleState{perms: role.Permissions(), denials: denialsOf(role), parents: role.Parents()}
+}
+
+// targetState returns the state of the role with the name in the scratch
+// registry, with the parents among the roles after the commit. A parent from
+// outside the registry is kept as it is.
+func targetState(scratch *Registry, roles map[string]Roler, name string) roleState {
+	s := scratch.roles[name]
+	state := stateOf(s)
+
+	parents := make(map[string]Roler, len(state.parents))
+	for parent := range state.parents {
+		if p, ok := roles[parent]; ok {
+			parents[parent] = p
+		} else {
+			parents[parent] = unwrapRole(roles[name]).GetParent(parent)
+		}
+	}
+	state.parents = parents
+	return state
+}
+
+// syncRoles changes the innermost roles to the states, so wrappers such as
+// StoredRole and NotifyingRole do not see the changes. The rules and
+// parents to drop are dropped from all the roles first, so the changes
+// never close a cycle on the way.
+func syncRoles(roles map[string]Roler, states map[string]roleState) error {
+	names := make([]string, 0, len(states))
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		role, state := unwrapRole(roles[name]), states[name]
+		cur := stateOf(role)
+
+		for perm := range cur.perms {
+			if !state.perms[perm] {
+				if err := role.Revoke(perm); err != nil {
+					return err
+				}
+			}
+		}
+
+		for perm := range cur.denials {
+			if !state.denials[perm] {
+				if err := undeny(role, perm); err != nil {
+					return err
+				}
+			}
+		}
+
+		for parent, p := range cur.parents {
+			if state.parents[parent] != p {
+				if err := role.RemoveParent(parent); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, name := range names {
+		role, state := unwrapRole(roles[name]), states[name]
+		cur := stateOf(role)
+
+		for perm := range state.perms {
+			if !cur.perms[perm] {
+				if err := role.Permit(perm); err != nil {
+					return err
+				}
+			}
+		}
+
+		for perm := range state.denials {
+			if !cur.denials[perm] {
+				if err := deny(role, perm); err != nil {
+					return err
+				}
+			}
+		}
+
+		for parent, p := range state.parents {
+			if cur.parents[parent] != p {
+				if err := role.SetParent(p); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// saveBatch writes the changes of a batch, as made to the scratch registry,
+// to the store of the registry and returns the function that undoes them.
+// If the store fails, the changes written so far are undone as far as
+// the store allows.
+// The caller must hold the lock of the registry.
+func (reg *Registry) saveBatch(scratch *Registry, touched map[string]bool) (func(), error) {
+	var undo []func()
+	undoAll := func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i]()
+		}
+	}
+
+	if reg.store == nil {
+		return undoAll, nil
+	}
+
+	fail := func(err error) (func(), error) {
+		undoAll()
+		return nil, err
+	}
+
+	names := make([]string, 0, len(touched))
+	for name := range touched {
+		if _, ok := scratch.roles[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := reg.store.SaveRole(RecordOf(scratch.roles[name])); err != nil {
+			return fail(err)
+		}
+
+		if old, ok := reg.roles[name]; ok {
+			rec := RecordOf(old)
+			undo = append(undo, func() { reg.store.SaveRole(rec) })
+		} else {
+			name := name
+			undo = append(undo, func() { reg.store.DeleteRole(name) })
+		}
+	}
+
+	deleted := make(map[string]bool)
+	for name, role := range reg.roles {
+		if _, ok := scratch.roles[name]; ok {
+			continue
+		}
+
+		if err := reg.store.DeleteRole(name); err != nil {
+			return fail(err)
+		}
+		deleted[name] = true
+
+		rec := RecordOf(role)
+		undo = append(undo, func() { reg.store.SaveRole(rec) })
+	}
+
+	store, ok := reg.store.(AssignmentStore)
+	if !ok {
+		return undoAll, nil
+	}
+
+	for subject, roles := range scratch.assignments {
+		for name := range roles {
+			if reg.assignments[subject][name] {
+				continue
+			}
+
+			if err := store.SaveAssignment(subject, name); err != nil {
+				return fail(err)
+			}
+
+			subject, name := subject, name
+			undo = append(undo, func() { store.DeleteAssignment(subject, name) })
+		}
+	}
+
+	for subject, roles := range reg.assignments {
+		for name := range roles {
+			if scratch.assignments[subject][name] || deleted[name] {
+				continue
+			}
+
+			if err := store.DeleteAssignment(subject, name); err != nil {
+				return fail(err)
+			}
+
+			subject, name := subject, name
+			undo = append(undo, func() { store.SaveAssignment(subject, name) })
+		}
+	}
+	return undoAll, nil
+}
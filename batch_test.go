@@ -0,0 +1,577 @@
+package grbac
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func batchCommit(newFunc NewFunc, t *testing.T) {
+	reg := NewRegistry(RoleFactory(newFunc))
+	reg.Create("General")
+	reg.Create("Other")
+	reg.Get("General").Permit("ReadMsg")
+	roleOther := reg.Get("Other")
+	reg.Snapshot()
+
+	b := reg.Batch()
+	b.Create("User")
+	b.Create("Admin")
+	b.Permit("User", "SendMsg")
+	b.Deny("Admin", "ReadMsg")
+	b.Undeny("Admin", "ReadMsg")
+	b.SetParent("User", "General")
+	b.SetParent("Admin", "User")
+	b.Assign("alice", "Admin")
+
+	if reg.Has("User") {
+		t.Fatalf("expected that the batch is not applied before Commit")
+	}
+
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reg.IsAllowed("Admin", "ReadMsg", "SendMsg") || !reg.Can("alice", "SendMsg") {
+		t.Errorf("expected that Admin inherits the permissions of User and General")
+	}
+
+	if !reg.Snapshot().IsAllowed("Admin", "ReadMsg", "SendMsg") {
+		t.Errorf("expected that the snapshot is compiled after Commit")
+	}
+
+	if reg.Get("Other") != roleOther {
+		t.Errorf("expected that the unchanged roles are kept")
+	}
+
+	// General must still pass its changes to its new children.
+	if err := reg.Get("General").Permit("EditMsg"); err != nil {
+		t.Fatal(err)
+	}
+	if !reg.IsAllowed("Admin", "EditMsg") {
+		t.Errorf("expected that Admin inherits the new permission of General")
+	}
+
+	b = reg.Batch()
+	b.Revoke("General", "ReadMsg")
+	b.Remove("User")
+	if err := b.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if reg.Has("User") || reg.Get("Admin").HasParent("User") || reg.Can("alice", "SendMsg") {
+		t.Errorf("expected that User is removed with its links")
+	}
+
+	if err := b.Commit(); err != ErrBatchDone {
+		t.Errorf("expected \"%v\", got \"%v\"", ErrBatchDone, err)
+	}
+}
+
+func batchRollback(newFunc NewFunc, t *testing.T) {
+	reg := NewRegistry(RoleFactory(newFunc))
+	reg.Create("General")
+	reg.Create("User")
+	reg.Get("General").Permit("ReadMsg")
+	reg.SetParent("User", "General")
+	before := reg.Policy()
+
+	b := reg.Batch()
+	b.Permit("User", "SendMsg")
+	b.Create("Admin")
+	b.SetParent("Admin", "User")
+	b.SetParent("User", "General")
+
+	err := b.Commit()
+	be, ok := err.(*BatchError)
+	if !ok || be.Index != 3 || be.Op != "set-parent" || be.Err != ErrRoleHasParent {
+		t.Fatalf("expected a BatchError of the last change, got %v", err)
+	}
+
+	if !reflect.DeepEqual(reg.Policy(), before) {
+		t.Errorf("expected that the registry is not changed: %+v", reg.Policy())
+	}
+
+	if err := reg.Get("General").Permit("EditMsg"); err != nil {
+		t.Fatal(err)
+	}
+	if !reg.IsAllowed("User", "ReadMsg", "EditMsg") || reg.IsAllowed("User", "SendMsg") {
+		t.Errorf("expected that User keeps the old rules and parents")
+	}
+
+	fail := errors.New("fail")
+	err = reg.Update(func(b *Batch) error {
+		b.Permit("User", "SendMsg")
+		return fail
+	})
+	if err != fail || reg.IsAllowed("User", "SendMsg") {
+		t.Errorf("expected that Update rolls the batch back")
+	}
+}
+
+func batchKeepRoles(newFunc NewFunc, t *testing.T) {
+	log := &auditLog{}
+	reg := NewRegistry(RoleFactory(newFunc))
+
+	roleUser := NewAuditedRole(newFunc("User"), log)
+	reg.Add(roleUser)
+	roleGuest := NewNotifyingRole(newFunc("Guest"), nil)
+	reg.Add(roleGuest)
+	roleAdmin, _ := reg.Create("Admin")
+
+	err := reg.Update(func(b *Batch) error {
+		b.Permit("User", "ReadMsg")
+		b.SetParent("Admin", "User")
+		b.SetParent("Guest", "User")
+		b.Deny("Guest", "ReadMsg")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r, ok := reg.Get("User").(*AuditedRole); !ok || r != roleUser {
+		t.Errorf("expected that User keeps its wrapper: %T", reg.Get("User"))
+	}
+	if reg.Get("Guest") != Roler(roleGuest) || reg.Get("Admin") != roleAdmin {
+		t.Errorf("expected that the changed roles are kept")
+	}
+
+	if !roleAdmin.IsAllowed("ReadMsg") || roleGuest.IsAllowed("ReadMsg") || !roleUser.IsAllowed("ReadMsg") {
+		t.Errorf("expected that the roles got before Commit see the changes")
+	}
+
+	if len(log.changes) != 1 || log.changes[0].Kind != EventPermit || log.changes[0].Permission != "ReadMsg" {
+		t.Errorf("expected that the audited role reports the change of the batch: %+v", log.changes)
+	}
+
+	// The kept roles still pass their changes to their new children.
+	roleUser.Permit("SendMsg")
+	if !roleAdmin.IsAllowed("SendMsg") || !roleGuest.IsAllowed("SendMsg") {
+		t.Errorf("expected that Admin and Guest inherit the new permission of User")
+	}
+}
+
+func TestDefaultRoleBatchCommit(t *testing.T) {
+	batchCommit(newRole, t)
+}
+
+func TestCachedRoleBatchCommit(t *testing.T) {
+	batchCommit(newCachedRole, t)
+}
+
+func TestDefaultRoleBatchKeepRoles(t *testing.T) {
+	batchKeepRoles(newRole, t)
+}
+
+func TestCachedRoleBatchKeepRoles(t *testing.T) {
+	batchKeepRoles(newCachedRole, t)
+}
+
+func TestDefaultRoleBatchRollback(t *testing.T) {
+	batchRollback(newRole, t)
+}
+
+func TestCachedRoleBatchRollback(t *testing.T) {
+	batchRollback(newCachedRole, t)
+}
+
+func TestBatchSessions(t *testing.T) {
+	reg := NewRegistry(RoleFactory(newCachedRole))
+	reg.Create("User")
+	reg.Create("Admin")
+	reg.Assign("alice", "User")
+	reg.Assign("alice", "Admin")
+
+	s := reg.NewSession("alice", 0)
+	s.Activate("User")
+	s.Activate("Admin")
+
+	err := reg.Update(func(b *Batch) error {
+		b.Permit("User", "ReadMsg")
+		b.Unassign("alice", "Admin")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active := s.ActiveRoles()
+	if len(active) != 1 || active["User"] != reg.Get("User") || !s.IsAllowed("ReadMsg") {
+		t.Errorf("expected that the session has only the new User role: %v", active)
+	}
+}
+
+func TestBatchStore(t *testing.T) {
+	store := NewMemoryStore()
+	reg, err := LoadRegistry(store, RoleFactory(newCachedRole))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = reg.Update(func(b *Batch) error {
+		b.Create("User")
+		b.Create("Admin")
+		b.Permit("User", "ReadMsg")
+		b.SetParent("Admin", "User")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec, err := store.LoadRole("Admin"); err != nil || !reflect.DeepEqual(rec.Parents, []string{"User"}) {
+		t.Errorf("expected that Admin is saved with its parent: %+v, %v", rec, err)
+	}
+
+	// Later changes of the new roles are written through.
+	if err := reg.Get("User").Permit("SendMsg"); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := store.LoadRole("User"); len(rec.Permissions) != 2 {
+		t.Errorf("expected that User is saved with both permissions: %+v", rec)
+	}
+
+	if err := reg.Update(func(b *Batch) error { b.Remove("User"); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := store.LoadRole("Admin"); len(rec.Parents) != 0 {
+		t.Errorf("expected that Admin is saved without its parent: %+v", rec)
+	}
+	if _, err := store.LoadRole("User"); err != ErrNoRole {
+		t.Errorf("expected that User is deleted from the store")
+	}
+}
+
+func TestBatchEvents(t *testing.T) {
+	bus := NewEventBus()
+	var events []Event
+	bus.Subscribe(func(e Event) { events = append(events, e) })
+
+	reg := NewRegistry(func(name string) Roler {
+		return NewNotifyingRole(NewCachedRole(name), bus)
+	})
+
+	err := reg.Update(func(b *Batch) error {
+		b.Create("User")
+		b.Create("Admin")
+		b.Permit("User", "ReadMsg")
+		b.SetParent("Admin", "User")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 2 || events[0].Kind != EventPermit || events[0].Permission != "ReadMsg" ||
+		events[1].Kind != EventSetParent || events[1].Parent != "User" {
+		t.Errorf("expected the events of the batch only: %+v", events)
+	}
+
+	if !reg.IsAllowed("Admin", "ReadMsg") {
+		t.Errorf("expected that Admin inherits ReadMsg")
+	}
+}
+
+func TestBatchEventOrder(t *testing.T) {
+	bus := NewEventBus()
+	reg := NewRegistry(func(name string) Roler {
+		return NewNotifyingRole(NewCachedRole(name), bus)
+	})
+	roleUser, _ := reg.Create("User")
+
+	var last Event
+	var mutex sync.Mutex
+	done := make(chan error, 1)
+
+	bus.Subscribe(func(e Event) {
+		// The revocation made while the event of the batch is delivered
+		// must wait for it.
+		if e.Kind == EventPermit {
+			go func() { done <- roleUser.Revoke("ReadMsg") }()
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		mutex.Lock()
+		last = e
+		mutex.Unlock()
+	})
+
+	if err := reg.Update(func(b *Batch) error { b.Permit("User", "ReadMsg"); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if last.Kind != EventRevoke || roleUser.IsAllowed("ReadMsg") {
+		t.Errorf("expected that the revocation is published last, got %v", last.Kind)
+	}
+}
+
+// registryAuditor reads the registry on every reported change.
+type registryAuditor struct {
+	reg      *Registry
+	subjects []map[string]bool
+}
+
+func (a *registryAuditor) AuditChange(e Event) {
+	a.subjects = append(a.subjects, a.reg.SubjectsOf(e.Role))
+}
+
+func (a *registryAuditor) AuditDecision(AuditDecision) {}
+
+func TestBatchReadersOfRegistry(t *testing.T) {
+	bus := NewEventBus()
+	reg := NewRegistry(func(name string) Roler {
+		return NewNotifyingRole(NewCachedRole(name), bus)
+	})
+	reg.Create("User")
+	reg.Create("Admin")
+
+	var allowed []bool
+	bus.Subscribe(func(Event) {
+		allowed = append(allowed, reg.Compile().IsAllowed("Admin", "ReadMsg"))
+	})
+
+	auditor := &registryAuditor{reg: reg}
+	reg.SetAuditor(auditor)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- reg.Update(func(b *Batch) error {
+			b.Permit("User", "ReadMsg")
+			b.SetParent("Admin", "User")
+			b.Assign("alice", "Admin")
+			return nil
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected that Commit does not wait for the readers of the registry forever")
+	}
+
+	if len(allowed) != 2 || !allowed[0] || !allowed[1] {
+		t.Errorf("expected that the subscriber sees the whole batch: %v", allowed)
+	}
+	if len(auditor.subjects) != 1 || !auditor.subjects[0]["alice"] {
+		t.Errorf("expected that the auditor sees the assignment: %v", auditor.subjects)
+	}
+}
+
+func TestPolicyBuildBatchError(t *testing.T) {
+	p := &Policy{Roles: []RoleRecord{
+		{Name: "User", Permissions: []string{"ReadMsg"}},
+		{Name: "Admin", Parents: []string{"User", "Guest"}},
+	}}
+
+	_, err := p.Build(nil)
+	pe, ok := err.(*PolicyError)
+	if !ok || pe.Role != "Admin" || pe.Parent != "Guest" || pe.Err != ErrNoRole {
+		t.Errorf("expected a PolicyError of the unknown parent, got %v", err)
+	}
+}
+
+// failingStore fails to save the roles after fail is set.
+type failingStore struct {
+	*MemoryStore
+	fail bool
+}
+
+func (s *failingStore) SaveRole(rec RoleRecord) error {
+	if s.fail {
+		return errors.New("fail")
+	}
+	return s.MemoryStore.SaveRole(rec)
+}
+
+func TestCachedRoleBatchSaveError(t *testing.T) {
+	store := &failingStore{MemoryStore: NewMemoryStore()}
+	reg, err := LoadRegistry(store, RoleFactory(newCachedRole))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roleGeneral, _ := reg.Create("General")
+	roleUser, _ := reg.Create("User")
+	reg.SetParent("User", "General")
+	reg.Add(NewRole("Plain"))
+	store.fail = true
+
+	err = reg.Update(func(b *Batch) error {
+		b.Permit("User", "ReadMsg")
+		b.SetParent("User", "Plain")
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("expected that the batch fails to be saved")
+	}
+
+	if reg.Get("User") != roleUser || unwrapRole(roleGeneral).(CachedRoler).Children()["User"] != unwrapRole(roleUser) {
+		t.Errorf("expected that General keeps the old User as its child")
+	}
+
+	store.fail = false
+	roleGeneral.Permit("EditMsg")
+	if !roleUser.IsAllowed("EditMsg") || roleUser.IsAllowed("ReadMsg") {
+		t.Errorf("expected that the old User still inherits from General")
+	}
+}
+
+func TestCachedRoleBatchApplyError(t *testing.T) {
+	reg := NewRegistry(RoleFactory(newCachedRole))
+	reg.Create("General")
+	roleUser, _ := reg.Create("User")
+	reg.Add(minimalRole{NewRole("Plain")})
+
+	// The copy of the registry takes the denial, the role itself does not.
+	err := reg.Update(func(b *Batch) error {
+		b.Create("Admin")
+		b.Permit("General", "ReadMsg")
+		b.SetParent("User", "General")
+		b.SetParent("Admin", "General")
+		b.Deny("Plain", "ReadMsg")
+		return nil
+	})
+	if err != ErrNoDenials {
+		t.Fatalf("expected \"%v\", got \"%v\"", ErrNoDenials, err)
+	}
+
+	roleGeneral := reg.Get("General")
+	if reg.Has("Admin") || roleUser.HasParent("General") || len(roleGeneral.Permissions()) != 0 {
+		t.Errorf("expected that the changes are undone")
+	}
+	if children := unwrapRole(roleGeneral).(CachedRoler).Children(); len(children) != 0 {
+		t.Errorf("expected that General has no children: %v", children)
+	}
+
+	roleGeneral.Permit("EditMsg")
+	if roleUser.IsAllowed("EditMsg") || roleGeneral.IsAllowed("ReadMsg") || !roleGeneral.IsAllowed("EditMsg") {
+		t.Errorf("expected that the caches are recounted after the undo")
+	}
+}
+
+func TestCachedRoleBatchPlainParent(t *testing.T) {
+	reg := NewRegistry(RoleFactory(newCachedRole))
+	reg.Create("General")
+	reg.Create("User")
+	reg.SetParent("User", "General")
+	rolePlain := NewRole("Plain")
+	reg.Add(rolePlain)
+
+	err := reg.Update(func(b *Batch) error {
+		b.Permit("Plain", "ReadMsg")
+		b.SetParent("User", "Plain")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reg.IsAllowed("User", "ReadMsg") {
+		t.Errorf("expected that User inherits ReadMsg from Plain")
+	}
+
+	reg.Get("Plain").Permit("SendMsg")
+	if !reg.IsAllowed("User", "SendMsg") {
+		t.Errorf("expected that User sees the changes of Plain")
+	}
+}
+
+func TestCachedRoleBatchRecreate(t *testing.T) {
+	reg := NewRegistry(RoleFactory(newCachedRole))
+	roleGeneral, _ := reg.Create("General")
+	oldUser, _ := reg.Create("User")
+	reg.SetParent("User", "General")
+
+	err := reg.Update(func(b *Batch) error {
+		b.Remove("User")
+		b.Create("User")
+		b.SetParent("User", "General")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roleUser := reg.Get("User")
+	if roleUser == oldUser || oldUser.HasParent("General") {
+		t.Errorf("expected that the removed User leaves General")
+	}
+	if children := roleGeneral.(CachedRoler).Children(); len(children) != 1 || children["User"] != roleUser {
+		t.Errorf("expected that General has the new User as its child: %v", children)
+	}
+
+	roleGeneral.Permit("ReadMsg")
+	if !roleUser.IsAllowed("ReadMsg") || oldUser.IsAllowed("ReadMsg") {
+		t.Errorf("expected that only the new User inherits the changes of General")
+	}
+
+	if err := roleGeneral.(*CachedRole).Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCachedRoleBatchConcurrentReaders(t *testing.T) {
+	reg := NewRegistry(RoleFactory(newCachedRole))
+	roleGeneral, _ := reg.Create("General")
+	roleUser, _ := reg.Create("User")
+	reg.SetParent("User", "General")
+	roleGeneral.Permit("a")
+	reg.Compile()
+
+	swap := func(from, to string) error {
+		return reg.Update(func(b *Batch) error {
+			b.Revoke("General", from)
+			b.Permit("General", to)
+			return nil
+		})
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			s := reg.Snapshot()
+			if s.IsAllowed("User", "a") == s.IsAllowed("User", "b") {
+				t.Errorf("expected that the snapshot has either a or b")
+				return
+			}
+
+			for _, role := range []Roler{roleGeneral, roleUser} {
+				if perms := role.AllPermissions(); perms["a"] == perms["b"] {
+					t.Errorf("expected that %s has either a or b: %v", role.Name(), perms)
+					return
+				}
+			}
+		}
+	}()
+
+	for i := 0; i < 5000; i++ {
+		if err := swap("a", "b"); err != nil {
+			t.Fatal(err)
+		}
+		if err := swap("b", "a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
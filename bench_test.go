@@ -247,3 +247,155 @@ func BenchmarkGrandPermsListLvlCachedLineCheckPermissions(b *testing.B) {
 	newFunc := func(name string) Roler { return NewCachedRole(name) }
 	lineCheckPermissions(newFunc, 1, 1, 100000, -1, b)
 }
+
+func compiledLineCheckPermissions(newFunc NewFunc, countParents, deep, countPerms, choiceLvl int, b *testing.B) {
+	rootRole := generateHierarchy(newFunc, countParents, deep, countPerms)
+
+	perms := make([]string, 6)
+	for i := range perms {
+		permList := getParentOnLvl(rootRole, choiceLvl).Permissions()
+		perms[i] = randomChoicePerm(getPermissionsList(permList))
+	}
+
+	snapshot := Compile(rootRole)
+
+	b.ResetTimer()
+	b.RunParallel(
+		func(pb *testing.PB) {
+			for pb.Next() {
+				if !snapshot.IsAllowed("root", perms...) {
+					b.Error("Expected that rootRole has all permissions")
+				}
+			}
+		})
+}
+
+func BenchmarkLongInheritChainCompiledLineCheckPermissions(b *testing.B) {
+	newFunc := func(name string) Roler { return NewCachedRole(name) }
+	compiledLineCheckPermissions(newFunc, 1, 1000, 1, -1, b)
+}
+
+func BenchmarkGrandPermsListCompiledLineCheckPermissions(b *testing.B) {
+	newFunc := func(name string) Roler { return NewCachedRole(name) }
+	compiledLineCheckPermissions(newFunc, 1, 1, 100000, -1, b)
+}
+
+func listCheckPermissions(countParents, deep, countPerms, choiceLvl int, b *testing.B) {
+	newFunc := func(name string) Roler { return NewCachedRole(name) }
+	rootRole := generateHierarchy(newFunc, countParents, deep, countPerms).(*CachedRole)
+
+	perms := make([]string, 6)
+	for i := range perms {
+		permList := getParentOnLvl(rootRole, choiceLvl).Permissions()
+		perms[i] = randomChoicePerm(getPermissionsList(permList))
+	}
+
+	list := NewPermList(perms...)
+
+	b.ResetTimer()
+	b.RunParallel(
+		func(pb *testing.PB) {
+			for pb.Next() {
+				if !rootRole.IsAllowedList(list) {
+					b.Error("Expected that rootRole has all permissions")
+				}
+			}
+		})
+}
+
+func BenchmarkLongInheritChainListCheckPermissions(b *testing.B) {
+	listCheckPermissions(1, 1000, 1, -1, b)
+}
+
+func BenchmarkGrandPermsListListCheckPermissions(b *testing.B) {
+	listCheckPermissions(1, 1, 100000, -1, b)
+}
+
+// generateDiamonds makes a hierarchy below the root role with the levels
+// of the width, where every role inherits two roles of the previous level.
+func generateDiamonds(newFunc NewFunc, width, deep, countPerms int) Roler {
+	root := newFunc("root")
+	prev := []Roler{root}
+
+	for lvl := 1; lvl <= deep; lvl++ {
+		roles := generateRoles(newFunc, "lvl"+strconv.Itoa(lvl), width, countPerms)
+		for i, role := range roles {
+			for _, parent := range []Roler{prev[i%len(prev)], prev[(i+1)%len(prev)]} {
+				if role.HasParent(parent.Name()) {
+					continue
+				}
+				if err := role.SetParent(parent); err != nil {
+					panic(err)
+				}
+			}
+		}
+		prev = roles
+	}
+	return root
+}
+
+func rootWritePermissions(newFunc NewFunc, width, deep, countPerms int, b *testing.B) {
+	root := generateDiamonds(newFunc, width, deep, countPerms)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := root.Permit("RootPerm"); err != nil {
+			b.Fatal(err)
+		}
+		if err := root.Revoke("RootPerm"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDiamondsDefaultRootWritePermissions(b *testing.B) {
+	newFunc := func(name string) Roler { return NewRole(name) }
+	rootWritePermissions(newFunc, 20, 20, 10, b)
+}
+
+func BenchmarkDiamondsCachedRootWritePermissions(b *testing.B) {
+	newFunc := func(name string) Roler { return NewCachedRole(name) }
+	rootWritePermissions(newFunc, 20, 20, 10, b)
+}
+
+// registryWritePermissions changes a leaf of a registry of count roles in
+// a binary tree, each with countPerms permissions, which has a snapshot.
+func registryWritePermissions(newFunc NewFunc, count, countPerms int, b *testing.B) {
+	reg := NewRegistry(RoleFactory(newFunc))
+	for i := 0; i < count; i++ {
+		name := "role" + strconv.Itoa(i)
+		role, _ := reg.Create(name)
+		for j := 0; j < countPerms; j++ {
+			role.Permit(name + "_perm" + strconv.Itoa(j))
+		}
+
+		if i > 0 {
+			if err := reg.SetParent(name, "role"+strconv.Itoa((i-1)/2)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	reg.Compile()
+
+	leaf := "role" + strconv.Itoa(count-1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := reg.Permit(leaf, "LeafPerm"); err != nil {
+			b.Fatal(err)
+		}
+		if err := reg.Revoke(leaf, "LeafPerm"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSmallRegistryCachedWritePermissions(b *testing.B) {
+	newFunc := func(name string) Roler { return NewCachedRole(name) }
+	registryWritePermissions(newFunc, 100, 10, b)
+}
+
+func BenchmarkBigRegistryCachedWritePermissions(b *testing.B) {
+	newFunc := func(name string) Roler { return NewCachedRole(name) }
+	registryWritePermissions(newFunc, 10000, 10, b)
+}
@@ -0,0 +1,460 @@
+package grbac
+
+import (
+	"strings"
+)
+
+const (
+	chunkShift = 12                    // log2 of the number of IDs in a chunk
+	chunkWords = 1 << (chunkShift - 6) // number of words in a chunk
+)
+
+// bitChunk holds the bits of 1<<chunkShift consecutive IDs.
+type bitChunk [chunkWords]uint64
+
+// wordOf returns the index of the word of the ID in its chunk.
+func wordOf(id permID) int {
+	return int(id>>6) & (chunkWords - 1)
+}
+
+// bitset is a set of permission IDs. It keeps a directory of the chunks
+// from the lowest to the highest used one, where the chunks without IDs
+// are nil, so a set takes 512 bytes for every chunk it uses and 8 bytes for
+// every 4096 IDs of the intern table between its lowest and highest IDs.
+type bitset struct {
+	base   int // index of the first chunk
+	chunks []*bitChunk
+}
+
+// chunk returns the chunk with the absolute index i, or nil.
+func (b *bitset) chunk(i int) *bitChunk {
+	i -= b.base
+	if i < 0 || i >= len(b.chunks) {
+		return nil
+	}
+	return b.chunks[i]
+}
+
+func (b *bitset) set(id permID) {
+	c := int(id >> chunkShift)
+
+	switch {
+	case len(b.chunks) == 0:
+		b.base = c
+		b.chunks = []*bitChunk{nil}
+
+	case c < b.base:
+		chunks := make([]*bitChunk, b.base-c, b.base-c+len(b.chunks))
+		b.chunks = append(chunks, b.chunks...)
+		b.base = c
+
+	case c >= b.base+len(b.chunks):
+		b.chunks = append(b.chunks, make([]*bitChunk, c-b.base-len(b.chunks)+1)...)
+	}
+
+	chunk := b.chunks[c-b.base]
+	if chunk == nil {
+		chunk = &bitChunk{}
+		b.chunks[c-b.base] = chunk
+	}
+	chunk[wordOf(id)] |= 1 << (id & 63)
+}
+
+func (b *bitset) clear(id permID) {
+	chunk := b.chunk(int(id >> chunkShift))
+	if chunk == nil {
+		return
+	}
+
+	chunk[wordOf(id)] &^= 1 << (id & 63)
+	if chunk.isEmpty() {
+		b.chunks[int(id>>chunkShift)-b.base] = nil
+		b.trim()
+	}
+}
+
+func (b *bitset) has(id permID) bool {
+	chunk := b.chunk(int(id >> chunkShift))
+	return chunk != nil && chunk[wordOf(id)]&(1<<(id&63)) != 0
+}
+
+func (b *bitset) isEmpty() bool {
+	return len(b.chunks) == 0
+}
+
+func (c *bitChunk) isEmpty() bool {
+	for _, w := range c {
+		if w != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// containsAll checks that b has all the IDs of o.
+func (b *bitset) containsAll(o *bitset) bool {
+	for i, oc := range o.chunks {
+		if oc == nil {
+			continue
+		}
+
+		bc := b.chunk(o.base + i)
+		if bc == nil {
+			return false
+		}
+
+		for k, w := range oc {
+			if w&^bc[k] != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// bitWord is a word of a set with its absolute index.
+type bitWord struct {
+	index int
+	bits  uint64
+}
+
+// words returns the non-empty words of the set.
+func (b *bitset) words() []bitWord {
+	var words []bitWord
+	for i, chunk := range b.chunks {
+		if chunk == nil {
+			continue
+		}
+
+		for k, w := range chunk {
+			if w != 0 {
+				words = append(words, bitWord{index: (b.base+i)*chunkWords + k, bits: w})
+			}
+		}
+	}
+	return words
+}
+
+// word returns the word with the absolute index i.
+func (b *bitset) word(i int) uint64 {
+	chunk := b.chunk(i / chunkWords)
+	if chunk == nil {
+		return 0
+	}
+	return chunk[i%chunkWords]
+}
+
+// containsWords checks that b has all the IDs of the words.
+func (b *bitset) containsWords(words []bitWord) bool {
+	for _, w := range words {
+		if w.bits&^b.word(w.index) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// intersectsWords checks that b has an ID of the words.
+func (b *bitset) intersectsWords(words []bitWord) bool {
+	for _, w := range words {
+		if w.bits&b.word(w.index) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// each calls fn for every ID of the set.
+func (b *bitset) each(fn func(permID)) {
+	for i, chunk := range b.chunks {
+		if chunk == nil {
+			continue
+		}
+
+		for k, w := range chunk {
+			first := permID((b.base+i)<<chunkShift + k<<6)
+			for bit := permID(0); w != 0; bit++ {
+				if w&1 != 0 {
+					fn(first + bit)
+				}
+				w >>= 1
+			}
+		}
+	}
+}
+
+// trim drops the nil chunks at the ends of the directory.
+func (b *bitset) trim() {
+	start, end := 0, len(b.chunks)
+	for start < end && b.chunks[start] == nil {
+		start++
+	}
+	for end > start && b.chunks[end-1] == nil {
+		end--
+	}
+
+	if start == end {
+		*b = bitset{}
+		return
+	}
+
+	b.base += start
+	b.chunks = b.chunks[start:end]
+}
+
+// shared returns a copy of the set for setShared and clearShared. The copy
+// has its own directory but shares the chunks with the set.
+func (b *bitset) shared() bitset {
+	return bitset{base: b.base, chunks: append([]*bitChunk(nil), b.chunks...)}
+}
+
+// own copies the chunk of the ID in a set made by shared on its first
+// change, which is recorded in copied.
+func (b *bitset) own(id permID, copied map[int]bool) {
+	c := int(id >> chunkShift)
+	if copied[c] {
+		return
+	}
+	copied[c] = true
+
+	if chunk := b.chunk(c); chunk != nil {
+		dup := *chunk
+		b.chunks[c-b.base] = &dup
+	}
+}
+
+// setShared is set for a set made by shared.
+func (b *bitset) setShared(id permID, copied map[int]bool) {
+	b.own(id, copied)
+	b.set(id)
+}
+
+// clearShared is clear for a set made by shared.
+func (b *bitset) clearShared(id permID, copied map[int]bool) {
+	b.own(id, copied)
+	b.clear(id)
+}
+
+// unionBits makes a new set with the IDs of all the sets.
+func unionBits(sets ...*bitset) bitset {
+	lo, hi := -1, -1
+	for _, s := range sets {
+		if len(s.chunks) == 0 {
+			continue
+		}
+
+		if lo < 0 || s.base < lo {
+			lo = s.base
+		}
+		if end := s.base + len(s.chunks); end > hi {
+			hi = end
+		}
+	}
+
+	if lo < 0 {
+		return bitset{}
+	}
+
+	u := bitset{base: lo, chunks: make([]*bitChunk, hi-lo)}
+	for _, s := range sets {
+		for i, chunk := range s.chunks {
+			if chunk == nil {
+				continue
+			}
+
+			uc := u.chunks[s.base+i-lo]
+			if uc == nil {
+				uc = &bitChunk{}
+				u.chunks[s.base+i-lo] = uc
+			}
+			for k, w := range chunk {
+				uc[k] |= w
+			}
+		}
+	}
+	return u
+}
+
+// ruleSet is a set of permissions and patterns kept as a bitset of
+// interned IDs. The patterns are also kept in a trie for matching.
+//
+// A ruleSet made by ruleSetOf or unionRules is never changed, so it can be
+// shared by the roles and snapshots.
+type ruleSet struct {
+	bits     bitset
+	patterns []permID
+	trie     *patternNode
+}
+
+// ruleSetOf makes a set of the permissions from the map.
+func ruleSetOf(perms map[string]bool) ruleSet {
+	list := make([]string, 0, len(perms))
+	for perm := range perms {
+		list = append(list, perm)
+	}
+
+	var s ruleSet
+	for i, id := range permTable.internAll(list) {
+		s.addID(list[i], id)
+	}
+	return s
+}
+
+// add adds the permission. The set must not have it.
+func (s *ruleSet) add(perm string) {
+	s.addID(perm, permTable.intern(perm))
+}
+
+// addID is add for the interned permission.
+func (s *ruleSet) addID(perm string, id permID) {
+	s.bits.set(id)
+
+	if IsPattern(perm) {
+		s.patterns = append(s.patterns, id)
+		if s.trie == nil {
+			s.trie = &patternNode{}
+		}
+		s.trie.insert(perm)
+	}
+}
+
+// remove removes the permission.
+func (s *ruleSet) remove(perm string) {
+	id, ok := permTable.lookup(perm)
+	if !ok {
+		return
+	}
+	s.bits.clear(id)
+
+	if !IsPattern(perm) {
+		return
+	}
+
+	patterns := s.patterns[:0]
+	for _, p := range s.patterns {
+		if p != id {
+			patterns = append(patterns, p)
+		}
+	}
+	s.patterns = patterns
+	s.trie = trieOf(patterns)
+}
+
+func (s *ruleSet) isEmpty() bool {
+	return s.bits.isEmpty() && len(s.patterns) == 0
+}
+
+// match checks that the permission is in the set or matched by a pattern
+// of the set.
+func (s *ruleSet) match(perm string) bool {
+	if id, ok := permTable.lookup(perm); ok && s.bits.has(id) {
+		return true
+	}
+
+	if s.trie == nil {
+		return false
+	}
+	return s.trie.match(strings.Split(perm, PermSeparator))
+}
+
+// matchID is like match for an interned permission.
+func (s *ruleSet) matchID(id permID) bool {
+	if s.bits.has(id) {
+		return true
+	}
+
+	if s.trie == nil {
+		return false
+	}
+	return s.trie.match(strings.Split(permTable.name(id), PermSeparator))
+}
+
+// perms returns a map of the permissions and patterns of the set.
+func (s *ruleSet) perms() map[string]bool {
+	perms := make(map[string]bool)
+	s.bits.each(func(id permID) {
+		perms[permTable.name(id)] = true
+	})
+	return perms
+}
+
+// unionRules makes a new set with the rules of all the sets.
+func unionRules(sets ...*ruleSet) ruleSet {
+	bits := make([]*bitset, len(sets))
+	for i, s := range sets {
+		bits[i] = &s.bits
+	}
+
+	u := ruleSet{bits: unionBits(bits...)}
+
+	seen := make(map[permID]bool)
+	for _, s := range sets {
+		for _, id := range s.patterns {
+			if !seen[id] {
+				seen[id] = true
+				u.patterns = append(u.patterns, id)
+			}
+		}
+	}
+
+	u.trie = trieOf(u.patterns)
+	return u
+}
+
+func trieOf(patterns []permID) *patternNode {
+	if len(patterns) == 0 {
+		return nil
+	}
+
+	trie := &patternNode{}
+	for _, id := range patterns {
+		trie.insert(permTable.name(id))
+	}
+	return trie
+}
+
+// isAllowedIn checks the permissions against the effective grants and
+// denials like Roler.IsAllowed.
+func isAllowedIn(grants, denials *ruleSet, perms []string) bool {
+	hasDenials := !denials.isEmpty()
+
+	for _, perm := range perms {
+		if !grants.match(perm) {
+			return false
+		}
+
+		if hasDenials && denials.match(perm) {
+			return false
+		}
+	}
+	return true
+}
+
+// isListAllowedIn is like isAllowedIn for a prepared list. Only
+// the permissions that are not granted exactly are matched one by one.
+func isListAllowedIn(grants, denials *ruleSet, l *PermList) bool {
+	if !grants.bits.containsWords(l.words) {
+		if grants.trie == nil {
+			return false
+		}
+
+		for _, id := range l.ids {
+			if !grants.matchID(id) {
+				return false
+			}
+		}
+	}
+
+	if denials.bits.intersectsWords(l.words) {
+		return false
+	}
+
+	if denials.trie != nil {
+		for _, id := range l.ids {
+			if denials.matchID(id) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,149 @@
+package grbac
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestBitset(t *testing.T) {
+	var a, b bitset
+	for _, id := range []permID{300, 5, 1000, 64} {
+		a.set(id)
+	}
+
+	var ids []permID
+	a.each(func(id permID) { ids = append(ids, id) })
+	if !reflect.DeepEqual(ids, []permID{5, 64, 300, 1000}) {
+		t.Errorf("incorrect IDs of the set: %v", ids)
+	}
+
+	words := []bitWord{{0, 1 << 5}, {1, 1}, {4, 1 << 44}, {15, 1 << 40}}
+	if !reflect.DeepEqual(a.words(), words) {
+		t.Errorf("incorrect words of the set: %v", a.words())
+	}
+
+	if a.has(6) || a.has(2000) || !a.has(1000) {
+		t.Errorf("has returned an incorrect answer")
+	}
+
+	b.set(64)
+	b.set(1000)
+	if !a.containsAll(&b) || b.containsAll(&a) || !b.intersectsWords(a.words()) {
+		t.Errorf("expected that a contains b")
+	}
+
+	a.clear(1000)
+	a.clear(64)
+	if a.intersectsWords(b.words()) || a.has(1000) {
+		t.Errorf("expected that the IDs are cleared")
+	}
+
+	u := unionBits(&a, &b, &bitset{})
+	if !u.containsAll(&a) || !u.containsAll(&b) || u.base != 0 || len(u.chunks) != 1 {
+		t.Errorf("incorrect union: %+v", u)
+	}
+
+	a.clear(5)
+	a.clear(300)
+	if u := unionBits(&a); len(u.chunks) != 0 {
+		t.Errorf("expected that the union of empty sets has no chunks: %+v", u)
+	}
+}
+
+func TestBitsetSparse(t *testing.T) {
+	var b bitset
+	for _, id := range []permID{1 << 21, 7, 1<<21 + 1, 64} {
+		b.set(id)
+	}
+
+	if b.chunk(0) == nil || b.chunk(1) != nil || b.chunk(1<<21>>chunkShift) == nil {
+		t.Errorf("expected that only the used chunks are allocated")
+	}
+	if !b.has(1<<21+1) || b.has(1<<21+2) || b.has(1<<20) {
+		t.Errorf("has returned an incorrect answer")
+	}
+
+	s := b.shared()
+	copied := make(map[int]bool)
+	s.setShared(1<<21+2, copied)
+	s.clearShared(7, copied)
+	s.clearShared(64, copied)
+	if !b.has(7) || b.has(1<<21+2) || !s.has(1<<21+2) {
+		t.Errorf("expected that a shared copy does not change the set")
+	}
+	if s.base != 1<<21>>chunkShift || len(s.chunks) != 1 {
+		t.Errorf("expected that the empty chunks are dropped: %+v", s)
+	}
+}
+
+func TestInternTable(t *testing.T) {
+	table := newInternTable()
+
+	for i := 0; i < 3000; i++ {
+		if id := table.intern("perm" + strconv.Itoa(i)); id != permID(i) {
+			t.Fatalf("expected ID %d, got %d", i, id)
+		}
+	}
+
+	if m := table.maps.Load().(*internMaps); len(m.frozen) == 0 || m.recent.isFull() {
+		t.Errorf("expected that the recent permissions are merged: %d, %d", len(m.frozen), m.recent.count)
+	}
+
+	ids := table.internAll([]string{"perm1", "new1", "new2", "new1"})
+	if ids[0] != 1 || ids[1] != 3000 || ids[2] != 3001 || ids[3] != 3000 {
+		t.Errorf("incorrect IDs of internAll: %v", ids)
+	}
+
+	for i := 0; i < 3000; i++ {
+		perm := "perm" + strconv.Itoa(i)
+		if id, ok := table.lookup(perm); !ok || table.name(id) != perm || table.intern(perm) != id {
+			t.Fatalf("incorrect ID of %s: %d, %v", perm, id, ok)
+		}
+	}
+
+	if _, ok := table.lookup("unknown"); ok {
+		t.Errorf("expected that lookup does not intern permissions")
+	}
+}
+
+func checkPermList(newFunc NewCachedFunc, t *testing.T) {
+	roleUser := newFunc("User")
+	roleUser.Permit("ReadMsg")
+	roleUser.Permit("msg:*")
+
+	roleGuest := newFunc("Guest")
+	roleGuest.Permit("ReadProfile")
+	roleGuest.(Denier).Deny("msg:delete")
+	roleGuest.SetParent(roleUser)
+
+	lists := map[*PermList]bool{
+		NewPermList("ReadMsg", "ReadProfile"):             true,
+		NewPermList("ReadMsg", "msg:send", "ReadProfile"): true,
+		NewPermList("ReadMsg", "msg:delete"):              false,
+		NewPermList("ReadMsg", "SendMsg"):                 false,
+		NewPermList():                                     true,
+	}
+
+	snapshot := Compile(roleGuest)
+	cached, ok := roleGuest.(interface {
+		IsAllowedList(*PermList) bool
+	})
+	if !ok {
+		t.Fatalf("expected that the role has IsAllowedList")
+	}
+
+	for l, expected := range lists {
+		if cached.IsAllowedList(l) != expected || roleGuest.IsAllowed(l.Perms()...) != expected {
+			t.Errorf("role: expected %v for %v", expected, l.Perms())
+		}
+
+		if snapshot.IsAllowedList("Guest", l) != expected {
+			t.Errorf("snapshot: expected %v for %v", expected, l.Perms())
+		}
+	}
+}
+
+func TestCachedRoleCheckPermList(t *testing.T) {
+	checkPermList(newCachedRoleCR, t)
+}
@@ -0,0 +1,222 @@
+package grbac
+
+// cacheDelta is a change of the effective rules of a CachedRole, pushed down
+// to its children.
+type cacheDelta struct {
+	addGrants, delGrants   []permID
+	addDenials, delDenials []permID
+
+	// liveChanged is set if the live roles of the role changed.
+	liveChanged bool
+}
+
+func (d *cacheDelta) isEmpty() bool {
+	return len(d.addGrants) == 0 && len(d.delGrants) == 0 &&
+		len(d.addDenials) == 0 && len(d.delDenials) == 0 && !d.liveChanged
+}
+
+func (d *cacheDelta) merge(o cacheDelta) {
+	d.addGrants = append(d.addGrants, o.addGrants...)
+	d.delGrants = append(d.delGrants, o.delGrants...)
+	d.addDenials = append(d.addDenials, o.addDenials...)
+	d.delDenials = append(d.delDenials, o.delDenials...)
+	d.liveChanged = d.liveChanged || o.liveChanged
+}
+
+// addDelta returns the delta that adds the rules.
+func addDelta(grants, denials ruleSet) cacheDelta {
+	return cacheDelta{addGrants: idsOf(&grants.bits), addDenials: idsOf(&denials.bits)}
+}
+
+// delDelta returns the delta that removes the rules.
+func delDelta(grants, denials ruleSet) cacheDelta {
+	return cacheDelta{delGrants: idsOf(&grants.bits), delDenials: idsOf(&denials.bits)}
+}
+
+func idsOf(b *bitset) []permID {
+	var ids []permID
+	b.each(func(id permID) { ids = append(ids, id) })
+	return ids
+}
+
+// countRules changes the counted rules by the delta and returns the new
+// rules and the IDs that entered and left them.
+//
+// An ID is in the rules while it has a reference from the role itself or
+// from any of its direct parents. The bitset of the rules holds the IDs with
+// at least one reference and extra the number of the other references, so
+// extra stays empty unless the hierarchy has diamonds or a role repeats
+// a rule of its parents. The rules are not changed, as they may be shared:
+// the new rules share the chunks of the bitset that the delta leaves as
+// they are.
+func countRules(rules ruleSet, extra map[permID]int32, add, del []permID) (ruleSet, []permID, []permID) {
+	if len(add) == 0 && len(del) == 0 {
+		return rules, nil, nil
+	}
+
+	bits := rules.bits.shared()
+	copied := make(map[int]bool)
+
+	var added, removed []permID
+	patternsChanged := false
+
+	// Additions go first, so an ID that one parent gains while another
+	// loses it never leaves the rules.
+	for _, id := range add {
+		if bits.has(id) {
+			extra[id]++
+			continue
+		}
+
+		bits.setShared(id, copied)
+		added = append(added, id)
+		patternsChanged = patternsChanged || IsPattern(permTable.name(id))
+	}
+
+	for _, id := range del {
+		if n := extra[id]; n > 0 {
+			if n == 1 {
+				delete(extra, id)
+			} else {
+				extra[id] = n - 1
+			}
+			continue
+		}
+
+		bits.clearShared(id, copied)
+		removed = append(removed, id)
+		patternsChanged = patternsChanged || IsPattern(permTable.name(id))
+	}
+
+	counted := ruleSet{bits: bits, patterns: rules.patterns, trie: rules.trie}
+
+	if patternsChanged {
+		counted.patterns = nil
+		bits.each(func(id permID) {
+			if IsPattern(permTable.name(id)) {
+				counted.patterns = append(counted.patterns, id)
+			}
+		})
+		counted.trie = trieOf(counted.patterns)
+	}
+	return counted, added, removed
+}
+
+// recountRules counts the rules of all the sources from scratch.
+func recountRules(sources []*ruleSet) (ruleSet, map[permID]int32) {
+	extra := make(map[permID]int32)
+
+	var seen bitset
+	for _, s := range sources {
+		s.bits.each(func(id permID) {
+			if seen.has(id) {
+				extra[id]++
+			} else {
+				seen.set(id)
+			}
+		})
+	}
+
+	return unionRules(sources...), extra
+}
+
+// diffIDs returns the IDs of a that are not in b.
+func diffIDs(a, b *bitset) []permID {
+	var ids []permID
+	a.each(func(id permID) {
+		if !b.has(id) {
+			ids = append(ids, id)
+		}
+	})
+	return ids
+}
+
+// propagate pushes the delta of the role down to all its descendants. Every
+// descendant is visited once, after all its changed parents, and gets
+// the merged deltas of them.
+//
+// Children that are not CachedRole cannot take deltas; they are returned to
+// be updated with UpdateCache once hierarchyMutex is released.
+// The caller must hold hierarchyMutex.
+func propagate(root *CachedRole, d cacheDelta) []CachedRoler {
+	if d.isEmpty() {
+		return nil
+	}
+
+	order, children := descendantsOf(root)
+	pending := make(map[*CachedRole]*cacheDelta, len(order))
+	foreign := make(map[CachedRoler]bool)
+
+	push := func(from *CachedRole, d cacheDelta) {
+		for _, child := range children[from] {
+			c, ok := child.(*CachedRole)
+			if !ok {
+				foreign[child] = true
+				continue
+			}
+
+			if pending[c] == nil {
+				pending[c] = &cacheDelta{}
+			}
+			pending[c].merge(d)
+		}
+	}
+
+	push(root, d)
+	for _, c := range order {
+		if in := pending[c]; in != nil {
+			if out := c.applyDelta(*in); !out.isEmpty() {
+				push(c, out)
+			}
+		}
+	}
+
+	list := make([]CachedRoler, 0, len(foreign))
+	for child := range foreign {
+		list = append(list, child)
+	}
+	return list
+}
+
+// descendantsOf returns the CachedRole descendants of the role, every
+// descendant after all its parents among them, and the children of the role
+// and the descendants.
+func descendantsOf(root *CachedRole) ([]*CachedRole, map[*CachedRole][]CachedRoler) {
+	children := make(map[*CachedRole][]CachedRoler)
+	var postorder []*CachedRole
+
+	var visit func(r *CachedRole)
+	visit = func(r *CachedRole) {
+		r.mutex.RLock()
+		list := make([]CachedRoler, 0, len(r.children))
+		for _, child := range r.children {
+			list = append(list, child)
+		}
+		r.mutex.RUnlock()
+		children[r] = list
+
+		for _, child := range list {
+			if c, ok := child.(*CachedRole); ok {
+				if _, visited := children[c]; !visited {
+					visit(c)
+					postorder = append(postorder, c)
+				}
+			}
+		}
+	}
+	visit(root)
+
+	order := make([]*CachedRole, len(postorder))
+	for i, c := range postorder {
+		order[len(postorder)-1-i] = c
+	}
+	return order, children
+}
+
+// updateForeign updates the caches of the children that could not take
+// the deltas. The caller must not hold hierarchyMutex.
+func updateForeign(children []CachedRoler) {
+	for _, child := range children {
+		child.UpdateCache()
+	}
+}
@@ -3,11 +3,13 @@ package grbac
 import (
 	"errors"
 	"sync"
+	"time"
 )
 
 var (
 	ErrNoChild       = errors.New("child does not exist")
 	ErrNoCachedRoler = errors.New("parent is not CachedRoler!")
+	ErrChildExists   = errors.New("parent already has another child with the name")
 )
 
 type CachedRoler interface {
@@ -18,10 +20,56 @@ type CachedRoler interface {
 	UpdateCache()
 }
 
+// CachedRole is a Role that keeps its effective rules, with the parental
+// ones, in bitset caches, so its checks do not walk the parents.
+//
+// Every change of the caches is made under hierarchyMutex, one lock of
+// the whole process rather than of the role graph, because the graphs can
+// be joined by any SetParent. The changes of all the cached roles, even of
+// unrelated graphs or registries, run one at a time then, each for as long
+// as it takes to push its deltas down to the descendants. The checks do
+// not take the lock. With many writers, coalesce the changes with
+// Registry.Batch or SetRebuildDelay, which recount the caches once for
+// many changes and so hold the lock for less.
 type CachedRole struct {
 	*Role
-	children   map[string]CachedRoler
-	permsCache map[string]bool
+	children map[string]CachedRoler
+
+	// ownGrants and ownDenials mirror the rules of the role itself,
+	// permsCache and denyCache are the effective rules with the parental
+	// ones. The caches are replaced, never changed, so they may be shared.
+	ownGrants  ruleSet
+	ownDenials ruleSet
+	permsCache ruleSet
+	denyCache  ruleSet
+
+	// grantExtra and denyExtra count the references to the IDs of
+	// the caches beyond the first one, see countRules.
+	grantExtra map[permID]int32
+	denyExtra  map[permID]int32
+
+	// live are the parents and inherited ancestors that are neither cached
+	// nor trusted to notify of their changes, so their rules are checked on
+	// every call; ownLive are the live direct parents. The maps are
+	// replaced, never changed.
+	live    map[string]Roler
+	ownLive map[string]Roler
+
+	// watches are the subscriptions to the buses of the notifying parents.
+	watches map[string]*parentWatch
+
+	// delay is the delay of the background rebuilds, see SetRebuildDelay.
+	// timer is the pending rebuild and fresh is closed once it is done;
+	// both are nil if no rebuild is pending.
+	delay time.Duration
+	timer *time.Timer
+	fresh chan struct{}
+
+	// held keeps the caches as they are until release, see hold.
+	held bool
+
+	// generation counts the changes of the caches.
+	generation uint64
 
 	mutex sync.RWMutex
 }
@@ -30,7 +78,9 @@ func NewCachedRole(name string) *CachedRole {
 	return &CachedRole{
 		Role:       NewRole(name),
 		children:   make(map[string]CachedRoler),
-		permsCache: make(map[string]bool),
+		grantExtra: make(map[permID]int32),
+		denyExtra:  make(map[permID]int32),
+		watches:    make(map[string]*parentWatch),
 	}
 }
 
@@ -61,76 +111,362 @@ func (r *CachedRole) RemoveChild(name string) {
 	delete(r.children, name)
 }
 
+// UpdateCache recounts the caches of the role from its own rules and
+// the caches of its parents, and pushes the difference down to the children.
+// A pending background rebuild is done by it.
 func (r *CachedRole) UpdateCache() {
-	perms := r.Role.AllPermissions()
+	hierarchyMutex.Lock()
+	fresh := r.takePending()
+	r.update(r.recount())
+
+	if fresh != nil {
+		close(fresh)
+	}
+}
+
+// recount counts the caches and the live roles from scratch and returns
+// the change of them. The caller must hold hierarchyMutex.
+func (r *CachedRole) recount() cacheDelta {
+	grants, denials, ownLive := r.sources()
+	live := r.inheritLive(ownLive)
+	names := r.watchedNames()
 
 	r.mutex.Lock()
-	r.permsCache = perms
-	r.mutex.Unlock()
+	defer r.mutex.Unlock()
 
-	for _, child := range r.Children() {
-		child.UpdateCache()
+	oldGrants, oldDenials := r.permsCache, r.denyCache
+	r.permsCache, r.grantExtra = recountRules(grants)
+	r.denyCache, r.denyExtra = recountRules(denials)
+
+	liveChanged := !sameRoles(live, r.live)
+	r.live, r.ownLive = live, ownLive
+	for name, w := range r.watches {
+		w.names = names[name]
 	}
+
+	d := cacheDelta{
+		addGrants:   diffIDs(&r.permsCache.bits, &oldGrants.bits),
+		delGrants:   diffIDs(&oldGrants.bits, &r.permsCache.bits),
+		addDenials:  diffIDs(&r.denyCache.bits, &oldDenials.bits),
+		delDenials:  diffIDs(&oldDenials.bits, &r.denyCache.bits),
+		liveChanged: liveChanged,
+	}
+	if !d.isEmpty() {
+		r.generation++
+	}
+	return d
 }
 
-func (r *CachedRole) AllPermissions() map[string]bool {
-	newPerms := make(map[string]bool)
+// sources returns the rules the caches are counted from: the rules of
+// the cached and notifying parents and the own rules of the role. The other
+// parents are returned as live.
+func (r *CachedRole) sources() (grants, denials []*ruleSet, ownLive map[string]Roler) {
+	parents := r.Role.Parents()
+	grants = make([]*ruleSet, 0, len(parents)+1)
+	denials = make([]*ruleSet, 0, len(parents)+1)
+
+	for name, p := range parents {
+		if parentKindOf(p) == parentLive {
+			if ownLive == nil {
+				ownLive = make(map[string]Roler)
+			}
+			ownLive[name] = p
+			continue
+		}
+
+		g, d := countedRulesOf(p)
+		grants = append(grants, &g)
+		denials = append(denials, &d)
+	}
 
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
-	for p := range r.permsCache {
-		newPerms[p] = true
+	own, ownDenials := r.ownGrants, r.ownDenials
+	return append(grants, &own), append(denials, &ownDenials), ownLive
+}
+
+// inheritLive returns the live roles of the role: the live direct parents
+// and the live roles of the cached parents.
+func (r *CachedRole) inheritLive(ownLive map[string]Roler) map[string]Roler {
+	var live map[string]Roler
+	add := func(roles map[string]Roler) {
+		for name, role := range roles {
+			if live == nil {
+				live = make(map[string]Roler)
+			}
+			live[name] = role
+		}
 	}
 
-	return newPerms
+	add(ownLive)
+	for _, p := range r.Role.Parents() {
+		if c, ok := unwrapRole(p).(*CachedRole); ok {
+			add(c.liveRoles())
+		}
+	}
+	return live
+}
+
+func (r *CachedRole) liveRoles() map[string]Roler {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.live
+}
+
+func sameRoles(a, b map[string]Roler) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, role := range a {
+		if b[name] != role {
+			return false
+		}
+	}
+	return true
+}
+
+// applyDelta counts the delta into the caches and returns the change of
+// the caches. The delta is dropped if a rebuild is pending or the caches
+// are held, as they are recounted anyway. The caller must hold
+// hierarchyMutex.
+func (r *CachedRole) applyDelta(d cacheDelta) cacheDelta {
+	var live map[string]Roler
+	if d.liveChanged {
+		live = r.inheritLive(r.ownLiveRoles())
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var out cacheDelta
+	if r.timer != nil || r.held {
+		return out
+	}
+
+	r.permsCache, out.addGrants, out.delGrants = countRules(r.permsCache, r.grantExtra, d.addGrants, d.delGrants)
+	r.denyCache, out.addDenials, out.delDenials = countRules(r.denyCache, r.denyExtra, d.addDenials, d.delDenials)
+
+	if d.liveChanged && !sameRoles(live, r.live) {
+		r.live = live
+		out.liveChanged = true
+	}
+
+	if !out.isEmpty() {
+		r.generation++
+	}
+	return out
+}
+
+func (r *CachedRole) ownLiveRoles() map[string]Roler {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.ownLive
+}
+
+// change counts the delta into the caches and propagates it.
+// The caller must hold hierarchyMutex, which change releases.
+func (r *CachedRole) change(d cacheDelta) {
+	r.update(r.applyDelta(d))
+}
+
+// update propagates the change of the caches of the role.
+// The caller must hold hierarchyMutex, which update releases.
+func (r *CachedRole) update(d cacheDelta) {
+	foreign := propagate(r, d)
+	hierarchyMutex.Unlock()
+
+	updateForeign(foreign)
+}
+
+// link makes the role a parent of the role and the role a child of c,
+// the CachedRoler of the parent, or neither of them on failure.
+// The caller must hold hierarchyMutex.
+func (r *CachedRole) link(parent Roler, c CachedRoler) error {
+	if child, ok := c.Children()[r.Name()]; ok && child != CachedRoler(r) {
+		return ErrChildExists
+	}
+
+	if err := r.Role.setParent(parent); err != nil {
+		return err
+	}
+
+	c.SetChild(r)
+	return nil
+}
+
+// unlink removes the parent with the name from the role and the role from
+// the children of the parent. It reports whether the parent was linked by
+// link, so its rules are counted in the caches by deltas.
+// The caller must hold hierarchyMutex.
+func (r *CachedRole) unlink(name string) (parent Roler, linked bool, err error) {
+	parent = r.GetParent(name)
+	if err := r.Role.RemoveParent(name); err != nil {
+		return nil, false, err
+	}
+
+	// A parent set directly on the embedded Role has no child link.
+	c, ok := unwrapRole(parent).(CachedRoler)
+	if !ok || c.Children()[r.Name()] != CachedRoler(r) {
+		return parent, false, nil
+	}
+
+	c.RemoveChild(r.Name())
+	return parent, true, nil
+}
+
+// rules returns the cached grants and denials of the role. They do not
+// have the rules of the live roles.
+func (r *CachedRole) rules() (grants, denials ruleSet) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.permsCache, r.denyCache
+}
+
+func (r *CachedRole) hasLive() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.live != nil
+}
+
+// rulesOf returns the effective grants and denials of any role. The caches
+// of a CachedRole without live roles are used as they are.
+func rulesOf(role Roler) (grants, denials ruleSet) {
+	if c, ok := unwrapRole(role).(*CachedRole); ok && !c.hasLive() {
+		return c.rules()
+	}
+	return ruleSetOf(role.AllPermissions()), ruleSetOf(allDenialsOf(role))
+}
+
+// countedRulesOf returns the rules of the parent counted in the caches of
+// its children. The live roles of a CachedRole are inherited by its children
+// as live roles, so only its caches are counted.
+func countedRulesOf(parent Roler) (grants, denials ruleSet) {
+	if c, ok := unwrapRole(parent).(*CachedRole); ok {
+		return c.rules()
+	}
+	return ruleSetOf(parent.AllPermissions()), ruleSetOf(allDenialsOf(parent))
+}
+
+func (r *CachedRole) AllPermissions() map[string]bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	perms := r.permsCache.perms()
+	for _, role := range r.live {
+		for perm := range role.AllPermissions() {
+			perms[perm] = true
+		}
+	}
+	return perms
 }
 
 func (r *CachedRole) Permit(perm string) error {
+	hierarchyMutex.Lock()
+
 	if err := r.Role.Permit(perm); err != nil {
+		hierarchyMutex.Unlock()
 		return err
 	}
 
-	r.UpdateCache()
+	r.mutex.Lock()
+	r.ownGrants.add(perm)
+	r.mutex.Unlock()
+
+	r.changeOwn(cacheDelta{addGrants: []permID{permTable.intern(perm)}})
 	return nil
 }
 
 func (r *CachedRole) Revoke(perm string) error {
+	hierarchyMutex.Lock()
+
 	if err := r.Role.Revoke(perm); err != nil {
+		hierarchyMutex.Unlock()
 		return err
 	}
 
-	r.UpdateCache()
+	r.mutex.Lock()
+	r.ownGrants.remove(perm)
+	r.mutex.Unlock()
+
+	r.changeOwn(cacheDelta{delGrants: []permID{permTable.intern(perm)}})
 	return nil
 }
 
+// SetParent adds the parent to the role. A parent may be any Roler:
+//
+//   - the rules of a CachedRoler parent are cached and its changes are
+//     pushed down to the role;
+//   - the rules of a parent that notifies of its changes, such as
+//     NotifyingRole, are cached as well if all its ancestors notify the same
+//     EventBus; the role recounts its caches on their events;
+//   - the rules of any other parent are checked live on every call.
 func (r *CachedRole) SetParent(role Roler) error {
-	c, ok := role.(CachedRoler)
-	if !ok {
-		return ErrNoCachedRoler
+	hierarchyMutex.Lock()
+
+	// The child link must not be made for a parent that would close a
+	// cycle, or the propagation would never stop.
+	if err := checkCycle(r.Name(), role); err != nil {
+		hierarchyMutex.Unlock()
+		return err
 	}
 
-	c.SetChild(r)
+	if c, ok := unwrapRole(role).(CachedRoler); ok {
+		if err := r.link(role, c); err != nil {
+			hierarchyMutex.Unlock()
+			return err
+		}
 
-	if err := r.Role.SetParent(role); err != nil {
+		d := addDelta(countedRulesOf(role))
+		if p, ok := c.(*CachedRole); ok {
+			d.liveChanged = p.hasLive()
+		}
+
+		r.changeOwn(d)
+		return nil
+	}
+
+	if err := r.Role.setParent(role); err != nil {
+		hierarchyMutex.Unlock()
 		return err
 	}
+	r.refresh()
 
-	r.UpdateCache()
+	if bus := notifierOf(role); bus != nil {
+		r.watch(role.Name(), bus)
+	}
 	return nil
 }
 
 func (r *CachedRole) RemoveParent(name string) error {
-	if p := r.GetParent(name); p != nil {
-		cachedP := p.(CachedRoler)
-		cachedP.RemoveChild(r.Name())
-	}
+	hierarchyMutex.Lock()
 
-	if err := r.Role.RemoveParent(name); err != nil {
+	parent, linked, err := r.unlink(name)
+	if err != nil {
+		hierarchyMutex.Unlock()
 		return err
 	}
 
-	r.UpdateCache()
+	if !linked {
+		w := r.unwatch(name)
+		r.refresh()
+
+		if w != nil {
+			w.sub.Cancel()
+		}
+		return nil
+	}
+
+	d := delDelta(countedRulesOf(parent))
+	if p, ok := unwrapRole(parent).(*CachedRole); ok {
+		d.liveChanged = p.hasLive()
+	}
+
+	r.changeOwn(d)
 	return nil
 }
 
@@ -138,11 +474,244 @@ func (r *CachedRole) IsAllowed(perms ...string) bool {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
-	for _, permisson := range perms {
-		if !r.permsCache[permisson] {
+	return r.isAllowed(perms)
+}
+
+// isAllowed is IsAllowed for the caller holding the read lock of the role.
+func (r *CachedRole) isAllowed(perms []string) bool {
+	if r.live == nil {
+		return isAllowedIn(&r.permsCache, &r.denyCache, perms)
+	}
+
+	for _, perm := range perms {
+		if !r.isLiveGranted(perm) || r.isLiveDenied(perm) {
 			return false
 		}
 	}
-
 	return true
 }
+
+// IsAllowedList is like IsAllowed for a prepared list of permissions.
+func (r *CachedRole) IsAllowedList(l *PermList) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	if r.live != nil {
+		for _, perm := range l.perms {
+			if !r.isLiveGranted(perm) || r.isLiveDenied(perm) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return isListAllowedIn(&r.permsCache, &r.denyCache, l)
+}
+
+func (r *CachedRole) IsGranted(perm string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.isLiveGranted(perm)
+}
+
+func (r *CachedRole) checkPerm(perm string) (granted, denied bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.isLiveGranted(perm), r.isLiveDenied(perm)
+}
+
+// isLiveGranted checks the permission in the cache and the live roles.
+// The caller must hold the read lock of the role.
+func (r *CachedRole) isLiveGranted(perm string) bool {
+	if r.permsCache.match(perm) {
+		return true
+	}
+
+	for _, role := range r.live {
+		if isGranted(role, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+// isLiveDenied is like isLiveGranted for the denials.
+func (r *CachedRole) isLiveDenied(perm string) bool {
+	if r.denyCache.match(perm) {
+		return true
+	}
+
+	for _, role := range r.live {
+		if isDenied(role, perm) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *CachedRole) AllDenials() map[string]bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	perms := r.denyCache.perms()
+	for _, role := range r.live {
+		for perm := range allDenialsOf(role) {
+			perms[perm] = true
+		}
+	}
+	return perms
+}
+
+func (r *CachedRole) EffectivePermissions() map[string]bool {
+	return effectivePermissions(r.AllPermissions(), r.AllDenials())
+}
+
+func (r *CachedRole) Deny(perm string) error {
+	hierarchyMutex.Lock()
+
+	if err := r.Role.Deny(perm); err != nil {
+		hierarchyMutex.Unlock()
+		return err
+	}
+
+	r.mutex.Lock()
+	r.ownDenials.add(perm)
+	r.mutex.Unlock()
+
+	r.changeOwn(cacheDelta{addDenials: []permID{permTable.intern(perm)}})
+	return nil
+}
+
+func (r *CachedRole) IsDenied(perm string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.isLiveDenied(perm)
+}
+
+func (r *CachedRole) Undeny(perm string) error {
+	hierarchyMutex.Lock()
+
+	if err := r.Role.Undeny(perm); err != nil {
+		hierarchyMutex.Unlock()
+		return err
+	}
+
+	r.mutex.Lock()
+	r.ownDenials.remove(perm)
+	r.mutex.Unlock()
+
+	r.changeOwn(cacheDelta{delDenials: []permID{permTable.intern(perm)}})
+	return nil
+}
+
+// Kinds of the parents of a CachedRole, see SetParent.
+const (
+	parentCached = iota
+	parentNotified
+	parentLive
+)
+
+// parentKindOf returns how the rules of the parent are kept by its
+// CachedRole children.
+func parentKindOf(parent Roler) int {
+	if _, ok := unwrapRole(parent).(CachedRoler); ok {
+		return parentCached
+	}
+
+	bus := notifierOf(parent)
+	if bus == nil {
+		return parentLive
+	}
+
+	// A change of an ancestor that is not published would leave the caches
+	// stale.
+	for _, ancestor := range parent.AllParents() {
+		if notifierOf(ancestor) != bus {
+			return parentLive
+		}
+	}
+	return parentNotified
+}
+
+// parentWatch is a subscription of a CachedRole to the bus of a notifying
+// parent.
+type parentWatch struct {
+	sub *Subscription
+
+	// names are the names of the parent and its ancestors, whose events
+	// make the role recount its caches.
+	names map[string]bool
+}
+
+// watch subscribes the role to the bus of the parent with the name.
+// The caller must not hold hierarchyMutex.
+func (r *CachedRole) watch(name string, bus *EventBus) {
+	w := &parentWatch{}
+	w.sub = bus.Subscribe(func(e Event) {
+		r.mutex.RLock()
+		watched := r.watches[name] == w && w.names[e.Role]
+		r.mutex.RUnlock()
+
+		if watched {
+			r.invalidate()
+		}
+	})
+
+	r.mutex.Lock()
+	old := r.watches[name]
+	r.watches[name] = w
+	r.mutex.Unlock()
+
+	if old != nil {
+		old.sub.Cancel()
+	}
+
+	// The parent may be removed or changed before the subscription.
+	if !r.HasParent(name) {
+		if r.unwatch(name) == w {
+			w.sub.Cancel()
+		}
+		return
+	}
+	r.invalidate()
+}
+
+// unwatch removes the watch of the parent with the name and returns it, so
+// the caller can cancel it without holding hierarchyMutex.
+func (r *CachedRole) unwatch(name string) *parentWatch {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	w := r.watches[name]
+	delete(r.watches, name)
+	return w
+}
+
+// watchedNames returns the names of the watched parents and their ancestors
+// by the names of the parents.
+func (r *CachedRole) watchedNames() map[string]map[string]bool {
+	r.mutex.RLock()
+	watched := make([]string, 0, len(r.watches))
+	for name := range r.watches {
+		watched = append(watched, name)
+	}
+	r.mutex.RUnlock()
+
+	names := make(map[string]map[string]bool, len(watched))
+	for _, name := range watched {
+		parent := r.Role.GetParent(name)
+		if parent == nil {
+			continue
+		}
+
+		set := map[string]bool{name: true}
+		for ancestor := range parent.AllParents() {
+			set[ancestor] = true
+		}
+		names[name] = set
+	}
+	return names
+}
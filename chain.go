@@ -0,0 +1,274 @@
+package grbac
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Error codes returned by VerifyChain.
+var (
+	ErrChainBroken = errors.New("hash of the previous record does not match")
+	ErrChainRecord = errors.New("record cannot be decoded")
+	ErrChainTorn   = errors.New("last record is torn")
+)
+
+// ChainRecord is a line of a hash-chained audit log.
+type ChainRecord struct {
+	// Prev is the hex SHA-256 hash of the previous line without its line
+	// break, empty for the first line.
+	Prev string `json:"prev"`
+
+	// Repair is set instead of the AuditRecord on the line written by
+	// OpenChainAuditor in place of a torn last line.
+	Repair *ChainRepair `json:"repair,omitempty"`
+
+	AuditRecord
+}
+
+// ChainRepair records the torn last line of a log, dropped by
+// OpenChainAuditor.
+type ChainRepair struct {
+	// Line is the number of the dropped line, from 1.
+	Line int `json:"line"`
+
+	// Size and Hash are the length and the hex SHA-256 hash of the dropped
+	// bytes.
+	Size int    `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// ChainError tells where a hash-chained audit log is broken.
+type ChainError struct {
+	// Line is the number of the first line whose link is broken, from 1.
+	Line int
+
+	Err error
+}
+
+func (e *ChainError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ChainError) Unwrap() error {
+	return e.Err
+}
+
+// ChainAuditor is an Auditor that writes a ChainRecord per line. Every line
+// has the hash of the previous one, so an edited or removed line breaks
+// the chain at the next line, see VerifyChain.
+//
+// Write errors are kept like by JSONAuditor.
+type ChainAuditor struct {
+	w    io.Writer
+	prev string
+	err  error
+
+	mutex sync.Mutex
+}
+
+// NewChainAuditor creates a ChainAuditor that starts a new chain in w.
+func NewChainAuditor(w io.Writer) *ChainAuditor {
+	return &ChainAuditor{w: w}
+}
+
+// OpenChainAuditor verifies the chain in the file and opens the file to
+// continue the chain. The file is created if it does not exist.
+//
+// A crash may tear the last line of the file. Such a line is dropped and
+// a ChainRepair record with its hash is written in its place, so the chain
+// shows the repair. A last line without its line break is completed.
+//
+// Returns a ChainError if the chain in the file is broken.
+func OpenChainAuditor(path string) (*ChainAuditor, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	a, err := continueChain(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+func continueChain(f *os.File) (*ChainAuditor, error) {
+	tail, err := verifyChain(f)
+	a := &ChainAuditor{w: f, prev: tail.head}
+
+	if e, ok := err.(*ChainError); ok && e.Err == ErrChainTorn {
+		torn := make([]byte, tail.torn)
+		if _, err := f.ReadAt(torn, tail.size); err != nil {
+			return nil, err
+		}
+
+		if err := f.Truncate(tail.size); err != nil {
+			return nil, err
+		}
+
+		a.writeRecord(ChainRecord{Repair: &ChainRepair{
+			Line: e.Line,
+			Size: len(torn),
+			Hash: hashLine(torn),
+		}})
+		return a, a.err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !tail.complete {
+		if _, err := f.Write([]byte("\n")); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// AuditChange writes the change.
+func (a *ChainAuditor) AuditChange(e Event) {
+	a.write(AuditRecord{Change: &e})
+}
+
+// AuditDecision writes the decision.
+func (a *ChainAuditor) AuditDecision(d AuditDecision) {
+	a.write(AuditRecord{Decision: &d})
+}
+
+func (a *ChainAuditor) write(rec AuditRecord) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.writeRecord(ChainRecord{AuditRecord: rec})
+}
+
+// writeRecord links the record to the chain and writes it.
+// The caller must hold the lock of the auditor.
+func (a *ChainAuditor) writeRecord(rec ChainRecord) {
+	if a.err != nil {
+		return
+	}
+
+	rec.Prev = a.prev
+	line, err := json.Marshal(&rec)
+	if err != nil {
+		a.err = err
+		return
+	}
+
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		a.err = err
+		return
+	}
+
+	a.prev = hashLine(line)
+}
+
+// Head returns the hash of the last written line, empty if there is none.
+// Keeping the head elsewhere allows to detect removed trailing lines.
+func (a *ChainAuditor) Head() string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.prev
+}
+
+// Err returns the first write error.
+func (a *ChainAuditor) Err() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.err
+}
+
+// Close closes the writer of the auditor if it is an io.Closer.
+func (a *ChainAuditor) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if c, ok := a.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// VerifyChain reads a hash-chained audit log and checks the link of every
+// line to the previous one. It returns the hash of the last line, which can
+// be compared with a Head kept elsewhere, or a ChainError for the first
+// broken link.
+//
+// A last line without its line break that cannot be decoded is reported
+// with ErrChainTorn, as it is likely cut by a crash; OpenChainAuditor
+// repairs such logs.
+func VerifyChain(r io.Reader) (head string, err error) {
+	tail, err := verifyChain(r)
+	if err != nil {
+		return "", err
+	}
+	return tail.head, nil
+}
+
+// chainTail is the end of a verified chain.
+type chainTail struct {
+	// head is the hash of the last intact line.
+	head string
+
+	// size is the length of the intact lines, and torn the length of
+	// the torn last line after them.
+	size int64
+	torn int
+
+	// complete is false if the last intact line has no line break.
+	complete bool
+}
+
+func verifyChain(r io.Reader) (chainTail, error) {
+	br := bufio.NewReader(r)
+	tail := chainTail{complete: true}
+
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return tail, nil
+		}
+		if err != nil && err != io.EOF {
+			return tail, err
+		}
+
+		size := len(line)
+		complete := err == nil
+		line = bytes.TrimSuffix(line, []byte("\n"))
+
+		var rec ChainRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			if !complete {
+				tail.torn = size
+				return tail, &ChainError{Line: n, Err: ErrChainTorn}
+			}
+			return tail, &ChainError{Line: n, Err: ErrChainRecord}
+		}
+
+		if rec.Prev != tail.head {
+			return tail, &ChainError{Line: n, Err: ErrChainBroken}
+		}
+
+		tail.head = hashLine(line)
+		tail.size += int64(size)
+		tail.complete = complete
+	}
+}
+
+func hashLine(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
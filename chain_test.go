@@ -0,0 +1,160 @@
+package grbac
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeChain(auditor Auditor) {
+	role := NewAuditedRole(NewRole("User"), auditor)
+	role.Permit("ReadMsg")
+	role.IsAllowed("ReadMsg")
+	role.IsAllowed("DelMsg")
+	role.Revoke("ReadMsg")
+}
+
+func TestChainAuditor(t *testing.T) {
+	var buf bytes.Buffer
+	auditor := NewChainAuditor(&buf)
+	writeChain(auditor)
+
+	if err := auditor.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	log := buf.String()
+	head, err := VerifyChain(strings.NewReader(log))
+	if err != nil || head != auditor.Head() || head == "" {
+		t.Errorf("expected that the chain is intact: %q, %v", head, err)
+	}
+
+	lines := strings.SplitAfter(log, "\n")
+
+	expected := map[string]*ChainError{
+		"edited":  {Line: 4, Err: ErrChainBroken},
+		"removed": {Line: 2, Err: ErrChainBroken},
+		"garbage": {Line: 2, Err: ErrChainRecord},
+	}
+
+	tampered := map[string]string{
+		"edited":  lines[0] + lines[1] + strings.Replace(lines[2], "DelMsg", "SendMsg", 1) + lines[3],
+		"removed": lines[0] + lines[2] + lines[3],
+		"garbage": lines[0] + "{\n" + lines[1],
+	}
+
+	for name, log := range tampered {
+		_, err := VerifyChain(strings.NewReader(log))
+		e, ok := err.(*ChainError)
+		if !ok || *e != *expected[name] {
+			t.Errorf("%s: expected \"%v\", got \"%v\"", name, expected[name], err)
+		}
+	}
+}
+
+func TestOpenChainAuditor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grbac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+
+	auditor, err := OpenChainAuditor(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeChain(auditor)
+	auditor.Close()
+
+	// The reopened auditor continues the chain.
+	auditor, err = OpenChainAuditor(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeChain(auditor)
+	auditor.Close()
+
+	data, _ := ioutil.ReadFile(path)
+	if head, err := VerifyChain(bytes.NewReader(data)); err != nil || head != auditor.Head() {
+		t.Errorf("expected that the chain is intact: %v", err)
+	}
+
+	if n := bytes.Count(data, []byte("\n")); n != 8 {
+		t.Errorf("expected 8 lines, got %d", n)
+	}
+
+	ioutil.WriteFile(path, bytes.Replace(data, []byte("ReadMsg"), []byte("SendMsg"), 1), 0644)
+
+	if _, err := OpenChainAuditor(path); err == nil {
+		t.Errorf("expected that a broken chain is not continued")
+	}
+}
+
+func TestOpenChainAuditorTorn(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grbac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+
+	auditor, err := OpenChainAuditor(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeChain(auditor)
+	auditor.Close()
+
+	data, _ := ioutil.ReadFile(path)
+	torn := append(append([]byte{}, data...), `{"prev":"12`...)
+
+	_, err = VerifyChain(bytes.NewReader(torn))
+	if e, ok := err.(*ChainError); !ok || *e != (ChainError{Line: 5, Err: ErrChainTorn}) {
+		t.Fatalf("expected that the last line is torn, got \"%v\"", err)
+	}
+
+	// The torn line is replaced by a repair record.
+	ioutil.WriteFile(path, torn, 0644)
+	auditor, err = OpenChainAuditor(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeChain(auditor)
+	auditor.Close()
+
+	data, _ = ioutil.ReadFile(path)
+	if head, err := VerifyChain(bytes.NewReader(data)); err != nil || head != auditor.Head() {
+		t.Fatalf("expected that the chain is intact: %v", err)
+	}
+
+	var rec ChainRecord
+	json.Unmarshal(bytes.SplitAfter(data, []byte("\n"))[4], &rec)
+	expected := ChainRepair{Line: 5, Size: 11, Hash: hashLine([]byte(`{"prev":"12`))}
+	if rec.Repair == nil || *rec.Repair != expected {
+		t.Errorf("expected the repair record, got %+v", rec)
+	}
+
+	// The missing line break of an intact last line is completed.
+	ioutil.WriteFile(path, bytes.TrimSuffix(data, []byte("\n")), 0644)
+	auditor, err = OpenChainAuditor(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeChain(auditor)
+	auditor.Close()
+
+	data, _ = ioutil.ReadFile(path)
+	if head, err := VerifyChain(bytes.NewReader(data)); err != nil || head != auditor.Head() {
+		t.Errorf("expected that the chain is intact: %v", err)
+	}
+	if n := bytes.Count(data, []byte("\n")); n != 13 {
+		t.Errorf("expected 13 lines, got %d", n)
+	}
+}
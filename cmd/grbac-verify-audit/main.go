@@ -0,0 +1,63 @@
+// Command grbac-verify-audit checks hash-chained audit logs written by
+// grbac.ChainAuditor.
+//
+// Usage:
+//
+//	grbac-verify-audit [-head HASH] FILE...
+//
+// For every file it prints the number of the first line with a broken link,
+// or the hash of the last line if the chain is intact. With -head the hash
+// of the last line must also match HASH, which detects removed trailing
+// lines. The exit status is 1 if any file fails the check.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/deterok/grbac"
+)
+
+func main() {
+	head := flag.String("head", "", "expected `hash` of the last line")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: grbac-verify-audit [-head HASH] FILE...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	status := 0
+	for _, path := range flag.Args() {
+		if err := verify(path, *head); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			status = 1
+		}
+	}
+	os.Exit(status)
+}
+
+func verify(path, expected string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	head, err := grbac.VerifyChain(f)
+	if err != nil {
+		return err
+	}
+
+	if expected != "" && head != expected {
+		return fmt.Errorf("last line has hash %s, expected %s", head, expected)
+	}
+
+	fmt.Printf("%s: ok, head %s\n", path, head)
+	return nil
+}
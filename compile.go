@@ -0,0 +1,329 @@
+package grbac
+
+import (
+	"sort"
+)
+
+// Snapshot is an immutable compiled form of a role graph. Every role of
+// a snapshot has its effective permissions and denials precomputed as
+// bitsets, so the checks of a snapshot take no locks of the roles and are
+// safe for any number of goroutines.
+//
+// A snapshot does not see later changes of the roles it was compiled from;
+// compile a new one instead.
+type Snapshot struct {
+	roles    *cowMap[*compiledRole]
+	subjects *cowMap[*compiledRole]
+
+	// children are the names of the direct children of the roles and
+	// holders the subjects holding them, so update finds what a change
+	// affects without walking the whole snapshot.
+	children *cowMap[[]string]
+	holders  *cowMap[[]string]
+}
+
+// compiledRole is the frozen rule sets of a role or of all the roles of
+// a subject.
+type compiledRole struct {
+	grants  ruleSet
+	denials ruleSet
+
+	// from are the names of the direct parents of a role or of the roles
+	// of a subject.
+	from []string
+}
+
+// Compile freezes the roles and all their ancestors into a snapshot.
+//
+// A CachedRole is compiled with its caches as they are, without its pending
+// background rebuild, see SetRebuildDelay; call Flush or WaitFresh first to
+// compile the latest changes.
+func Compile(roles ...Roler) *Snapshot {
+	all := make(map[string]Roler)
+	for _, role := range roles {
+		all[role.Name()] = role
+		for name, parent := range role.AllParents() {
+			all[name] = parent
+		}
+	}
+
+	return compile(all, nil)
+}
+
+func compile(roles map[string]Roler, assignments map[string]map[string]bool) *Snapshot {
+	s := &Snapshot{
+		roles:    &cowMap[*compiledRole]{},
+		subjects: &cowMap[*compiledRole]{},
+		children: &cowMap[[]string]{},
+		holders:  &cowMap[[]string]{},
+	}
+
+	for name, role := range roles {
+		s.setRole(name, compileRole(role))
+	}
+
+	for subject, names := range assignments {
+		s.setSubject(subject, s.compileSubject(names))
+	}
+	return s
+}
+
+func compileRole(role Roler) *compiledRole {
+	r := &compiledRole{}
+	r.grants, r.denials = rulesOf(role)
+	for name := range role.Parents() {
+		r.from = append(r.from, name)
+	}
+	return r
+}
+
+// compileSubject unites the compiled roles with the names.
+func (s *Snapshot) compileSubject(names map[string]bool) *compiledRole {
+	var grants, denials []*ruleSet
+	from := make([]string, 0, len(names))
+
+	for name := range names {
+		from = append(from, name)
+		if r, ok := s.roles.get(name); ok {
+			grants = append(grants, &r.grants)
+			denials = append(denials, &r.denials)
+		}
+	}
+
+	return &compiledRole{
+		grants:  unionRules(grants...),
+		denials: unionRules(denials...),
+		from:    from,
+	}
+}
+
+// setRole sets or, if r is nil, drops the compiled role with the name and
+// updates the children of its parents.
+func (s *Snapshot) setRole(name string, r *compiledRole) {
+	if old, ok := s.roles.get(name); ok {
+		unlink(s.children, old.from, name)
+	}
+
+	if r == nil {
+		s.roles.delete(name)
+		return
+	}
+
+	s.roles.set(name, r)
+	link(s.children, r.from, name)
+}
+
+// setSubject is setRole for a subject and the holders of its roles.
+func (s *Snapshot) setSubject(subject string, r *compiledRole) {
+	if old, ok := s.subjects.get(subject); ok {
+		unlink(s.holders, old.from, subject)
+	}
+
+	if r == nil {
+		s.subjects.delete(subject)
+		return
+	}
+
+	s.subjects.set(subject, r)
+	link(s.holders, r.from, subject)
+}
+
+// link adds the name to the index entries of the keys.
+func link(index *cowMap[[]string], keys []string, name string) {
+	for _, key := range keys {
+		names, _ := index.get(key)
+		index.set(key, append(names[:len(names):len(names)], name))
+	}
+}
+
+// unlink removes the name from the index entries of the keys.
+func unlink(index *cowMap[[]string], keys []string, name string) {
+	for _, key := range keys {
+		names, _ := index.get(key)
+		rest := make([]string, 0, len(names))
+		for _, n := range names {
+			if n != name {
+				rest = append(rest, n)
+			}
+		}
+
+		if len(rest) == 0 {
+			index.delete(key)
+		} else {
+			index.set(key, rest)
+		}
+	}
+}
+
+// update returns a copy of the snapshot with the roles with the names and
+// their descendants compiled again, or dropped if they are not in roles
+// any more, and with the subjects holding any of them or listed in
+// subjects compiled again. The rest is shared with the snapshot, so
+// an update costs as much as the roles and subjects it compiles.
+func (s *Snapshot) update(roles map[string]Roler, assignments map[string]map[string]bool, names, subjects []string) *Snapshot {
+	changed := make(map[string]bool)
+	var visit func(name string)
+	visit = func(name string) {
+		if changed[name] {
+			return
+		}
+		changed[name] = true
+
+		children, _ := s.children.get(name)
+		for _, child := range children {
+			visit(child)
+		}
+	}
+	for _, name := range names {
+		visit(name)
+	}
+
+	u := &Snapshot{
+		roles:    s.roles.clone(),
+		subjects: s.subjects.clone(),
+		children: s.children.clone(),
+		holders:  s.holders.clone(),
+	}
+
+	for name := range changed {
+		if role, ok := roles[name]; ok {
+			u.setRole(name, compileRole(role))
+		} else {
+			u.setRole(name, nil)
+		}
+	}
+
+	stale := make(map[string]bool, len(subjects))
+	for _, subject := range subjects {
+		stale[subject] = true
+	}
+	for name := range changed {
+		holders, _ := s.holders.get(name)
+		for _, subject := range holders {
+			stale[subject] = true
+		}
+	}
+
+	for subject := range stale {
+		if held, ok := assignments[subject]; ok {
+			u.setSubject(subject, u.compileSubject(held))
+		} else {
+			u.setSubject(subject, nil)
+		}
+	}
+	return u
+}
+
+// IsAllowed checks the permissions of the role with the name like
+// Roler.IsAllowed. If the snapshot does not have the role, the function
+// returns false.
+func (s *Snapshot) IsAllowed(name string, perms ...string) bool {
+	r, ok := s.roles.get(name)
+	if !ok {
+		return false
+	}
+	return isAllowedIn(&r.grants, &r.denials, perms)
+}
+
+// IsAllowedList is like IsAllowed for a prepared list of permissions.
+func (s *Snapshot) IsAllowedList(name string, l *PermList) bool {
+	r, ok := s.roles.get(name)
+	if !ok {
+		return false
+	}
+	return isListAllowedIn(&r.grants, &r.denials, l)
+}
+
+// Can checks the permissions of the subject like Registry.Can. Only
+// snapshots of a registry have subjects.
+func (s *Snapshot) Can(subject string, perms ...string) bool {
+	r, ok := s.subjects.get(subject)
+	if !ok {
+		return false
+	}
+	return isAllowedIn(&r.grants, &r.denials, perms)
+}
+
+// Has checks that the snapshot has a role with the name.
+func (s *Snapshot) Has(name string) bool {
+	_, ok := s.roles.get(name)
+	return ok
+}
+
+// Roles returns the sorted names of the roles of the snapshot.
+func (s *Snapshot) Roles() []string {
+	names := make([]string, 0, s.roles.len())
+	s.roles.each(func(name string, _ *compiledRole) {
+		names = append(names, name)
+	})
+	sort.Strings(names)
+	return names
+}
+
+// Compile freezes the roles and assignments of the registry into a new
+// snapshot and makes it the current snapshot of the registry.
+//
+// Changes made through the registry, including Registry.Permit and
+// Registry.Deny, compile a new snapshot themselves once the registry has
+// one. Changes made directly to the roles, such as Roler.Permit, are seen
+// only by the next Compile; a NotifyingRole subscriber may call it, as
+// the registry is not locked while its roles publish their changes.
+func (reg *Registry) Compile() *Snapshot {
+	reg.compileMutex.Lock()
+	defer reg.compileMutex.Unlock()
+
+	reg.mutex.RLock()
+	s := compile(reg.roles, reg.assignments)
+	reg.mutex.RUnlock()
+
+	reg.snapshot.Store(s)
+	return s
+}
+
+// Snapshot returns the current snapshot of the registry without taking any
+// lock. The first call compiles the snapshot, see Compile.
+func (reg *Registry) Snapshot() *Snapshot {
+	if s, ok := reg.snapshot.Load().(*Snapshot); ok {
+		return s
+	}
+	return reg.Compile()
+}
+
+// refreshSnapshot compiles a new snapshot if the registry has one.
+// The caller must not hold the lock of the registry.
+func (reg *Registry) refreshSnapshot() {
+	if _, ok := reg.snapshot.Load().(*Snapshot); ok {
+		reg.Compile()
+	}
+}
+
+// refreshRoles is refreshSnapshot after a change of the roles with
+// the names: only they, their descendants and the subjects holding any of
+// them are compiled again, so a change costs as much as the roles it
+// affects rather than the whole registry.
+func (reg *Registry) refreshRoles(names ...string) {
+	reg.refresh(names, nil)
+}
+
+// refreshSubject is refreshRoles after a change of the assignments of
+// the subject.
+func (reg *Registry) refreshSubject(subject string) {
+	reg.refresh(nil, []string{subject})
+}
+
+func (reg *Registry) refresh(names, subjects []string) {
+	if _, ok := reg.snapshot.Load().(*Snapshot); !ok {
+		return
+	}
+
+	reg.compileMutex.Lock()
+	defer reg.compileMutex.Unlock()
+
+	s := reg.snapshot.Load().(*Snapshot)
+
+	reg.mutex.RLock()
+	s = s.update(reg.roles, reg.assignments, names, subjects)
+	reg.mutex.RUnlock()
+
+	reg.snapshot.Store(s)
+}
@@ -0,0 +1,272 @@
+package grbac
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func compileRoles(newFunc NewFunc, t *testing.T) {
+	roleUser := newFunc("User")
+	roleUser.Permit("msg:*")
+	roleUser.Permit("ReadProfile")
+
+	roleGuest := newFunc("Guest")
+	roleGuest.(Denier).Deny("msg:send")
+	roleGuest.SetParent(roleUser)
+
+	s := Compile(roleGuest)
+
+	if !reflect.DeepEqual(s.Roles(), []string{"Guest", "User"}) {
+		t.Errorf("expected that the snapshot has Guest and its parents: %v", s.Roles())
+	}
+
+	if !s.IsAllowed("Guest", "msg:read", "ReadProfile") || !s.IsAllowed("User", "msg:send") {
+		t.Errorf("expected that the snapshot has the inherited permissions")
+	}
+
+	if s.IsAllowed("Guest", "msg:send") || s.IsAllowed("Guest", "msg:read", "DelMsg") {
+		t.Errorf("expected that the snapshot applies the denials")
+	}
+
+	if s.IsAllowed("Admin", "msg:read") || s.Has("Admin") {
+		t.Errorf("expected that the snapshot does not have Admin role")
+	}
+
+	roleGuest.(Denier).Undeny("msg:send")
+	if s.IsAllowed("Guest", "msg:send") {
+		t.Errorf("expected that the snapshot does not change with the roles")
+	}
+}
+
+func compileRegistry(newFunc NewFunc, t *testing.T) {
+	reg := NewRegistry(RoleFactory(newFunc))
+
+	roleUser, _ := reg.Create("User")
+	roleUser.Permit("ReadMsg")
+	reg.Create("Admin")
+	reg.Assign("alice", "Admin")
+
+	s := reg.Snapshot()
+	if s.Can("alice", "ReadMsg") || s != reg.Snapshot() {
+		t.Errorf("expected that Snapshot returns the compiled snapshot")
+	}
+
+	// Changes through the registry swap the snapshot.
+	reg.SetParent("Admin", "User")
+	if !reg.Snapshot().Can("alice", "ReadMsg") || s.Can("alice", "ReadMsg") {
+		t.Errorf("expected that SetParent compiles a new snapshot")
+	}
+
+	// Direct changes of the roles wait for Compile.
+	roleUser.Permit("SendMsg")
+	if reg.Snapshot().IsAllowed("Admin", "SendMsg") {
+		t.Errorf("expected that direct changes are not compiled")
+	}
+
+	reg.Compile()
+	if !reg.Snapshot().IsAllowed("Admin", "SendMsg") {
+		t.Errorf("expected that Compile sees direct changes")
+	}
+
+	// Grants through the registry swap the snapshot as well.
+	if err := reg.Permit("User", "EditMsg"); err != nil {
+		t.Fatal(err)
+	}
+	if !reg.Snapshot().IsAllowed("Admin", "EditMsg") {
+		t.Errorf("expected that Registry.Permit compiles a new snapshot")
+	}
+
+	if err := reg.Deny("Admin", "EditMsg"); err != nil {
+		t.Fatal(err)
+	}
+	if reg.Snapshot().IsAllowed("Admin", "EditMsg") {
+		t.Errorf("expected that Registry.Deny compiles a new snapshot")
+	}
+
+	reg.Undeny("Admin", "EditMsg")
+	reg.Revoke("User", "ReadMsg")
+	if !reg.Snapshot().IsAllowed("Admin", "EditMsg") || reg.Snapshot().IsAllowed("Admin", "ReadMsg") {
+		t.Errorf("expected that Undeny and Revoke compile a new snapshot")
+	}
+
+	if err := reg.Permit("Guest", "ReadMsg"); err != ErrNoRole {
+		t.Errorf("expected \"%v\", got \"%v\"", ErrNoRole, err)
+	}
+
+	reg.Unassign("alice", "Admin")
+	if reg.Snapshot().Can("alice", "EditMsg") {
+		t.Errorf("expected that Unassign compiles a new snapshot")
+	}
+}
+
+func compileConcurrently(newFunc NewFunc, t *testing.T) {
+	reg := NewRegistry(RoleFactory(newFunc))
+	roleUser, _ := reg.Create("User")
+	roleUser.Permit("ReadMsg")
+	reg.Compile()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				name := "Role" + strconv.Itoa(i) + "_" + strconv.Itoa(j)
+				reg.Create(name)
+				reg.SetParent(name, "User")
+			}
+		}(i)
+
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				if !reg.Snapshot().IsAllowed("User", "ReadMsg") {
+					t.Errorf("expected that every snapshot allows ReadMsg for User")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !reg.Snapshot().IsAllowed("Role3_49", "ReadMsg") {
+		t.Errorf("expected that the last snapshot has all the roles")
+	}
+}
+
+func compileFromSubscriber(newFunc NewFunc, t *testing.T) {
+	bus := NewEventBus()
+	reg := NewRegistry(func(name string) Roler {
+		return NewNotifyingRole(newFunc(name), bus)
+	})
+	reg.Create("A")
+	reg.Create("B")
+	reg.Permit("A", "ReadMsg")
+
+	bus.Subscribe(func(Event) { reg.Compile() })
+
+	// The changes of the registry must not wait for the subscriber forever.
+	wait := func(change string, fn func() error) {
+		done := make(chan error, 1)
+		go func() { done <- fn() }()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected that %s does not wait for the subscriber forever", change)
+		}
+	}
+
+	wait("SetParent", func() error { return reg.SetParent("B", "A") })
+	if !reg.Snapshot().IsAllowed("B", "ReadMsg") {
+		t.Errorf("expected that the snapshot has the new parent")
+	}
+
+	wait("Remove", func() error { return reg.Remove("A") })
+	if reg.Snapshot().IsAllowed("B", "ReadMsg") {
+		t.Errorf("expected that the snapshot does not have the removed parent")
+	}
+}
+
+func compileIncrementally(newFunc NewFunc, t *testing.T) {
+	reg := NewRegistry(RoleFactory(newFunc))
+	reg.Compile()
+
+	perms := []string{"ReadMsg", "SendMsg", "DelMsg"}
+	subjects := []string{"alice", "bob"}
+
+	changes := []func() error{
+		func() error { _, err := reg.Create("User"); return err },
+		func() error { return reg.Permit("User", "ReadMsg") },
+		func() error { _, err := reg.Create("Admin"); return err },
+		func() error { return reg.Assign("alice", "Admin") },
+		func() error { return reg.SetParent("Admin", "User") },
+		func() error { return reg.Permit("Admin", "DelMsg") },
+		func() error { _, err := reg.Create("Guest"); return err },
+		func() error { return reg.SetParent("Guest", "User") },
+		func() error { return reg.Assign("bob", "Guest") },
+		func() error { return reg.Permit("User", "SendMsg") },
+		func() error { return reg.Deny("Guest", "SendMsg") },
+		func() error { return reg.Revoke("User", "ReadMsg") },
+		func() error { return reg.RemoveParent("Guest", "User") },
+		func() error { return reg.Remove("User") },
+		func() error { return reg.Unassign("alice", "Admin") },
+		func() error { return reg.Undeny("Guest", "SendMsg") },
+	}
+
+	// Every snapshot updated after a change must equal a compiled one.
+	for i, change := range changes {
+		if err := change(); err != nil {
+			t.Fatal(i, err)
+		}
+
+		updated := reg.Snapshot()
+		reg.Compile()
+		compiled := reg.Snapshot()
+
+		if !reflect.DeepEqual(updated.Roles(), compiled.Roles()) {
+			t.Fatalf("expected the roles %v after change %d, got %v", compiled.Roles(), i, updated.Roles())
+		}
+
+		for _, perm := range perms {
+			for _, name := range compiled.Roles() {
+				if updated.IsAllowed(name, perm) != compiled.IsAllowed(name, perm) {
+					t.Errorf("expected that %s of %s is compiled again after change %d", perm, name, i)
+				}
+			}
+
+			for _, subject := range subjects {
+				if updated.Can(subject, perm) != compiled.Can(subject, perm) {
+					t.Errorf("expected that %s of %s is compiled again after change %d", perm, subject, i)
+				}
+			}
+		}
+	}
+}
+
+func TestDefaultRoleCompile(t *testing.T) {
+	compileRoles(newRole, t)
+}
+
+func TestCachedRoleCompile(t *testing.T) {
+	compileRoles(newCachedRole, t)
+}
+
+func TestDefaultRoleCompileRegistry(t *testing.T) {
+	compileRegistry(newRole, t)
+}
+
+func TestCachedRoleCompileRegistry(t *testing.T) {
+	compileRegistry(newCachedRole, t)
+}
+
+func TestDefaultRoleCompileConcurrently(t *testing.T) {
+	compileConcurrently(newRole, t)
+}
+
+func TestCachedRoleCompileConcurrently(t *testing.T) {
+	compileConcurrently(newCachedRole, t)
+}
+
+func TestDefaultRoleCompileFromSubscriber(t *testing.T) {
+	compileFromSubscriber(newRole, t)
+}
+
+func TestCachedRoleCompileFromSubscriber(t *testing.T) {
+	compileFromSubscriber(newCachedRole, t)
+}
+
+func TestDefaultRoleCompileIncrementally(t *testing.T) {
+	compileIncrementally(newRole, t)
+}
+
+func TestCachedRoleCompileIncrementally(t *testing.T) {
+	compileIncrementally(newCachedRole, t)
+}
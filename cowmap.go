@@ -0,0 +1,70 @@
+package grbac
+
+// cowShards is the number of shards of a cowMap.
+const cowShards = 64
+
+// cowMap is a copy-on-write map split into shards, so a copy with a few
+// keys changed costs as much as the shards of the keys rather than
+// the whole map. A cowMap is never changed once shared; clone it and
+// change the clone.
+type cowMap[V any] struct {
+	shards [cowShards]map[string]V
+
+	// owned are the bits of the shards the map does not share.
+	owned uint64
+}
+
+func shardOf(key string) int {
+	return int(hashString(key) % cowShards)
+}
+
+// clone returns a copy sharing the shards with the map.
+func (m *cowMap[V]) clone() *cowMap[V] {
+	return &cowMap[V]{shards: m.shards}
+}
+
+func (m *cowMap[V]) get(key string) (V, bool) {
+	v, ok := m.shards[shardOf(key)][key]
+	return v, ok
+}
+
+func (m *cowMap[V]) len() int {
+	n := 0
+	for _, shard := range m.shards {
+		n += len(shard)
+	}
+	return n
+}
+
+// each calls fn for every key of the map.
+func (m *cowMap[V]) each(fn func(key string, v V)) {
+	for _, shard := range m.shards {
+		for key, v := range shard {
+			fn(key, v)
+		}
+	}
+}
+
+// own copies the shard of the key if it is shared and returns it.
+func (m *cowMap[V]) own(key string) map[string]V {
+	i := shardOf(key)
+	if m.owned&(1<<i) == 0 {
+		shard := make(map[string]V, len(m.shards[i])+1)
+		for k, v := range m.shards[i] {
+			shard[k] = v
+		}
+		m.shards[i] = shard
+		m.owned |= 1 << i
+	}
+	return m.shards[i]
+}
+
+func (m *cowMap[V]) set(key string, v V) {
+	m.own(key)[key] = v
+}
+
+func (m *cowMap[V]) delete(key string) {
+	if _, ok := m.get(key); ok {
+		delete(m.own(key), key)
+	}
+}
@@ -0,0 +1,415 @@
+package grbac
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventKind is the kind of a change of a role or of its assignments.
+type EventKind int
+
+// Kinds of events.
+const (
+	EventPermit EventKind = iota + 1
+	EventRevoke
+	EventDeny
+	EventUndeny
+	EventSetParent
+	EventRemoveParent
+	EventAssign
+	EventUnassign
+)
+
+var eventKindNames = map[EventKind]string{
+	EventPermit:       "permit",
+	EventRevoke:       "revoke",
+	EventDeny:         "deny",
+	EventUndeny:       "undeny",
+	EventSetParent:    "set-parent",
+	EventRemoveParent: "remove-parent",
+	EventAssign:       "assign",
+	EventUnassign:     "unassign",
+}
+
+func (k EventKind) String() string {
+	if name, ok := eventKindNames[k]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// MarshalText encodes the kind as its name.
+func (k EventKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText decodes the kind from its name.
+func (k *EventKind) UnmarshalText(text []byte) error {
+	for kind, name := range eventKindNames {
+		if name == string(text) {
+			*k = kind
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown event kind %q", text)
+}
+
+// Event describes a change of a role or of its assignments.
+type Event struct {
+	Role string    `json:"role"`
+	Kind EventKind `json:"kind"`
+
+	// Permission is the permission of EventPermit, EventRevoke, EventDeny
+	// and EventUndeny.
+	Permission string `json:"permission,omitempty"`
+
+	// Parent is the parent of EventSetParent and EventRemoveParent.
+	Parent string `json:"parent,omitempty"`
+
+	// Subject is the subject of EventAssign and EventUnassign, which are
+	// reported by a registry to its auditor, see Registry.SetAuditor.
+	Subject string `json:"subject,omitempty"`
+
+	Time time.Time `json:"time"`
+
+	// Actor is who made the change, see WithActor. Empty if unknown.
+	Actor string `json:"actor,omitempty"`
+}
+
+type actorKey struct{}
+
+// WithActor returns a copy of ctx that carries the actor, the user or
+// the service on whose behalf changes are made.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor carried by ctx, empty if none.
+func ActorFrom(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// EventBus delivers events to subscribers.
+//
+// The events of a role are published in the order of its changes, and every
+// subscriber receives them in that order. Events of different roles may be
+// interleaved in any way.
+type EventBus struct {
+	subs map[*Subscription]bool
+
+	mutex sync.RWMutex
+}
+
+// NewEventBus creates a new EventBus without subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{subs: make(map[*Subscription]bool)}
+}
+
+// Subscription is a subscription to an EventBus.
+type Subscription struct {
+	bus *EventBus
+
+	// fn is called in the goroutine of Publish.
+	fn func(Event)
+
+	// queue is the channel of an asynchronous subscriber.
+	queue chan Event
+
+	dropped uint64
+}
+
+// Subscribe calls fn for every event before Publish returns, so the change
+// that caused the event waits for fn. fn must not change roles of the bus or
+// their registry, but it may read them.
+func (b *EventBus) Subscribe(fn func(Event)) *Subscription {
+	return b.add(&Subscription{bus: b, fn: fn})
+}
+
+// SubscribeAsync calls fn for every event in a separate goroutine. Up to size
+// events wait for fn in a queue; events published while the queue is full
+// are dropped, so a slow fn never stalls a change.
+func (b *EventBus) SubscribeAsync(fn func(Event), size int) *Subscription {
+	s := &Subscription{bus: b, queue: make(chan Event, size)}
+
+	go func() {
+		for e := range s.queue {
+			fn(e)
+		}
+	}()
+
+	return b.add(s)
+}
+
+// Channel returns a channel of size that receives the events. Events
+// published while the channel is full are dropped, so a slow reader never
+// stalls a change. The channel is closed when the subscription is
+// cancelled.
+func (b *EventBus) Channel(size int) (<-chan Event, *Subscription) {
+	s := &Subscription{bus: b, queue: make(chan Event, size)}
+	return s.queue, b.add(s)
+}
+
+func (b *EventBus) add(s *Subscription) *Subscription {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.subs[s] = true
+	return s
+}
+
+// Publish delivers the event to all the subscribers. If the event has no
+// time, it is set to the current time.
+func (b *EventBus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	for s := range b.subs {
+		if s.fn != nil {
+			s.fn(e)
+			continue
+		}
+
+		select {
+		case s.queue <- e:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// Cancel stops the delivery of events. Events already queued for
+// an asynchronous subscriber are still delivered.
+func (s *Subscription) Cancel() {
+	s.bus.mutex.Lock()
+	defer s.bus.mutex.Unlock()
+
+	if !s.bus.subs[s] {
+		return
+	}
+
+	delete(s.bus.subs, s)
+	if s.queue != nil {
+		close(s.queue)
+	}
+}
+
+// Dropped returns the number of events dropped because the queue of
+// the subscriber was full.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Notifier is implemented by roles that publish their changes.
+type Notifier interface {
+	Events() *EventBus
+}
+
+// NotifyingRole is a Roler that publishes every change of the wrapped role
+// to an EventBus.
+//
+// The changes of the role are serialized, so its events are published in
+// the order of the changes. Failed changes are not published.
+type NotifyingRole struct {
+	Roler
+	bus *EventBus
+
+	mutex sync.Mutex
+}
+
+// NewNotifyingRole wraps the role. The events are published to bus, which
+// may be shared by many roles; a new bus is made if bus is nil.
+func NewNotifyingRole(role Roler, bus *EventBus) *NotifyingRole {
+	if bus == nil {
+		bus = NewEventBus()
+	}
+	return &NotifyingRole{Roler: role, bus: bus}
+}
+
+// Unwrap returns the wrapped role.
+func (r *NotifyingRole) Unwrap() Roler {
+	return r.Roler
+}
+
+// Events returns the bus the changes of the role are published to.
+func (r *NotifyingRole) Events() *EventBus {
+	return r.bus
+}
+
+// change makes the change and publishes e if it succeeds.
+func (r *NotifyingRole) change(ctx context.Context, e Event, fn func() error) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	e.Role = r.Roler.Name()
+	e.Actor = ActorFrom(ctx)
+	r.bus.Publish(e)
+	return nil
+}
+
+// Permit adds the permission to the role and publishes EventPermit.
+func (r *NotifyingRole) Permit(perm string) error {
+	return r.PermitContext(context.Background(), perm)
+}
+
+// PermitContext is like Permit, the event has the actor of ctx.
+func (r *NotifyingRole) PermitContext(ctx context.Context, perm string) error {
+	return r.change(ctx, Event{Kind: EventPermit, Permission: perm}, func() error {
+		return r.Roler.Permit(perm)
+	})
+}
+
+// Revoke revokes the permission from the role and publishes EventRevoke.
+func (r *NotifyingRole) Revoke(perm string) error {
+	return r.RevokeContext(context.Background(), perm)
+}
+
+// RevokeContext is like Revoke, the event has the actor of ctx.
+func (r *NotifyingRole) RevokeContext(ctx context.Context, perm string) error {
+	return r.change(ctx, Event{Kind: EventRevoke, Permission: perm}, func() error {
+		return r.Roler.Revoke(perm)
+	})
+}
+
+// Deny adds the denial to the role and publishes EventDeny.
+func (r *NotifyingRole) Deny(perm string) error {
+	return r.DenyContext(context.Background(), perm)
+}
+
+// DenyContext is like Deny, the event has the actor of ctx.
+func (r *NotifyingRole) DenyContext(ctx context.Context, perm string) error {
+	return r.change(ctx, Event{Kind: EventDeny, Permission: perm}, func() error {
+		return deny(r.Roler, perm)
+	})
+}
+
+// Undeny removes the denial from the role and publishes EventUndeny.
+func (r *NotifyingRole) Undeny(perm string) error {
+	return r.UndenyContext(context.Background(), perm)
+}
+
+// UndenyContext is like Undeny, the event has the actor of ctx.
+func (r *NotifyingRole) UndenyContext(ctx context.Context, perm string) error {
+	return r.change(ctx, Event{Kind: EventUndeny, Permission: perm}, func() error {
+		return undeny(r.Roler, perm)
+	})
+}
+
+// IsGranted checks the grant like the wrapped role, see Denier.
+func (r *NotifyingRole) IsGranted(perm string) bool {
+	return isGranted(r.Roler, perm)
+}
+
+// IsDenied checks the denial like the wrapped role, see Denier.
+func (r *NotifyingRole) IsDenied(perm string) bool {
+	return isDenied(r.Roler, perm)
+}
+
+// Denials returns the denials of the wrapped role, see Denier.
+func (r *NotifyingRole) Denials() map[string]bool {
+	return denialsOf(r.Roler)
+}
+
+// AllDenials returns the denials of the wrapped role and its parents.
+func (r *NotifyingRole) AllDenials() map[string]bool {
+	return allDenialsOf(r.Roler)
+}
+
+// EffectivePermissions returns the effective permissions of the wrapped
+// role, see Role.EffectivePermissions.
+func (r *NotifyingRole) EffectivePermissions() map[string]bool {
+	return effectivePermissions(r.Roler.AllPermissions(), allDenialsOf(r.Roler))
+}
+
+// SetParent adds the parent to the role and publishes EventSetParent.
+func (r *NotifyingRole) SetParent(role Roler) error {
+	return r.SetParentContext(context.Background(), role)
+}
+
+// SetParentContext is like SetParent, the event has the actor of ctx.
+func (r *NotifyingRole) SetParentContext(ctx context.Context, role Roler) error {
+	return r.change(ctx, Event{Kind: EventSetParent, Parent: role.Name()}, func() error {
+		return r.Roler.SetParent(role)
+	})
+}
+
+// RemoveParent removes the parent from the role and publishes
+// EventRemoveParent.
+func (r *NotifyingRole) RemoveParent(name string) error {
+	return r.RemoveParentContext(context.Background(), name)
+}
+
+// RemoveParentContext is like RemoveParent, the event has the actor of ctx.
+func (r *NotifyingRole) RemoveParentContext(ctx context.Context, name string) error {
+	return r.change(ctx, Event{Kind: EventRemoveParent, Parent: name}, func() error {
+		return r.Roler.RemoveParent(name)
+	})
+}
+
+// unwrapRole removes the wrappers, such as StoredRole and NotifyingRole,
+// from the role.
+func unwrapRole(role Roler) Roler {
+	for {
+		w, ok := role.(interface {
+			Unwrap() Roler
+		})
+		if !ok {
+			return role
+		}
+		role = w.Unwrap()
+	}
+}
+
+// notifying returns the role, so wrappers that embed it, such as
+// AuditedRole, are found by notifyingOf.
+func (r *NotifyingRole) notifying() *NotifyingRole {
+	return r
+}
+
+// notifyingOf returns the NotifyingRole the role is or wraps, or nil.
+func notifyingOf(role Roler) *NotifyingRole {
+	for role != nil {
+		if n, ok := role.(interface{ notifying() *NotifyingRole }); ok {
+			return n.notifying()
+		}
+
+		w, ok := role.(interface {
+			Unwrap() Roler
+		})
+		if !ok {
+			return nil
+		}
+		role = w.Unwrap()
+	}
+	return nil
+}
+
+// notifierOf returns the bus the role or one of its wrapped roles publishes
+// its changes to, or nil.
+func notifierOf(role Roler) *EventBus {
+	for role != nil {
+		if n, ok := role.(Notifier); ok {
+			return n.Events()
+		}
+
+		w, ok := role.(interface {
+			Unwrap() Roler
+		})
+		if !ok {
+			return nil
+		}
+		role = w.Unwrap()
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package grbac
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func notifyChanges(newFunc NewFunc, t *testing.T) {
+	bus := NewEventBus()
+	roleUser := NewNotifyingRole(newFunc("User"), bus)
+	roleAdmin := NewNotifyingRole(newFunc("Admin"), bus)
+
+	var events []Event
+	sub := bus.Subscribe(func(e Event) { events = append(events, e) })
+
+	ctx := WithActor(context.Background(), "alice")
+	roleUser.PermitContext(ctx, "ReadMsg")
+	roleAdmin.Deny("DelMsg")
+	roleAdmin.SetParent(roleUser)
+	roleAdmin.RemoveParent("User")
+	roleAdmin.Undeny("DelMsg")
+	roleUser.RevokeContext(ctx, "ReadMsg")
+
+	// Failed changes are not published.
+	roleUser.Revoke("ReadMsg")
+
+	sub.Cancel()
+	roleUser.Permit("SendMsg")
+
+	expected := []Event{
+		{Role: "User", Kind: EventPermit, Permission: "ReadMsg", Actor: "alice"},
+		{Role: "Admin", Kind: EventDeny, Permission: "DelMsg"},
+		{Role: "Admin", Kind: EventSetParent, Parent: "User"},
+		{Role: "Admin", Kind: EventRemoveParent, Parent: "User"},
+		{Role: "Admin", Kind: EventUndeny, Permission: "DelMsg"},
+		{Role: "User", Kind: EventRevoke, Permission: "ReadMsg", Actor: "alice"},
+	}
+
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d: %v", len(expected), len(events), events)
+	}
+
+	for i, e := range events {
+		if e.Time.IsZero() {
+			t.Errorf("event %d has no time", i)
+		}
+
+		e.Time = time.Time{}
+		if e != expected[i] {
+			t.Errorf("event %d is %+v, expected %+v", i, e, expected[i])
+		}
+	}
+}
+
+func notifyInOrder(newFunc NewFunc, t *testing.T) {
+	role := NewNotifyingRole(newFunc("User"), nil)
+
+	var last Event
+	role.Events().Subscribe(func(e Event) { last = e })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				role.Permit("ReadMsg")
+				role.Revoke("ReadMsg")
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The last event matches the final state only if the events are
+	// published in the order of the changes.
+	if role.IsAllowed("ReadMsg") != (last.Kind == EventPermit) {
+		t.Errorf("the last event %v does not match the state of the role", last.Kind)
+	}
+}
+
+func notifyRegistry(newFunc NewFunc, t *testing.T) {
+	bus := NewEventBus()
+	reg := NewRegistry(func(name string) Roler {
+		return NewNotifyingRole(newFunc(name), bus)
+	})
+
+	events, sub := bus.Channel(10)
+
+	reg.Create("User")
+	reg.Create("Admin")
+	if err := reg.SetParent("Admin", "User"); err != nil {
+		t.Fatal(err)
+	}
+	reg.Get("User").Permit("ReadMsg")
+
+	if !reg.IsAllowed("Admin", "ReadMsg") {
+		t.Errorf("expected that Admin role inherits ReadMsg")
+	}
+
+	sub.Cancel()
+
+	var kinds []EventKind
+	for e := range events {
+		kinds = append(kinds, e.Kind)
+	}
+
+	if len(kinds) != 2 || kinds[0] != EventSetParent || kinds[1] != EventPermit {
+		t.Errorf("the channel received incorrect events: %v", kinds)
+	}
+}
+
+func TestDefaultRoleNotifyChanges(t *testing.T) {
+	notifyChanges(newRole, t)
+}
+
+func TestCachedRoleNotifyChanges(t *testing.T) {
+	notifyChanges(newCachedRole, t)
+}
+
+func TestDefaultRoleNotifyInOrder(t *testing.T) {
+	notifyInOrder(newRole, t)
+}
+
+func TestCachedRoleNotifyInOrder(t *testing.T) {
+	notifyInOrder(newCachedRole, t)
+}
+
+func TestDefaultRoleNotifyRegistry(t *testing.T) {
+	notifyRegistry(newRole, t)
+}
+
+func TestCachedRoleNotifyRegistry(t *testing.T) {
+	notifyRegistry(newCachedRole, t)
+}
+
+func TestEventBusNonBlocking(t *testing.T) {
+	bus := NewEventBus()
+	role := NewNotifyingRole(NewRole("User"), bus)
+
+	release := make(chan struct{})
+	received := make(chan Event, 10)
+	sub := bus.SubscribeAsync(func(e Event) {
+		<-release
+		received <- e
+	}, 1)
+
+	// The subscriber is stuck on the first event and its queue holds
+	// the second one, so the rest are dropped instead of blocking.
+	done := make(chan struct{})
+	go func() {
+		for _, perm := range []string{"A", "B", "C", "D"} {
+			role.Permit(perm)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a slow subscriber stalled the changes")
+	}
+
+	close(release)
+	sub.Cancel()
+
+	first := <-received
+	if first.Permission != "A" {
+		t.Errorf("expected that the first event is delivered first, got %v", first.Permission)
+	}
+
+	if sub.Dropped() == 0 || sub.Dropped() > 3 {
+		t.Errorf("incorrect number of dropped events: %d", sub.Dropped())
+	}
+}
+
+func TestCachedRoleNotifyingParent(t *testing.T) {
+	bus := NewEventBus()
+	roleRoot := NewNotifyingRole(NewRole("Root"), bus)
+	roleBase := NewNotifyingRole(NewRole("Base"), bus)
+	roleBase.SetParent(roleRoot)
+
+	roleUser := NewCachedRole("User")
+	if err := roleUser.SetParent(roleBase); err != nil {
+		t.Fatal(err)
+	}
+	if roleUser.hasLive() {
+		t.Fatalf("expected that the notifying parent is cached")
+	}
+
+	roleBase.Permit("ReadMsg")
+	roleRoot.Permit("SendMsg")
+	if !roleUser.IsAllowed("ReadMsg", "SendMsg") {
+		t.Errorf("expected that the events of the parent and its ancestors update the cache")
+	}
+
+	// An ancestor that does not notify makes the parent live.
+	roleOther := NewRole("Other")
+	roleRoot.SetParent(roleOther)
+	roleOther.Permit("EditMsg")
+	if !roleUser.hasLive() || !roleUser.IsAllowed("EditMsg") {
+		t.Errorf("expected that User sees the changes of the silent ancestor")
+	}
+
+	if err := roleUser.Verify(); err != nil {
+		t.Error(err)
+	}
+
+	if err := roleUser.RemoveParent("Base"); err != nil {
+		t.Fatal(err)
+	}
+	if roleUser.IsAllowed("ReadMsg") || len(bus.subs) != 0 {
+		t.Errorf("expected that User stops watching Base")
+	}
+}
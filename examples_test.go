@@ -72,3 +72,15 @@ func ExampleRole_SetParent() {
 	}
 	// Output: All permissions are allowed in the Admin role
 }
+
+func ExampleRole_Explain() {
+	roleU := NewRole("User")
+	roleU.Permit("ReadMsg")
+
+	roleC := NewRole("Contractor")
+	roleC.SetParent(roleU)
+	roleC.Deny("DelMsg")
+
+	fmt.Println(roleC.Explain("ReadMsg", "DelMsg"))
+	// Output: role "Contractor": denied; "ReadMsg" granted by "ReadMsg" via Contractor -> User; "DelMsg" denied by "DelMsg" via Contractor
+}
@@ -0,0 +1,160 @@
+package grbac
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Decision is a structured answer to a permission check with the reasons
+// for it.
+type Decision struct {
+	Role        string               `json:"role"`
+	Allowed     bool                 `json:"allowed"`
+	Permissions []PermissionDecision `json:"permissions"`
+}
+
+// PermissionDecision explains the decision for one permission.
+type PermissionDecision struct {
+	Permission string `json:"permission"`
+	Allowed    bool   `json:"allowed"`
+
+	// Grant is the nearest role that grants the permission, nil if none.
+	Grant *Trace `json:"grant,omitempty"`
+
+	// Denial is the nearest role that denies the permission, nil if none.
+	Denial *Trace `json:"denial,omitempty"`
+}
+
+// Trace points to the role that supplied a grant or a denial.
+type Trace struct {
+	// Path is the chain of role names from the checked role up to the role
+	// that has the rule.
+	Path []string `json:"path"`
+
+	// Rule is the permission or the pattern of the role that matched.
+	Rule string `json:"rule"`
+}
+
+func (t *Trace) String() string {
+	return fmt.Sprintf("%q via %s", t.Rule, strings.Join(t.Path, " -> "))
+}
+
+func (d *Decision) String() string {
+	var buf bytes.Buffer
+
+	verdict := "denied"
+	if d.Allowed {
+		verdict = "allowed"
+	}
+	fmt.Fprintf(&buf, "role %q: %s", d.Role, verdict)
+
+	for _, p := range d.Permissions {
+		fmt.Fprintf(&buf, "; %q ", p.Permission)
+		switch {
+		case p.Denial != nil:
+			fmt.Fprintf(&buf, "denied by %v", p.Denial)
+		case p.Grant != nil:
+			fmt.Fprintf(&buf, "granted by %v", p.Grant)
+		default:
+			buf.WriteString("not granted")
+		}
+	}
+	return buf.String()
+}
+
+// Explain checks the permissions like IsAllowed and tells for each of them
+// which role of the hierarchy grants or denies it.
+func (r *Role) Explain(perms ...string) *Decision {
+	return Explain(r, perms...)
+}
+
+// Explain checks the permissions of the role like Roler.IsAllowed and tells
+// for each of them which role of the hierarchy grants or denies it.
+//
+// The hierarchy is walked breadth-first, so the traces point to the nearest
+// roles with the rules.
+func Explain(role Roler, perms ...string) *Decision {
+	d := &Decision{
+		Role:        role.Name(),
+		Allowed:     true,
+		Permissions: make([]PermissionDecision, len(perms)),
+	}
+
+	for i, perm := range perms {
+		p := PermissionDecision{
+			Permission: perm,
+			Grant:      traceRule(role, perm, Roler.Permissions),
+			Denial:     traceRule(role, perm, denialsOf),
+		}
+		p.Allowed = p.Grant != nil && p.Denial == nil
+
+		d.Permissions[i] = p
+		d.Allowed = d.Allowed && p.Allowed
+	}
+	return d
+}
+
+// traceRule finds the nearest role of the hierarchy whose rules match
+// the permission.
+func traceRule(role Roler, perm string, rules func(Roler) map[string]bool) *Trace {
+	type item struct {
+		role Roler
+		path []string
+	}
+
+	queue := []item{{role, []string{role.Name()}}}
+	visited := map[string]bool{role.Name(): true}
+
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+
+		if rule, ok := matchRule(rules(cur.role), perm); ok {
+			return &Trace{Path: cur.path, Rule: rule}
+		}
+
+		parents := cur.role.Parents()
+		names := make([]string, 0, len(parents))
+		for name := range parents {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if visited[name] {
+				continue
+			}
+			visited[name] = true
+
+			path := make([]string, len(cur.path)+1)
+			copy(path, cur.path)
+			path[len(cur.path)] = name
+			queue = append(queue, item{parents[name], path})
+		}
+	}
+	return nil
+}
+
+// matchRule returns the permission or the pattern from rules that matches
+// perm. An exact permission wins over patterns.
+func matchRule(rules map[string]bool, perm string) (string, bool) {
+	if rules[perm] {
+		return perm, true
+	}
+
+	var patterns []string
+	for rule := range rules {
+		if IsPattern(rule) && MatchPattern(rule, perm) {
+			patterns = append(patterns, rule)
+		}
+	}
+
+	if len(patterns) == 0 {
+		return "", false
+	}
+
+	sort.Strings(patterns)
+	return patterns[0], true
+}
@@ -0,0 +1,71 @@
+package grbac
+
+import (
+	"reflect"
+	"testing"
+)
+
+func explainPermissions(newFunc NewFunc, t *testing.T) {
+	roleGeneral := newFunc("General")
+	roleGeneral.Permit("ReadMsg")
+	roleGeneral.Permit("report:*")
+
+	roleUser := newFunc("User")
+	roleUser.SetParent(roleGeneral)
+	roleUser.Permit("SendMsg")
+
+	roleContractor := newFunc("Contractor")
+	roleContractor.SetParent(roleUser)
+	roleContractor.(Denier).Deny("report:salary")
+
+	d := roleContractor.(interface {
+		Explain(...string) *Decision
+	}).Explain("SendMsg", "report:sales", "report:salary", "DelMsg")
+
+	if d.Role != "Contractor" || d.Allowed || len(d.Permissions) != 4 {
+		t.Fatalf("Explain returned an incorrect decision: %v", d)
+	}
+
+	if d.Allowed != roleContractor.IsAllowed("SendMsg", "report:sales", "report:salary", "DelMsg") {
+		t.Errorf("expected that Explain agrees with IsAllowed")
+	}
+
+	send := d.Permissions[0]
+	if !send.Allowed || send.Grant == nil ||
+		!reflect.DeepEqual(send.Grant.Path, []string{"Contractor", "User"}) {
+		t.Errorf("expected that SendMsg is granted via Contractor -> User: %v", d)
+	}
+
+	sales := d.Permissions[1]
+	if !sales.Allowed || sales.Grant.Rule != "report:*" ||
+		!reflect.DeepEqual(sales.Grant.Path, []string{"Contractor", "User", "General"}) {
+		t.Errorf("expected that report:sales is granted by report:* of General: %v", d)
+	}
+
+	salary := d.Permissions[2]
+	if salary.Allowed || salary.Grant == nil || salary.Denial == nil ||
+		!reflect.DeepEqual(salary.Denial.Path, []string{"Contractor"}) {
+		t.Errorf("expected that report:salary is denied by Contractor: %v", d)
+	}
+
+	del := d.Permissions[3]
+	if del.Allowed || del.Grant != nil || del.Denial != nil {
+		t.Errorf("expected that DelMsg is not granted: %v", d)
+	}
+
+	if d.String() == "" {
+		t.Errorf("expected a text form of the decision")
+	}
+
+	if !Explain(roleUser, "ReadMsg", "SendMsg").Allowed {
+		t.Errorf("expected that User role is allowed ReadMsg and SendMsg")
+	}
+}
+
+func TestDefaultRoleExplainPermissions(t *testing.T) {
+	explainPermissions(newRole, t)
+}
+
+func TestCachedRoleExplainPermissions(t *testing.T) {
+	explainPermissions(newCachedRole, t)
+}
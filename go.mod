@@ -0,0 +1,8 @@
+module github.com/deterok/grbac
+
+go 1.19
+
+require (
+	github.com/mattn/go-sqlite3 v1.14.24
+	gopkg.in/yaml.v3 v3.0.1
+)
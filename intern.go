@@ -0,0 +1,233 @@
+package grbac
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// permID is the dense integer ID of an interned permission or pattern.
+type permID uint32
+
+// internTable maps permissions to dense IDs and back. IDs are never
+// reused, so the table only grows: it keeps every permission and pattern
+// ever granted or denied to a CachedRole, compiled into a Snapshot or put
+// in a PermList for the life of the process, at a few dozen bytes each
+// besides the name. The checks only look the permissions up, so checking
+// unknown permissions adds nothing to it, and the bitsets keep only
+// the words with IDs, so a large table does not make the rules of
+// the roles larger.
+//
+// Lookups take no lock, hits and misses alike. Permissions interned a while
+// ago are in the frozen map, which is never changed once stored. New
+// permissions go to the recent table, whose slots are filled once and never
+// changed. Once the recent table is half full, it is merged into a new
+// frozen map and replaced by an empty table of a quarter of the frozen
+// size, so interning takes amortized O(1).
+type internTable struct {
+	maps  atomic.Value // *internMaps
+	names atomic.Value // []string, indexed by permID
+
+	mutex sync.Mutex
+}
+
+// internMaps are the maps of an internTable. A permission is in either of
+// them.
+type internMaps struct {
+	frozen map[string]permID
+	recent *recentTable
+}
+
+// recentTable is an open addressing hash table of the recent permissions
+// of an internTable. It is filled by the writer holding the lock of
+// the table and read without locks.
+type recentTable struct {
+	slots []atomic.Value // *internEntry
+	count int
+}
+
+type internEntry struct {
+	perm string
+	id   permID
+}
+
+// newRecentTable makes a table for at least size permissions.
+func newRecentTable(size int) *recentTable {
+	n := 64
+	for n < 2*size {
+		n *= 2
+	}
+	return &recentTable{slots: make([]atomic.Value, n)}
+}
+
+// find returns the slot of the permission or the empty slot to put it in.
+func (r *recentTable) find(perm string) (*atomic.Value, *internEntry) {
+	mask := uint32(len(r.slots) - 1)
+	for i := hashString(perm) & mask; ; i = (i + 1) & mask {
+		e, _ := r.slots[i].Load().(*internEntry)
+		if e == nil || e.perm == perm {
+			return &r.slots[i], e
+		}
+	}
+}
+
+// hashString is the FNV-1a hash of the string.
+func hashString(s string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
+
+func (r *recentTable) lookup(perm string) (permID, bool) {
+	if _, e := r.find(perm); e != nil {
+		return e.id, true
+	}
+	return 0, false
+}
+
+// isFull checks that the table is half full.
+func (r *recentTable) isFull() bool {
+	return 2*r.count >= len(r.slots)
+}
+
+// add adds the permission, which the table must not have.
+// The caller must hold the lock of the internTable.
+func (r *recentTable) add(perm string, id permID) {
+	slot, _ := r.find(perm)
+	slot.Store(&internEntry{perm: perm, id: id})
+	r.count++
+}
+
+// permTable is the table shared by all the roles.
+var permTable = newInternTable()
+
+func newInternTable() *internTable {
+	t := &internTable{}
+	t.maps.Store(&internMaps{frozen: map[string]permID{}, recent: newRecentTable(0)})
+	t.names.Store([]string(nil))
+	return t
+}
+
+// lookup returns the ID of the permission if it is interned.
+func (t *internTable) lookup(perm string) (permID, bool) {
+	m := t.maps.Load().(*internMaps)
+	if id, ok := m.frozen[perm]; ok {
+		return id, true
+	}
+	return m.recent.lookup(perm)
+}
+
+// intern returns the ID of the permission, assigning a new one if needed.
+func (t *internTable) intern(perm string) permID {
+	if id, ok := t.lookup(perm); ok {
+		return id
+	}
+	return t.internAll([]string{perm})[0]
+}
+
+// internAll is intern for many permissions.
+func (t *internTable) internAll(perms []string) []permID {
+	ids := make([]permID, len(perms))
+	missing := false
+	for i, perm := range perms {
+		var ok bool
+		if ids[i], ok = t.lookup(perm); !ok {
+			missing = true
+		}
+	}
+
+	if !missing {
+		return ids
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	names := t.names.Load().([]string)
+	added := make(map[string]permID)
+	for i, perm := range perms {
+		if id, ok := t.lookup(perm); ok {
+			ids[i] = id
+			continue
+		}
+
+		if id, ok := added[perm]; ok {
+			ids[i] = id
+			continue
+		}
+
+		ids[i] = permID(len(names))
+		names = append(names, perm)
+		added[perm] = ids[i]
+	}
+
+	// The names go first, so every published ID has its name.
+	t.names.Store(names)
+
+	for perm, id := range added {
+		m := t.maps.Load().(*internMaps)
+		if m.recent.isFull() {
+			m = t.merge(m)
+		}
+		m.recent.add(perm, id)
+	}
+	return ids
+}
+
+// merge publishes a new frozen map with the recent permissions and
+// an empty recent table and returns them.
+// The caller must hold the lock of the table.
+func (t *internTable) merge(m *internMaps) *internMaps {
+	frozen := make(map[string]permID, len(m.frozen)+m.recent.count)
+	for perm, id := range m.frozen {
+		frozen[perm] = id
+	}
+	for i := range m.recent.slots {
+		if e, ok := m.recent.slots[i].Load().(*internEntry); ok {
+			frozen[e.perm] = e.id
+		}
+	}
+
+	merged := &internMaps{frozen: frozen, recent: newRecentTable(len(frozen) / 4)}
+	t.maps.Store(merged)
+	return merged
+}
+
+// name returns the permission with the ID.
+func (t *internTable) name(id permID) string {
+	return t.names.Load().([]string)[id]
+}
+
+// PermList is a list of permissions prepared for repeated checks.
+// The permissions are interned once, so IsAllowedList of CachedRole and
+// Snapshot checks them all at once with bitwise operations.
+type PermList struct {
+	perms []string
+	ids   []permID
+	words []bitWord // the non-empty words of the IDs
+}
+
+// NewPermList prepares the permissions for checks. The permissions stay
+// interned for the life of the process, so prepare the lists of the
+// permissions the application checks, not of arbitrary input.
+func NewPermList(perms ...string) *PermList {
+	l := &PermList{
+		perms: append([]string(nil), perms...),
+	}
+
+	var bits bitset
+	l.ids = permTable.internAll(l.perms)
+	for _, id := range l.ids {
+		bits.set(id)
+	}
+
+	l.words = bits.words()
+	return l
+}
+
+// Perms returns the permissions of the list.
+func (l *PermList) Perms() []string {
+	return append([]string(nil), l.perms...)
+}
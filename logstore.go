@@ -0,0 +1,459 @@
+package grbac
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Names of the files of a LogStore in its directory.
+const (
+	LogStoreSnapshot = "snapshot.json"
+	LogStoreLog      = "wal.log"
+)
+
+// DefaultCompactEvery is the default number of log entries after which
+// a LogStore compacts its log into the snapshot.
+const DefaultCompactEvery = 1000
+
+// Error codes returned by failures of a LogStore.
+var (
+	ErrStoreClosed = errors.New("store is closed")
+	ErrLogDamaged  = errors.New("log entry is damaged")
+)
+
+// LogError tells which entry of the log of a LogStore is damaged.
+type LogError struct {
+	// Line is the number of the damaged line, from 1.
+	Line int
+
+	Err error
+}
+
+func (e *LogError) Error() string {
+	return fmt.Sprintf("%s: line %d: %v", LogStoreLog, e.Line, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *LogError) Unwrap() error {
+	return e.Err
+}
+
+// logEntry is one change in the log of a LogStore.
+type logEntry struct {
+	Op      string      `json:"op"`
+	Role    string      `json:"role"`
+	Record  *RoleRecord `json:"record,omitempty"`
+	Subject string      `json:"subject,omitempty"`
+}
+
+// Operations of log entries.
+const (
+	opSave     = "save"
+	opDelete   = "delete"
+	opAssign   = "assign"
+	opUnassign = "unassign"
+)
+
+// LogStore is a Store that keeps the records and assignments in a directory
+// without any external database. It is also an AssignmentStore and
+// a PolicyLoader.
+//
+// Every change is appended to a write-ahead log and synced before it is
+// applied. Once the log has CompactEvery entries, the whole state is written
+// to a snapshot in the Policy format through a temporary file and a rename,
+// and the log is truncated.
+//
+// A log entry is a single line with a checksum, so an entry torn by a crash
+// in the middle of a change is detected and dropped when the store is
+// opened, and the store recovers to the state before the change. A damaged
+// complete entry is not a crash: OpenLogStore returns a LogError and leaves
+// the log as it is, so the entries after it are not lost. Replaying
+// the log over a snapshot is idempotent, so a crash between writing
+// the snapshot and truncating the log loses nothing either.
+//
+// Watch reports only the changes made through this LogStore.
+type LogStore struct {
+	// CompactEvery is the number of log entries after which the log is
+	// compacted. DefaultCompactEvery is used if it is not positive.
+	CompactEvery int
+
+	dir         string
+	mem         *MemoryStore
+	assignments map[string]map[string]bool
+	log         *os.File
+	entries     int
+
+	mutex sync.Mutex
+}
+
+// OpenLogStore opens the store in the directory, creating the directory if
+// it does not exist, and recovers its state from the snapshot and the log.
+func OpenLogStore(dir string) (*LogStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &LogStore{
+		dir:         dir,
+		mem:         NewMemoryStore(),
+		assignments: make(map[string]map[string]bool),
+	}
+
+	if err := s.readSnapshot(); err != nil {
+		return nil, err
+	}
+
+	log, err := os.OpenFile(filepath.Join(dir, LogStoreLog), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.replay(log); err != nil {
+		log.Close()
+		return nil, err
+	}
+
+	s.log = log
+	return s, nil
+}
+
+func (s *LogStore) readSnapshot() error {
+	data, err := ioutil.ReadFile(filepath.Join(s.dir, LogStoreSnapshot))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return err
+	}
+
+	for _, rec := range p.Roles {
+		s.mem.records[rec.Name] = rec
+	}
+
+	for subject, roles := range p.Assignments {
+		for _, role := range roles {
+			s.assign(subject, role)
+		}
+	}
+	return nil
+}
+
+// replay applies the entries of the log and cuts off the torn last line,
+// which has no end of line. Returns a LogError for a damaged complete line.
+func (s *LogStore) replay(log *os.File) error {
+	r := bufio.NewReader(log)
+
+	var offset int64
+	for n := 1; ; n++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) == 0 {
+				break
+			}
+
+			if err := log.Truncate(offset); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		e, ok := parseLogLine(line)
+		if !ok {
+			return &LogError{Line: n, Err: ErrLogDamaged}
+		}
+
+		s.apply(e)
+		s.entries++
+		offset += int64(len(line))
+	}
+
+	_, err := log.Seek(offset, io.SeekStart)
+	return err
+}
+
+// parseLogLine decodes a line of the log. It fails for torn and damaged
+// lines.
+func parseLogLine(line []byte) (logEntry, bool) {
+	var e logEntry
+
+	if len(line) < 10 || line[8] != ' ' {
+		return e, false
+	}
+
+	sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil {
+		return e, false
+	}
+
+	data := line[9 : len(line)-1]
+	if uint64(crc32.ChecksumIEEE(data)) != sum {
+		return e, false
+	}
+
+	if err := json.Unmarshal(data, &e); err != nil {
+		return e, false
+	}
+	return e, true
+}
+
+// apply changes the state of the store according to the entry.
+// Applying an entry twice has the same effect as applying it once.
+func (s *LogStore) apply(e logEntry) {
+	s.mem.mutex.Lock()
+	defer s.mem.mutex.Unlock()
+
+	switch e.Op {
+	case opSave:
+		if e.Record != nil {
+			s.mem.records[e.Role] = copyRecord(*e.Record)
+		}
+
+	case opDelete:
+		delete(s.mem.records, e.Role)
+		for subject := range s.assignments {
+			s.unassign(subject, e.Role)
+		}
+
+	case opAssign:
+		s.assign(e.Subject, e.Role)
+
+	case opUnassign:
+		s.unassign(e.Subject, e.Role)
+	}
+}
+
+func (s *LogStore) assign(subject, role string) {
+	roles, ok := s.assignments[subject]
+	if !ok {
+		roles = make(map[string]bool)
+		s.assignments[subject] = roles
+	}
+	roles[role] = true
+}
+
+func (s *LogStore) unassign(subject, role string) {
+	roles := s.assignments[subject]
+	delete(roles, role)
+	if len(roles) == 0 {
+		delete(s.assignments, subject)
+	}
+}
+
+// write appends the entry to the log, syncs it and applies it.
+// The caller must hold the lock of the store.
+func (s *LogStore) write(e logEntry) error {
+	if s.log == nil {
+		return ErrStoreClosed
+	}
+
+	data, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+
+	offset, err := s.log.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	line := fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(data), data)
+	if _, err := io.WriteString(s.log, line); err != nil {
+		s.cut(offset)
+		return err
+	}
+
+	if err := s.log.Sync(); err != nil {
+		s.cut(offset)
+		return err
+	}
+
+	s.apply(e)
+	s.entries++
+
+	compactEvery := s.CompactEvery
+	if compactEvery <= 0 {
+		compactEvery = DefaultCompactEvery
+	}
+
+	// The change is already durable, so a failed compaction is only
+	// retried with the next change.
+	if s.entries >= compactEvery {
+		s.compact()
+	}
+	return nil
+}
+
+// cut drops a partly written entry from the end of the log.
+func (s *LogStore) cut(offset int64) {
+	s.log.Truncate(offset)
+	s.log.Seek(offset, io.SeekStart)
+}
+
+// Compact writes the state of the store to the snapshot and truncates
+// the log.
+func (s *LogStore) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.log == nil {
+		return ErrStoreClosed
+	}
+	return s.compact()
+}
+
+func (s *LogStore) compact() error {
+	data, err := json.MarshalIndent(s.policy(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The snapshot must be durable before the log is dropped, or a crash
+	// could bring back the old snapshot with an empty log.
+	if err := writeFileAtomic(filepath.Join(s.dir, LogStoreSnapshot), data); err != nil {
+		return err
+	}
+
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+
+	if _, err := s.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	s.entries = 0
+	return s.log.Sync()
+}
+
+// Close closes the log. The store must not be used after that.
+func (s *LogStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.log == nil {
+		return ErrStoreClosed
+	}
+
+	err := s.log.Close()
+	s.log = nil
+	return err
+}
+
+// LoadRole returns the record of the role.
+func (s *LogStore) LoadRole(name string) (RoleRecord, error) {
+	return s.mem.LoadRole(name)
+}
+
+// SaveRole adds or replaces the record of the role.
+func (s *LogStore) SaveRole(rec RoleRecord) error {
+	rec = copyRecord(rec)
+
+	s.mutex.Lock()
+	err := s.write(logEntry{Op: opSave, Role: rec.Name, Record: &rec})
+	s.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	s.mem.watchers.notify(rec.Name, &rec)
+	return nil
+}
+
+// ListRoles returns the sorted names of all the roles in the store.
+func (s *LogStore) ListRoles() ([]string, error) {
+	return s.mem.ListRoles()
+}
+
+// DeleteRole deletes the record of the role and its assignments.
+func (s *LogStore) DeleteRole(name string) error {
+	s.mutex.Lock()
+
+	s.mem.mutex.RLock()
+	_, ok := s.mem.records[name]
+	s.mem.mutex.RUnlock()
+
+	if !ok {
+		s.mutex.Unlock()
+		return ErrNoRole
+	}
+
+	err := s.write(logEntry{Op: opDelete, Role: name})
+	s.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	s.mem.watchers.notify(name, nil)
+	return nil
+}
+
+// SaveAssignment assigns the role to the subject.
+func (s *LogStore) SaveAssignment(subject, role string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.write(logEntry{Op: opAssign, Role: role, Subject: subject})
+}
+
+// DeleteAssignment takes the role away from the subject.
+func (s *LogStore) DeleteAssignment(subject, role string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.write(logEntry{Op: opUnassign, Role: role, Subject: subject})
+}
+
+// LoadPolicy returns all the roles and assignments of the store.
+func (s *LogStore) LoadPolicy() (*Policy, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.policy(), nil
+}
+
+// policy describes the state of the store.
+// The caller must hold the lock of the store.
+func (s *LogStore) policy() *Policy {
+	s.mem.mutex.RLock()
+	defer s.mem.mutex.RUnlock()
+
+	p := &Policy{Roles: make([]RoleRecord, 0, len(s.mem.records))}
+	for _, rec := range s.mem.records {
+		p.Roles = append(p.Roles, copyRecord(rec))
+	}
+	sort.Sort(recordsByName(p.Roles))
+
+	if len(s.assignments) > 0 {
+		p.Assignments = make(map[string][]string)
+		for subject, roles := range s.assignments {
+			p.Assignments[subject] = setToSlice(roles)
+		}
+	}
+	return p
+}
+
+// Watch calls fn for every change of a role made through the store until
+// cancel is called.
+func (s *LogStore) Watch(fn func(StoreEvent)) (cancel func()) {
+	return s.mem.Watch(fn)
+}
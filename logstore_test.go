@@ -0,0 +1,217 @@
+package grbac
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func openLogStore(dir string, t *testing.T) *LogStore {
+	store, err := OpenLogStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func appendToFile(path, data string, t *testing.T) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grbac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := openLogStore(dir, t)
+	storeRoles(store, t)
+	store.Close()
+
+	if err := store.SaveRole(RoleRecord{Name: "User"}); err != ErrStoreClosed {
+		t.Errorf("expected \"%v\"", ErrStoreClosed)
+	}
+
+	reopened := openLogStore(dir, t)
+	defer reopened.Close()
+
+	if names, _ := reopened.ListRoles(); !reflect.DeepEqual(names, []string{"Admin", "User"}) {
+		t.Errorf("expected that the reopened store has Admin and User roles: %v", names)
+	}
+}
+
+func TestLogStoreRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grbac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := openLogStore(dir, t)
+	reg, err := LoadRegistry(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roleUser, _ := reg.Create("User")
+	roleUser.Permit("ReadMsg")
+	reg.Create("Admin")
+	reg.SetParent("Admin", "User")
+	reg.Assign("alice", "Admin")
+	store.Close()
+
+	expected := reg.Policy()
+
+	// A crash in the middle of Permit leaves a torn entry at the end of
+	// the log.
+	path := filepath.Join(dir, LogStoreLog)
+	appendToFile(path, `4c1e2f3a {"op":"save","role":"User","record":{"name":"User","permi`, t)
+
+	store = openLogStore(dir, t)
+	restarted, err := LoadRegistry(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(restarted.Policy(), expected) {
+		t.Errorf("expected that the torn entry is dropped")
+		t.Logf("before: %#v", expected)
+		t.Logf("after: %#v", restarted.Policy())
+	}
+
+	// The log is usable after the recovery.
+	restarted.Get("Admin").Permit("DelMsg")
+	store.Close()
+
+	store = openLogStore(dir, t)
+	defer store.Close()
+
+	restarted, err = LoadRegistry(store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !restarted.IsAllowed("Admin", "ReadMsg", "DelMsg") || !restarted.Can("alice", "DelMsg") {
+		t.Errorf("expected that the store recovers all the complete changes")
+	}
+}
+
+func TestLogStoreDamagedEntry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grbac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := openLogStore(dir, t)
+	storeRoles(store, t)
+	store.Close()
+
+	// Damage the checksum of an entry in the middle of the log.
+	path := filepath.Join(dir, LogStoreLog)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	if len(lines) < 3 {
+		t.Fatalf("expected a few entries in the log: %q", data)
+	}
+	lines[1] = "00000000" + lines[1][8:]
+	damaged := strings.Join(lines, "")
+
+	if err := ioutil.WriteFile(path, []byte(damaged), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = OpenLogStore(dir)
+	if e, ok := err.(*LogError); !ok || e.Line != 2 || !errors.Is(err, ErrLogDamaged) {
+		t.Fatalf("expected the error of the damaged line 2, got \"%v\"", err)
+	}
+
+	if data, _ := ioutil.ReadFile(path); string(data) != damaged {
+		t.Errorf("expected that the damaged log is left as it is")
+	}
+
+	// A damaged complete last entry is not a torn one either.
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	appendToFile(path, "00000000 {\"op\":\"delete\",\"role\":\"User\"}\n", t)
+
+	if _, err := OpenLogStore(dir); !errors.Is(err, ErrLogDamaged) {
+		t.Errorf("expected \"%v\", got \"%v\"", ErrLogDamaged, err)
+	}
+}
+
+func TestLogStoreCompact(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grbac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := openLogStore(dir, t)
+	store.CompactEvery = 3
+
+	reg, err := LoadRegistry(store, RoleFactory(newCachedRole))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roleUser, _ := reg.Create("User")
+	roleUser.Permit("ReadMsg")
+	roleUser.Permit("SendMsg")
+	reg.Create("Admin")
+	reg.SetParent("Admin", "User")
+	reg.Assign("alice", "Admin")
+
+	path := filepath.Join(dir, LogStoreLog)
+	old, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, _ := os.Stat(path); info.Size() != 0 {
+		t.Errorf("expected that Compact truncates the log")
+	}
+	store.Close()
+
+	// A crash after the snapshot is written, but before the log is
+	// truncated, replays the log over the snapshot.
+	if err := ioutil.WriteFile(path, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openLogStore(dir, t)
+	defer store.Close()
+
+	restarted, err := LoadRegistry(store, RoleFactory(newCachedRole))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(restarted.Policy(), reg.Policy()) {
+		t.Errorf("expected that the snapshot and the log give the same graph")
+		t.Logf("before: %#v", reg.Policy())
+		t.Logf("after: %#v", restarted.Policy())
+	}
+}
@@ -0,0 +1,189 @@
+package grbac
+
+import "strings"
+
+// Permissions may be split into segments by PermSeparator. A permission with
+// a segment equal to AnySegment or AnySegments is a pattern:
+//
+//	invoice:*    matches invoice:read, invoice:write, but not invoice:line:edit
+//	billing:**   matches billing:invoice, billing:invoice:read and so on
+//
+// A permission with wildcard segments is matched as the set of permissions
+// it stands for: invoice:* is matched by invoice:* and invoice:**, but
+// invoice:** is not matched by invoice:*.
+//
+// Patterns are matched only if a role is granted one, so roles with plain
+// permissions work exactly as before.
+const (
+	PermSeparator = ":"
+	AnySegment    = "*"
+	AnySegments   = "**"
+)
+
+// IsPattern checks that the permission contains wildcard segments.
+func IsPattern(perm string) bool {
+	if !strings.Contains(perm, AnySegment) {
+		return false
+	}
+
+	for _, seg := range strings.Split(perm, PermSeparator) {
+		if seg == AnySegment || seg == AnySegments {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchPattern checks that the permission is matched by the pattern.
+// A pattern without wildcard segments matches only itself.
+func MatchPattern(pattern, perm string) bool {
+	if pattern == perm {
+		return true
+	}
+
+	if !IsPattern(pattern) {
+		return false
+	}
+
+	root := &patternNode{}
+	root.insert(pattern)
+	return root.match(strings.Split(perm, PermSeparator))
+}
+
+// patternNode is a node of a trie of permission patterns split into segments.
+type patternNode struct {
+	children map[string]*patternNode
+	any      *patternNode // AnySegment
+	anyMany  *patternNode // AnySegments
+	end      bool
+}
+
+func (n *patternNode) insert(pattern string) {
+	node := n
+	for _, seg := range strings.Split(pattern, PermSeparator) {
+		var next **patternNode
+		switch seg {
+		case AnySegment:
+			next = &node.any
+		case AnySegments:
+			next = &node.anyMany
+		default:
+			if node.children == nil {
+				node.children = make(map[string]*patternNode)
+			}
+			child := node.children[seg]
+			if child == nil {
+				child = &patternNode{}
+				node.children[seg] = child
+			}
+			node = child
+			continue
+		}
+
+		if *next == nil {
+			*next = &patternNode{}
+		}
+		node = *next
+	}
+	node.end = true
+}
+
+func (n *patternNode) match(segs []string) bool {
+	if len(segs) == 0 {
+		return n.end
+	}
+
+	if child := n.children[segs[0]]; child != nil && child.match(segs[1:]) {
+		return true
+	}
+
+	// A wildcard segment of the permission is matched only by the same or
+	// a wider one, so a narrower pattern does not grant it.
+	if n.any != nil && segs[0] != AnySegments && n.any.match(segs[1:]) {
+		return true
+	}
+
+	if n.anyMany != nil {
+		for i := 1; i <= len(segs); i++ {
+			if n.anyMany.match(segs[i:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// permSet is a set of permissions that can hold patterns.
+//
+// Plain permissions are looked up in the map, patterns are also kept in
+// a trie which is only built if the set has any.
+type permSet struct {
+	perms    map[string]bool
+	patterns *patternNode
+}
+
+func newPermSet() permSet {
+	return permSet{perms: make(map[string]bool)}
+}
+
+// add adds the permission and returns false if the set already has it.
+func (s *permSet) add(perm string) bool {
+	if s.perms[perm] {
+		return false
+	}
+
+	s.perms[perm] = true
+	if IsPattern(perm) {
+		if s.patterns == nil {
+			s.patterns = &patternNode{}
+		}
+		s.patterns.insert(perm)
+	}
+	return true
+}
+
+// remove removes the permission and returns false if the set does not
+// have it.
+func (s *permSet) remove(perm string) bool {
+	if !s.perms[perm] {
+		return false
+	}
+
+	delete(s.perms, perm)
+	if IsPattern(perm) {
+		s.rebuildPatterns()
+	}
+	return true
+}
+
+func (s *permSet) rebuildPatterns() {
+	s.patterns = nil
+	for perm := range s.perms {
+		if IsPattern(perm) {
+			if s.patterns == nil {
+				s.patterns = &patternNode{}
+			}
+			s.patterns.insert(perm)
+		}
+	}
+}
+
+// match checks that the permission is in the set or matched by a pattern
+// of the set.
+func (s *permSet) match(perm string) bool {
+	if s.perms[perm] {
+		return true
+	}
+
+	if s.patterns == nil {
+		return false
+	}
+	return s.patterns.match(strings.Split(perm, PermSeparator))
+}
+
+// permSetOf makes a set of the permissions from the map.
+func permSetOf(perms map[string]bool) permSet {
+	s := permSet{perms: perms}
+	s.rebuildPatterns()
+	return s
+}
@@ -0,0 +1,92 @@
+package grbac
+
+import "testing"
+
+func TestMatchPattern(t *testing.T) {
+	matches := map[string][]string{
+		"invoice:*":     {"invoice:read", "invoice:write", "invoice:*"},
+		"*:read":        {"invoice:read", "doc:read"},
+		"billing:**":    {"billing:invoice", "billing:invoice:read", "billing:a:b:c", "billing:*", "billing:**"},
+		"doc:**:delete": {"doc:42:delete", "doc:a:b:delete", "doc:*:delete"},
+		"invoice:read":  {"invoice:read"},
+		"*":             {"read"},
+		"**":            {"read", "invoice:read"},
+		"org:*:team:**": {"org:acme:team:dev", "org:acme:team:dev:read"},
+	}
+
+	mismatches := map[string][]string{
+		"invoice:*":     {"invoice", "invoice:line:edit", "invoices:read", "invoice:**"},
+		"*:read":        {"read", "invoice:write"},
+		"billing:**":    {"billing", "invoice:read"},
+		"doc:**:delete": {"doc:delete", "doc:42:read"},
+		"invoice:read":  {"invoice:write", "invoice:*"},
+		"*":             {"invoice:read", "**"},
+		"org:*:team:**": {"org:acme:team", "org:team:dev", "org:**:team:dev"},
+	}
+
+	for pattern, perms := range matches {
+		for _, perm := range perms {
+			if !MatchPattern(pattern, perm) {
+				t.Errorf("expected that %q matches %q", pattern, perm)
+			}
+		}
+	}
+
+	for pattern, perms := range mismatches {
+		for _, perm := range perms {
+			if MatchPattern(pattern, perm) {
+				t.Errorf("expected that %q does not match %q", pattern, perm)
+			}
+		}
+	}
+}
+
+func wildcardPermissions(newFunc NewFunc, t *testing.T) {
+	roleClerk := newFunc("Clerk")
+	roleClerk.Permit("invoice:*")
+
+	roleAccountant := newFunc("Accountant")
+	roleAccountant.Permit("billing:**")
+	if err := roleAccountant.SetParent(roleClerk); err != nil {
+		t.Fatal(err)
+	}
+
+	if !roleClerk.IsAllowed("invoice:read", "invoice:write") {
+		t.Errorf("expected that invoice:* allows invoice:read and invoice:write")
+	}
+
+	if roleClerk.IsAllowed("invoice:line:edit") {
+		t.Errorf("expected that invoice:* does not allow invoice:line:edit")
+	}
+
+	if !roleAccountant.IsAllowed("invoice:read", "billing:report:export") {
+		t.Errorf("expected that Accountant role has own and inherited patterns")
+		t.Logf("Accountant: %v", roleAccountant.AllPermissions())
+	}
+
+	if err := roleClerk.Revoke("invoice:*"); err != nil {
+		t.Error(err)
+	}
+
+	if roleAccountant.IsAllowed("invoice:read") {
+		t.Errorf("expected that the revoked pattern does not match")
+	}
+
+	// A wildcard permission is granted only by the same or a wider pattern.
+	roleClerk.Permit("invoice:*")
+	if roleClerk.IsAllowed("invoice:**") || Compile(roleClerk).IsAllowed("Clerk", "invoice:**") {
+		t.Errorf("expected that invoice:* does not allow invoice:**")
+	}
+
+	if !roleClerk.IsAllowed("invoice:*") || !roleAccountant.IsAllowed("billing:*", "billing:**") {
+		t.Errorf("expected that the same or a wider pattern allows a wildcard permission")
+	}
+}
+
+func TestDefaultRoleWildcardPermissions(t *testing.T) {
+	wildcardPermissions(newRole, t)
+}
+
+func TestCachedRoleWildcardPermissions(t *testing.T) {
+	wildcardPermissions(newCachedRole, t)
+}
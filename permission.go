@@ -0,0 +1,111 @@
+package grbac
+
+import (
+	"errors"
+	"strings"
+)
+
+// ErrInvalidPermission is returned for a Permission that cannot be
+// converted to a string and back.
+var ErrInvalidPermission = errors.New("permission fields must not contain the separator")
+
+// Permission is a structured permission: an action on a resource of some
+// type, for example "edit" on "doc" "42".
+//
+// An empty field matches any value, so Permission{Action: "edit",
+// Resource: "doc"} granted to a role allows editing of any doc.
+//
+// A Permission is stored in roles as the string "action:resource:id" where
+// empty fields are replaced with AnySegment, so structured and string
+// permissions work together.
+type Permission struct {
+	Action   string
+	Resource string
+	ID       string
+}
+
+// ParsePermission parses a string made by Permission.String.
+func ParsePermission(s string) (Permission, error) {
+	fields := strings.Split(s, PermSeparator)
+	if len(fields) != 3 {
+		return Permission{}, ErrInvalidPermission
+	}
+
+	for i, f := range fields {
+		if f == AnySegment {
+			fields[i] = ""
+		}
+	}
+
+	return Permission{Action: fields[0], Resource: fields[1], ID: fields[2]}, nil
+}
+
+// String returns the string form of the permission.
+func (p Permission) String() string {
+	return strings.Join([]string{anyIfEmpty(p.Action), anyIfEmpty(p.Resource),
+		anyIfEmpty(p.ID)}, PermSeparator)
+}
+
+// Valid checks that no field of the permission contains PermSeparator.
+func (p Permission) Valid() bool {
+	return !strings.Contains(p.Action, PermSeparator) &&
+		!strings.Contains(p.Resource, PermSeparator) &&
+		!strings.Contains(p.ID, PermSeparator)
+}
+
+// Matches checks that the permission, granted to a role, allows other.
+func (p Permission) Matches(other Permission) bool {
+	return MatchPattern(p.String(), other.String())
+}
+
+func anyIfEmpty(s string) string {
+	if s == "" {
+		return AnySegment
+	}
+	return s
+}
+
+// PermitPermission adds the structured permission to the role.
+//
+// Returns ErrInvalidPermission if the permission is not valid.
+func PermitPermission(r Roler, p Permission) error {
+	if !p.Valid() {
+		return ErrInvalidPermission
+	}
+	return r.Permit(p.String())
+}
+
+// RevokePermission revokes the structured permission from the role.
+//
+// Returns ErrInvalidPermission if the permission is not valid.
+func RevokePermission(r Roler, p Permission) error {
+	if !p.Valid() {
+		return ErrInvalidPermission
+	}
+	return r.Revoke(p.String())
+}
+
+// DenyPermission adds a denial of the structured permission to the role.
+//
+// Returns ErrInvalidPermission if the permission is not valid and
+// ErrNoDenials if the role is not a Denier.
+func DenyPermission(r Roler, p Permission) error {
+	if !p.Valid() {
+		return ErrInvalidPermission
+	}
+	return deny(r, p.String())
+}
+
+// IsPermitted checks the structured permissions like Roler.IsAllowed.
+// Invalid permissions are never allowed.
+func IsPermitted(r Roler, perms ...Permission) bool {
+	strPerms := make([]string, len(perms))
+	for i, p := range perms {
+		if !p.Valid() {
+			return false
+		}
+		strPerms[i] = p.String()
+	}
+
+	return r.IsAllowed(strPerms...)
+}
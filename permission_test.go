@@ -0,0 +1,91 @@
+package grbac
+
+import "testing"
+
+func TestPermissionString(t *testing.T) {
+	p := Permission{Action: "edit", Resource: "doc", ID: "42"}
+	if p.String() != "edit:doc:42" {
+		t.Errorf("Permission.String returned an incorrect value: %v", p)
+	}
+
+	anyDoc := Permission{Action: "edit", Resource: "doc"}
+	if anyDoc.String() != "edit:doc:*" {
+		t.Errorf("Permission.String returned an incorrect value: %v", anyDoc)
+	}
+
+	parsed, err := ParsePermission("edit:doc:*")
+	if err != nil || parsed != anyDoc {
+		t.Errorf("expected that ParsePermission returns %#v, got %#v", anyDoc, parsed)
+	}
+
+	if _, err := ParsePermission("edit:doc"); err != ErrInvalidPermission {
+		t.Errorf("expected \"%v\"", ErrInvalidPermission)
+	}
+
+	if !anyDoc.Matches(p) || p.Matches(anyDoc) {
+		t.Errorf("expected that any doc matches doc 42, but not vice versa")
+	}
+
+	if (Permission{Action: "edit", Resource: "doc:42"}).Valid() {
+		t.Errorf("expected that a field with the separator is not valid")
+	}
+}
+
+func structuredPermissions(newFunc NewFunc, t *testing.T) {
+	editDoc42 := Permission{Action: "edit", Resource: "doc", ID: "42"}
+	editDoc7 := Permission{Action: "edit", Resource: "doc", ID: "7"}
+	readAnyDoc := Permission{Action: "read", Resource: "doc"}
+	readDoc7 := Permission{Action: "read", Resource: "doc", ID: "7"}
+
+	roleViewer := newFunc("Viewer")
+	if err := PermitPermission(roleViewer, readAnyDoc); err != nil {
+		t.Fatal(err)
+	}
+
+	roleAuthor := newFunc("Author")
+	roleAuthor.SetParent(roleViewer)
+	if err := PermitPermission(roleAuthor, editDoc42); err != nil {
+		t.Fatal(err)
+	}
+
+	if !IsPermitted(roleAuthor, editDoc42, readDoc7) {
+		t.Errorf("expected that Author role can edit doc 42 and read any doc")
+		t.Log(roleAuthor.AllPermissions())
+	}
+
+	if IsPermitted(roleAuthor, editDoc7) {
+		t.Errorf("expected that Author role cannot edit doc 7")
+	}
+
+	if !roleAuthor.IsAllowed("read:doc:99") {
+		t.Errorf("expected that structured and string permissions work together")
+	}
+
+	if err := DenyPermission(roleAuthor, readDoc7); err != nil {
+		t.Error(err)
+	}
+
+	if IsPermitted(roleAuthor, readDoc7) {
+		t.Errorf("expected that Author role cannot read denied doc 7")
+	}
+
+	if err := RevokePermission(roleAuthor, editDoc42); err != nil {
+		t.Error(err)
+	}
+
+	if IsPermitted(roleAuthor, editDoc42) {
+		t.Errorf("expected that Author role cannot edit doc 42 now")
+	}
+
+	if err := PermitPermission(roleAuthor, Permission{Action: "a:b"}); err != ErrInvalidPermission {
+		t.Errorf("expected \"%v\"", ErrInvalidPermission)
+	}
+}
+
+func TestDefaultRoleStructuredPermissions(t *testing.T) {
+	structuredPermissions(newRole, t)
+}
+
+func TestCachedRoleStructuredPermissions(t *testing.T) {
+	structuredPermissions(newCachedRole, t)
+}
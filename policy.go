@@ -0,0 +1,288 @@
+package grbac
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// Policy is a serializable description of a role graph: the roles with their
+// permissions, denials and parents, the assignments of the roles to subjects
+// and the separation of duty constraints.
+//
+// The JSON form of a policy is:
+//
+//	{
+//	  "roles": [
+//	    {"name": "General", "permissions": ["ReadMsg"]},
+//	    {"name": "User", "permissions": ["SendMsg"], "parents": ["General"]},
+//	    {"name": "Contractor", "denials": ["ExportData"], "parents": ["User"]}
+//	  ],
+//	  "assignments": {"alice": ["User"]},
+//	  "ssd": [{"name": "payments", "roles": ["Approver", "Requester"], "cardinality": 2}],
+//	  "dsd": []
+//	}
+//
+// Only "roles" is required; every role must be described once and its
+// parents must be described in the same policy.
+type Policy struct {
+	Roles       []RoleRecord        `json:"roles"`
+	Assignments map[string][]string `json:"assignments,omitempty"`
+	SSD         []SoDConstraint     `json:"ssd,omitempty"`
+	DSD         []SoDConstraint     `json:"dsd,omitempty"`
+}
+
+// RoleRecord describes one role of a policy. The parents are referred to
+// by names.
+type RoleRecord struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions,omitempty"`
+	Denials     []string `json:"denials,omitempty"`
+	Parents     []string `json:"parents,omitempty"`
+}
+
+// PolicyError is returned when a policy cannot be built.
+type PolicyError struct {
+	// Role is the role the error is about, if any.
+	Role string
+
+	// Parent is the parent of Role the error is about, if any.
+	Parent string
+
+	// Subject is the subject the error is about, if any.
+	Subject string
+
+	Err error
+}
+
+func (e *PolicyError) Error() string {
+	msg := "policy"
+	if e.Subject != "" {
+		msg += fmt.Sprintf(": subject %q", e.Subject)
+	}
+	if e.Role != "" {
+		msg += fmt.Sprintf(": role %q", e.Role)
+	}
+	if e.Parent != "" {
+		msg += fmt.Sprintf(": parent %q", e.Parent)
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *PolicyError) Unwrap() error {
+	return e.Err
+}
+
+// RecordOf describes the role, its own permissions and denials and its
+// direct parents.
+func RecordOf(role Roler) RoleRecord {
+	rec := RoleRecord{
+		Name:        role.Name(),
+		Permissions: setToSlice(role.Permissions()),
+		Denials:     setToSlice(denialsOf(role)),
+	}
+
+	parents := make(map[string]bool)
+	for name := range role.Parents() {
+		parents[name] = true
+	}
+	rec.Parents = setToSlice(parents)
+	return rec
+}
+
+// Export describes the roles and all their ancestors as a policy.
+func Export(roles ...Roler) *Policy {
+	all := make(map[string]Roler)
+	for _, role := range roles {
+		all[role.Name()] = role
+		for name, parent := range role.AllParents() {
+			all[name] = parent
+		}
+	}
+
+	return &Policy{Roles: recordsOf(all)}
+}
+
+func recordsOf(roles map[string]Roler) []RoleRecord {
+	names := make([]string, 0, len(roles))
+	for name := range roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	records := make([]RoleRecord, len(names))
+	for i, name := range names {
+		records[i] = RecordOf(roles[name])
+	}
+	return records
+}
+
+// Policy describes all the roles, assignments and constraints of
+// the registry.
+func (reg *Registry) Policy() *Policy {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	p := &Policy{Roles: recordsOf(reg.roles)}
+
+	if len(reg.assignments) > 0 {
+		p.Assignments = make(map[string][]string)
+		for subject, roles := range reg.assignments {
+			p.Assignments[subject] = setToSlice(roles)
+		}
+	}
+
+	p.SSD = sortedConstraints(reg.ssd)
+	p.DSD = sortedConstraints(reg.dsd)
+	return p
+}
+
+func sortedConstraints(constraints map[string]SoDConstraint) []SoDConstraint {
+	if len(constraints) == 0 {
+		return nil
+	}
+
+	names := make([]string, 0, len(constraints))
+	for name := range constraints {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]SoDConstraint, len(names))
+	for i, name := range names {
+		list[i] = constraints[name]
+	}
+	return list
+}
+
+// Build makes a new registry with the roles, assignments and constraints
+// of the policy. The roles are made with factory, see NewRegistry.
+//
+// The roles are built by a single Batch, so the caches of the roles are
+// computed once.
+//
+// Returns a PolicyError if a role is described twice, refers to an unknown
+// parent, is its own ancestor, or the policy breaks its own constraints.
+func (p *Policy) Build(factory RoleFactory) (*Registry, error) {
+	reg := NewRegistry(factory)
+
+	for _, c := range p.SSD {
+		if err := reg.AddSSD(c.Name, c.Cardinality, c.Roles...); err != nil {
+			return nil, &PolicyError{Err: err}
+		}
+	}
+
+	for _, c := range p.DSD {
+		if err := reg.AddDSD(c.Name, c.Cardinality, c.Roles...); err != nil {
+			return nil, &PolicyError{Err: err}
+		}
+	}
+
+	// errs describes the changes of the batch in the same order.
+	b := reg.Batch()
+	var errs []PolicyError
+
+	for _, rec := range p.Roles {
+		b.Create(rec.Name)
+		errs = append(errs, PolicyError{Role: rec.Name})
+
+		for _, perm := range rec.Permissions {
+			b.Permit(rec.Name, perm)
+			errs = append(errs, PolicyError{Role: rec.Name})
+		}
+
+		for _, perm := range rec.Denials {
+			b.Deny(rec.Name, perm)
+			errs = append(errs, PolicyError{Role: rec.Name})
+		}
+	}
+
+	for _, rec := range p.Roles {
+		for _, parent := range rec.Parents {
+			b.SetParent(rec.Name, parent)
+			errs = append(errs, PolicyError{Role: rec.Name, Parent: parent})
+		}
+	}
+
+	subjects := make([]string, 0, len(p.Assignments))
+	for subject := range p.Assignments {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+
+	for _, subject := range subjects {
+		for _, role := range p.Assignments[subject] {
+			b.Assign(subject, role)
+			errs = append(errs, PolicyError{Subject: subject, Role: role})
+		}
+	}
+
+	if err := b.Commit(); err != nil {
+		if be, ok := err.(*BatchError); ok {
+			e := errs[be.Index]
+			e.Err = be.Err
+			return nil, &e
+		}
+		return nil, &PolicyError{Err: err}
+	}
+
+	return reg, nil
+}
+
+// Import parses a policy in the JSON form and builds a registry from it.
+// The roles are made with factory, see NewRegistry.
+func Import(data []byte, factory RoleFactory) (*Registry, error) {
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+
+	return p.Build(factory)
+}
+
+// MarshalJSON encodes the policy of the registry.
+func (reg *Registry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(reg.Policy())
+}
+
+// UnmarshalJSON replaces the roles, assignments and constraints of
+// the registry with the ones of the policy. Roles are made with the factory
+// of the registry; a zero Registry uses NewRole.
+//
+// The live sessions of the registry move to the new roles; the roles no
+// longer assigned to their subjects are deactivated.
+//
+// Returns ErrStoreBound if the registry is bound to a store, see
+// LoadRegistry; the policy of such a registry is changed by its store.
+func (reg *Registry) UnmarshalJSON(data []byte) error {
+	reg.mutex.RLock()
+	factory, store := reg.factory, reg.store
+	reg.mutex.RUnlock()
+
+	if store != nil {
+		return ErrStoreBound
+	}
+
+	built, err := Import(data, factory)
+	if err != nil {
+		return err
+	}
+
+	defer reg.refreshSnapshot()
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	reg.roles = built.roles
+	reg.assignments = built.assignments
+	reg.ssd = built.ssd
+	reg.dsd = built.dsd
+	reg.factory = built.factory
+	if reg.sessions == nil {
+		reg.sessions = make(map[string]map[*Session]bool)
+	}
+
+	reg.rebindSessions(reg.roles)
+	return nil
+}
@@ -0,0 +1,186 @@
+package grbac
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const testPolicy = `{
+  "roles": [
+    {"name": "General", "permissions": ["ReadMsg"]},
+    {"name": "User", "permissions": ["SendMsg", "report:*"], "parents": ["General"]},
+    {"name": "Contractor", "denials": ["report:salary"], "parents": ["User"]},
+    {"name": "Approver", "permissions": ["Approve"]}
+  ],
+  "assignments": {"alice": ["Contractor"], "bob": ["User", "Approver"]},
+  "ssd": [{"name": "payments", "roles": ["Approver", "Contractor"], "cardinality": 2}]
+}`
+
+func importPolicy(newFunc NewFunc, t *testing.T) {
+	reg, err := Import([]byte(testPolicy), RoleFactory(newFunc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reg.IsAllowed("Contractor", "ReadMsg", "SendMsg", "report:sales") {
+		t.Errorf("expected that Contractor role inherits the permissions")
+	}
+
+	if reg.IsAllowed("Contractor", "report:salary") {
+		t.Errorf("expected that Contractor role denies report:salary")
+	}
+
+	if !reg.Can("bob", "Approve", "ReadMsg") || !reg.Can("alice", "SendMsg") {
+		t.Errorf("expected that the assignments are imported")
+	}
+
+	if _, ok := reg.SSD()["payments"]; !ok {
+		t.Errorf("expected that the constraints are imported")
+	}
+
+	data, err := json.Marshal(reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var again Registry
+	if err := json.Unmarshal(data, &again); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(reg.Policy(), again.Policy()) {
+		t.Errorf("expected that the policy survives a round trip")
+		t.Logf("before: %#v", reg.Policy())
+		t.Logf("after: %#v", again.Policy())
+	}
+
+	if !again.IsAllowed("Contractor", "ReadMsg") || again.IsAllowed("Contractor", "report:salary") {
+		t.Errorf("expected that the decoded registry answers like the original one")
+	}
+}
+
+func importInvalidPolicy(newFunc NewFunc, t *testing.T) {
+	policies := map[string]string{
+		"duplicate":      `{"roles": [{"name": "User"}, {"name": "User"}]}`,
+		"unknown parent": `{"roles": [{"name": "User", "parents": ["General"]}]}`,
+		"cycle":          `{"roles": [{"name": "A", "parents": ["B"]}, {"name": "B", "parents": ["A"]}]}`,
+		"unknown role":   `{"roles": [{"name": "User"}], "assignments": {"alice": ["Admin"]}}`,
+		"constraint": `{"roles": [{"name": "A"}, {"name": "B"}],
+			"assignments": {"alice": ["A", "B"]},
+			"ssd": [{"name": "ab", "roles": ["A", "B"], "cardinality": 2}]}`,
+	}
+
+	errs := map[string]error{
+		"duplicate":      ErrRoleExists,
+		"unknown parent": ErrNoRole,
+		"unknown role":   ErrNoRole,
+	}
+
+	for name, policy := range policies {
+		_, err := Import([]byte(policy), RoleFactory(newFunc))
+		policyErr, ok := err.(*PolicyError)
+		if !ok {
+			t.Errorf("%s: expected PolicyError, got \"%v\"", name, err)
+			continue
+		}
+
+		if expected, ok := errs[name]; ok && policyErr.Err != expected {
+			t.Errorf("%s: expected \"%v\", got \"%v\"", name, expected, policyErr.Err)
+		}
+	}
+
+	_, err := Import([]byte(policies["cycle"]), RoleFactory(newFunc))
+	if err.Error() != `policy: role "B": parent "A": parent would create a cycle: B -> A -> B` {
+		t.Errorf("PolicyError has an incorrect message: %v", err)
+	}
+}
+
+func exportRoles(newFunc NewFunc, t *testing.T) {
+	roleGeneral := newFunc("General")
+	roleGeneral.Permit("ReadMsg")
+
+	roleUser := newFunc("User")
+	roleUser.SetParent(roleGeneral)
+	roleUser.(Denier).Deny("DelMsg")
+
+	p := Export(roleUser)
+
+	expected := []RoleRecord{
+		{Name: "General", Permissions: []string{"ReadMsg"}, Denials: []string{}, Parents: []string{}},
+		{Name: "User", Permissions: []string{}, Denials: []string{"DelMsg"}, Parents: []string{"General"}},
+	}
+
+	if !reflect.DeepEqual(p.Roles, expected) {
+		t.Errorf("Export returned an incorrect policy: %#v", p.Roles)
+	}
+}
+
+func TestDefaultRoleImportPolicy(t *testing.T) {
+	importPolicy(newRole, t)
+}
+
+func TestCachedRoleImportPolicy(t *testing.T) {
+	importPolicy(newCachedRole, t)
+}
+
+func TestDefaultRoleImportInvalidPolicy(t *testing.T) {
+	importInvalidPolicy(newRole, t)
+}
+
+func TestCachedRoleImportInvalidPolicy(t *testing.T) {
+	importInvalidPolicy(newCachedRole, t)
+}
+
+func TestDefaultRoleExportRoles(t *testing.T) {
+	exportRoles(newRole, t)
+}
+
+func TestCachedRoleExportRoles(t *testing.T) {
+	exportRoles(newCachedRole, t)
+}
+
+func TestUnmarshalJSONSessions(t *testing.T) {
+	reg, err := Import([]byte(testPolicy), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := reg.NewSession("bob", 0)
+	s.Activate("User")
+	s.Activate("Approver")
+
+	// bob is no longer an Approver, and User may not send messages.
+	policy := `{
+  "roles": [
+    {"name": "User", "permissions": ["ReadMsg"]},
+    {"name": "Approver", "permissions": ["Approve"]}
+  ],
+  "assignments": {"bob": ["User"]}
+}`
+	if err := json.Unmarshal([]byte(policy), reg); err != nil {
+		t.Fatal(err)
+	}
+
+	active := s.ActiveRoles()
+	if len(active) != 1 || active["User"] != reg.Get("User") {
+		t.Errorf("expected that the session has only the new User role: %v", active)
+	}
+	if s.IsAllowed("Approve") || s.IsAllowed("SendMsg") || !s.IsAllowed("ReadMsg") {
+		t.Errorf("expected that the session answers with the new policy")
+	}
+}
+
+func TestUnmarshalJSONStore(t *testing.T) {
+	reg, err := LoadRegistry(NewMemoryStore(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := json.Unmarshal([]byte(testPolicy), reg); err != ErrStoreBound {
+		t.Errorf("expected \"%v\", got \"%v\"", ErrStoreBound, err)
+	}
+	if reg.Has("User") {
+		t.Errorf("expected that the registry is not changed")
+	}
+}
@@ -0,0 +1,203 @@
+package grbac
+
+import (
+	"context"
+	"time"
+)
+
+// SetRebuildDelay makes the role rebuild its caches in the background.
+//
+// With a positive delay the changes of the role itself, such as Permit,
+// Revoke, SetParent and RemoveParent, and the events of its notifying
+// parents do not touch the caches. The first of them schedules a rebuild
+// after the delay, and the following ones until the rebuild are coalesced
+// into it. Until then the checks of the role and its children answer with
+// the old caches; use Flush or WaitFresh to read your writes.
+//
+// A zero delay, the default, updates the caches on every change; a pending
+// rebuild is done at once then.
+func (r *CachedRole) SetRebuildDelay(delay time.Duration) {
+	r.mutex.Lock()
+	r.delay = delay
+	r.mutex.Unlock()
+
+	if delay <= 0 {
+		r.rebuild()
+	}
+}
+
+// Flush does the pending rebuilds of the role and its cached ancestors now.
+func (r *CachedRole) Flush() {
+	for _, c := range cachedAncestors(r) {
+		c.rebuild()
+	}
+}
+
+// WaitFresh waits for the rebuilds of the role and its cached ancestors
+// pending at the call, so the caches have all the changes made before it.
+// Returns the error of ctx if it is done first.
+func (r *CachedRole) WaitFresh(ctx context.Context) error {
+	var pending []chan struct{}
+	for _, c := range cachedAncestors(r) {
+		c.mutex.RLock()
+		if c.fresh != nil {
+			pending = append(pending, c.fresh)
+		}
+		c.mutex.RUnlock()
+	}
+
+	for _, fresh := range pending {
+		select {
+		case <-fresh:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Generation returns the generation of the caches of the role. It grows
+// with every change of the caches, so two checks answered with the same
+// generation saw the same cached rules. The rules of the live roles, see
+// SetParent, are not counted in it.
+func (r *CachedRole) Generation() uint64 {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.generation
+}
+
+// IsAllowedGeneration is like IsAllowed and also returns the generation of
+// the caches that answered.
+func (r *CachedRole) IsAllowedGeneration(perms ...string) (bool, uint64) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.isAllowed(perms), r.generation
+}
+
+// changeOwn counts the delta of a change of the role itself, or schedules
+// a rebuild if the role rebuilds its caches in the background.
+// The caller must hold hierarchyMutex, which changeOwn releases.
+func (r *CachedRole) changeOwn(d cacheDelta) {
+	if r.schedule() {
+		hierarchyMutex.Unlock()
+		return
+	}
+	r.change(d)
+}
+
+// refresh is like changeOwn for a change that needs the caches recounted.
+func (r *CachedRole) refresh() {
+	if r.schedule() {
+		hierarchyMutex.Unlock()
+		return
+	}
+	r.update(r.recount())
+}
+
+// invalidate is refresh for the caller not holding hierarchyMutex.
+func (r *CachedRole) invalidate() {
+	hierarchyMutex.Lock()
+	r.refresh()
+}
+
+// schedule schedules a rebuild of the caches, unless one is pending
+// already, and reports whether the role rebuilds them in the background.
+// Held caches are rebuilt by release instead.
+// The caller must hold hierarchyMutex.
+func (r *CachedRole) schedule() bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.held {
+		return true
+	}
+
+	if r.delay <= 0 {
+		return false
+	}
+
+	if r.timer == nil {
+		r.fresh = make(chan struct{})
+		r.timer = time.AfterFunc(r.delay, r.rebuild)
+	}
+	return true
+}
+
+// takePending cancels the pending rebuild and returns the channel to close
+// once the caches are rebuilt, or nil if no rebuild is pending.
+// The caller must hold hierarchyMutex.
+func (r *CachedRole) takePending() chan struct{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.timer == nil {
+		return nil
+	}
+
+	r.timer.Stop()
+	fresh := r.fresh
+	r.timer, r.fresh = nil, nil
+	return fresh
+}
+
+// rebuild recounts the caches if a rebuild is pending.
+func (r *CachedRole) rebuild() {
+	hierarchyMutex.Lock()
+
+	fresh := r.takePending()
+	if fresh == nil {
+		hierarchyMutex.Unlock()
+		return
+	}
+
+	r.update(r.recount())
+	close(fresh)
+}
+
+// hold keeps the caches of the role as they are until release: the changes
+// of the role and its parents are not counted, as if a rebuild were pending.
+// A batch holds the caches of the roles it changes, so each of them is
+// recounted once.
+func (r *CachedRole) hold() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.held = true
+}
+
+// release recounts the held caches of the role, see UpdateCache. The parents
+// held together with the role must be released first.
+func (r *CachedRole) release() {
+	r.mutex.Lock()
+	r.held = false
+	r.mutex.Unlock()
+
+	r.UpdateCache()
+}
+
+// cachedAncestors returns the role and its CachedRole ancestors, every
+// ancestor before its children.
+func cachedAncestors(r *CachedRole) []*CachedRole {
+	var order []*CachedRole
+	seen := make(map[*CachedRole]bool)
+
+	var visit func(c *CachedRole)
+	visit = func(c *CachedRole) {
+		if seen[c] {
+			return
+		}
+		seen[c] = true
+
+		for _, parent := range c.Role.Parents() {
+			if p, ok := unwrapRole(parent).(*CachedRole); ok {
+				visit(p)
+			}
+		}
+		order = append(order, c)
+	}
+
+	visit(r)
+	return order
+}
@@ -0,0 +1,184 @@
+package grbac
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCachedRoleRebuildDelay(t *testing.T) {
+	roleGeneral := NewCachedRole("General")
+	roleGeneral.SetRebuildDelay(time.Hour)
+
+	roleUser := NewCachedRole("User")
+	if err := roleUser.SetParent(roleGeneral); err != nil {
+		t.Fatal(err)
+	}
+	gen := roleUser.Generation()
+
+	roleGeneral.Permit("ReadMsg")
+	roleGeneral.Permit("SendMsg")
+	if allowed, g := roleUser.IsAllowedGeneration("ReadMsg"); allowed || g != gen {
+		t.Errorf("expected that User answers with the old caches before the rebuild")
+	}
+
+	roleUser.Flush()
+	allowed, g := roleUser.IsAllowedGeneration("ReadMsg", "SendMsg")
+	if !allowed {
+		t.Errorf("expected that User inherits the permissions after the rebuild")
+	}
+	if g != gen+1 {
+		t.Errorf("expected that the burst is rebuilt once, got generation %d after %d", g, gen)
+	}
+
+	// The rebuild is done in the background after the delay.
+	roleGeneral.SetRebuildDelay(10 * time.Millisecond)
+	roleGeneral.Permit("EditMsg")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := roleUser.WaitFresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !roleUser.IsAllowed("EditMsg") {
+		t.Errorf("expected that User inherits EditMsg after WaitFresh")
+	}
+}
+
+func TestCachedRoleFlush(t *testing.T) {
+	roleGeneral := NewCachedRole("General")
+	roleGeneral.Permit("ReadMsg")
+	roleGeneral.SetRebuildDelay(time.Hour)
+
+	roleUser := NewCachedRole("User")
+	roleUser.SetParent(roleGeneral)
+
+	roleGeneral.Revoke("ReadMsg")
+	if !roleUser.IsAllowed("ReadMsg") {
+		t.Fatalf("expected that the revocation waits for the rebuild")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := roleUser.WaitFresh(ctx); err != context.Canceled {
+		t.Errorf("expected \"%v\", got \"%v\"", context.Canceled, err)
+	}
+
+	roleUser.Flush()
+	if roleUser.IsAllowed("ReadMsg") {
+		t.Errorf("expected that Flush rebuilds the caches of the ancestors")
+	}
+	if err := roleUser.WaitFresh(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	// Snapshots are compiled from the caches as they are.
+	roleGeneral.Permit("SendMsg")
+	if Compile(roleUser).IsAllowed("User", "SendMsg") {
+		t.Errorf("expected that Compile does not rebuild the pending caches")
+	}
+
+	roleUser.Flush()
+	if !Compile(roleUser).IsAllowed("User", "SendMsg") {
+		t.Errorf("expected that Compile sees the flushed caches")
+	}
+
+	roleGeneral.Deny("SendMsg")
+	roleGeneral.SetRebuildDelay(0)
+	if roleUser.IsAllowed("SendMsg") {
+		t.Errorf("expected that a zero delay rebuilds the pending caches")
+	}
+}
+
+func TestCachedRoleRebuildDelayRegistry(t *testing.T) {
+	reg := NewRegistry(RoleFactory(newCachedRole))
+	roleGeneral, _ := reg.Create("General")
+	roleUser, _ := reg.Create("User")
+	reg.SetParent("User", "General")
+	reg.Compile()
+
+	roleGeneral.(*CachedRole).SetRebuildDelay(time.Hour)
+	roleGeneral.Permit("ReadMsg")
+
+	// The writes of the registry compile new snapshots, but do not rebuild
+	// the pending caches.
+	reg.Create("Admin")
+	if roleUser.IsAllowed("ReadMsg") || reg.Snapshot().IsAllowed("User", "ReadMsg") {
+		t.Errorf("expected that the rebuild of General is still pending")
+	}
+
+	roleUser.(*CachedRole).Flush()
+	if !reg.Compile().IsAllowed("User", "ReadMsg") {
+		t.Errorf("expected that Compile sees the flushed caches")
+	}
+}
+
+func TestCachedRoleRebuildRandomHierarchy(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	const count = 12
+	plain := make([]*Role, count)
+	roles := make([]*CachedRole, count)
+	for i := range roles {
+		name := "role" + strconv.Itoa(i)
+		plain[i] = NewRole(name)
+		roles[i] = NewCachedRole(name)
+
+		// The rebuilds are done by Flush only.
+		if i%2 == 0 {
+			roles[i].SetRebuildDelay(time.Hour)
+		}
+	}
+
+	for step := 0; step < 2000; step++ {
+		i := rnd.Intn(count)
+		perm := "perm" + strconv.Itoa(rnd.Intn(8))
+
+		switch rnd.Intn(6) {
+		case 0:
+			roles[i].Permit(perm)
+			plain[i].Permit(perm)
+		case 1:
+			roles[i].Revoke(perm)
+			plain[i].Revoke(perm)
+		case 2:
+			roles[i].Deny(perm)
+			plain[i].Deny(perm)
+		case 3:
+			roles[i].Undeny(perm)
+			plain[i].Undeny(perm)
+		case 4:
+			if j := rnd.Intn(count); j < i {
+				roles[i].SetParent(roles[j])
+				plain[i].SetParent(plain[j])
+			}
+		case 5:
+			name := "role" + strconv.Itoa(rnd.Intn(count))
+			roles[i].RemoveParent(name)
+			plain[i].RemoveParent(name)
+		}
+
+		if rnd.Intn(4) != 0 {
+			continue
+		}
+
+		for k := range roles {
+			roles[k].Flush()
+			if !reflect.DeepEqual(roles[k].AllPermissions(), plain[k].AllPermissions()) ||
+				!reflect.DeepEqual(roles[k].AllDenials(), plain[k].AllDenials()) {
+				t.Fatalf("step %d: rules of %s differ: %v %v, expected %v %v", step, roles[k].Name(),
+					roles[k].AllPermissions(), roles[k].AllDenials(),
+					plain[k].AllPermissions(), plain[k].AllDenials())
+			}
+		}
+	}
+
+	for _, role := range roles {
+		if err := role.Verify(); err != nil {
+			t.Error(err)
+		}
+	}
+}
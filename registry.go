@@ -0,0 +1,346 @@
+package grbac
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Error codes returned by failures to manage roles in a registry.
+var (
+	ErrRoleExists = errors.New("role already exists")
+	ErrNoRole     = errors.New("role does not exist")
+	ErrStoreBound = errors.New("registry is bound to a store")
+)
+
+// RoleFactory creates a new role with the given name.
+type RoleFactory func(name string) Roler
+
+// Registry owns a set of roles and gives access to them by name.
+//
+// The names of the roles in a registry are unique. Parents of the roles are
+// expected to be registered in the same registry.
+type Registry struct {
+	roles       map[string]Roler
+	assignments map[string]map[string]bool
+	sessions    map[string]map[*Session]bool
+	ssd         map[string]SoDConstraint
+	dsd         map[string]SoDConstraint
+	factory     RoleFactory
+	store       Store
+	auditor     Auditor
+
+	// snapshot is the current *Snapshot, see Compile.
+	snapshot     atomic.Value
+	compileMutex sync.Mutex
+
+	// writeMutex serializes the changes that change roles. The roles are
+	// changed without the registry locked, so they may publish their events
+	// to subscribers that read the registry.
+	writeMutex sync.Mutex
+
+	mutex sync.RWMutex
+}
+
+// NewRegistry creates a new empty registry. Roles made by Create are built
+// with factory. If factory is nil, NewRole is used.
+func NewRegistry(factory RoleFactory) *Registry {
+	if factory == nil {
+		factory = func(name string) Roler { return NewRole(name) }
+	}
+
+	return &Registry{
+		roles:       make(map[string]Roler),
+		assignments: make(map[string]map[string]bool),
+		sessions:    make(map[string]map[*Session]bool),
+		ssd:         make(map[string]SoDConstraint),
+		dsd:         make(map[string]SoDConstraint),
+		factory:     factory,
+	}
+}
+
+// Create makes a new role with the name and adds it to the registry.
+//
+// Returns ErrRoleExists if the registry already has a role with the name.
+func (reg *Registry) Create(name string) (Roler, error) {
+	defer reg.refreshRoles(name)
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	if _, ok := reg.roles[name]; ok {
+		return nil, ErrRoleExists
+	}
+
+	role := reg.factory(name)
+	if reg.store != nil {
+		if err := reg.store.SaveRole(RecordOf(role)); err != nil {
+			return nil, err
+		}
+	}
+
+	reg.roles[name] = role
+	return role, nil
+}
+
+// Add puts an existing role into the registry.
+//
+// Returns ErrRoleExists if the registry already has a role with the same name.
+func (reg *Registry) Add(role Roler) error {
+	defer reg.refreshRoles(role.Name())
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	if _, ok := reg.roles[role.Name()]; ok {
+		return ErrRoleExists
+	}
+
+	if reg.store != nil {
+		if err := reg.store.SaveRole(RecordOf(role)); err != nil {
+			return err
+		}
+	}
+
+	reg.roles[role.Name()] = role
+	return nil
+}
+
+// Get returns the role by the name.
+// If the registry does not have the role, the function returns nil.
+func (reg *Registry) Get(name string) Roler {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	return reg.roles[name]
+}
+
+// Has checks that the registry has a role with the name.
+func (reg *Registry) Has(name string) bool {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	_, ok := reg.roles[name]
+	return ok
+}
+
+// Roles returns a copy of the map of all registered roles.
+//
+// Key of the map - a name of the role.
+func (reg *Registry) Roles() map[string]Roler {
+	newRoles := make(map[string]Roler)
+
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	for k, v := range reg.roles {
+		newRoles[k] = v
+	}
+	return newRoles
+}
+
+// Remove deletes the role from the registry, takes it away from the subjects
+// and their sessions, detaches it from its parents and from all registered
+// roles that have it as a direct parent.
+//
+// Returns ErrNoRole if the registry does not have the role.
+func (reg *Registry) Remove(name string) error {
+	defer reg.refreshRoles(name)
+
+	reg.writeMutex.Lock()
+	defer reg.writeMutex.Unlock()
+
+	removed, children, err := reg.remove(name)
+	if err != nil {
+		return err
+	}
+
+	// The links of the wrapped role are dropped, so wrappers such as
+	// StoredRole do not save the removed role again.
+	inner := unwrapRole(removed)
+	for parent := range inner.Parents() {
+		if err := inner.RemoveParent(parent); err != nil {
+			return err
+		}
+	}
+
+	for _, role := range children {
+		if err := role.RemoveParent(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes the role from the registry and returns it and
+// the registered roles that have it as a direct parent.
+// The caller must hold writeMutex.
+func (reg *Registry) remove(name string) (removed Roler, children []Roler, err error) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	removed, ok := reg.roles[name]
+	if !ok {
+		return nil, nil, ErrNoRole
+	}
+
+	if reg.store != nil {
+		if err := reg.store.DeleteRole(name); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	delete(reg.roles, name)
+
+	for subject, roles := range reg.assignments {
+		delete(roles, name)
+		if len(roles) == 0 {
+			delete(reg.assignments, subject)
+		}
+	}
+	reg.deactivateRole("", name)
+
+	for _, role := range reg.roles {
+		if role.HasParent(name) {
+			children = append(children, role)
+		}
+	}
+	return removed, children, nil
+}
+
+// SetParent makes the role named parent a parent of the role named child.
+//
+// Returns ErrNoRole if either of the roles is not registered and a SoDError
+// if the inherited roles would violate a static separation of duty
+// constraint. The constraints are checked only for the parents set through
+// the registry.
+func (reg *Registry) SetParent(child, parent string) error {
+	defer reg.refreshRoles(child)
+
+	reg.writeMutex.Lock()
+	defer reg.writeMutex.Unlock()
+
+	c, p, err := reg.parentOf(child, parent)
+	if err != nil {
+		return err
+	}
+
+	return c.SetParent(p)
+}
+
+// parentOf returns the roles named child and parent if parent can become
+// a parent of child.
+// The caller must hold writeMutex.
+func (reg *Registry) parentOf(child, parent string) (c, p Roler, err error) {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	c, cOk := reg.roles[child]
+	p, pOk := reg.roles[parent]
+
+	if !cOk || !pOk {
+		return nil, nil, ErrNoRole
+	}
+
+	if err := reg.checkParentSSD(child, parent); err != nil {
+		return nil, nil, err
+	}
+	return c, p, nil
+}
+
+// RemoveParent removes the role named parent from the parents of the role
+// named child.
+//
+// Returns ErrNoRole if the child is not registered.
+func (reg *Registry) RemoveParent(child, parent string) error {
+	defer reg.refreshRoles(child)
+
+	c := reg.Get(child)
+	if c == nil {
+		return ErrNoRole
+	}
+
+	return c.RemoveParent(parent)
+}
+
+// Permit grants the permission to the role with the name.
+//
+// Unlike Roler.Permit on the role itself, it compiles a new snapshot of
+// the registry. Returns ErrNoRole if the registry does not have the role.
+func (reg *Registry) Permit(name, perm string) error {
+	defer reg.refreshRoles(name)
+
+	role := reg.Get(name)
+	if role == nil {
+		return ErrNoRole
+	}
+
+	return role.Permit(perm)
+}
+
+// Revoke revokes the permission from the role with the name, see Permit.
+func (reg *Registry) Revoke(name, perm string) error {
+	defer reg.refreshRoles(name)
+
+	role := reg.Get(name)
+	if role == nil {
+		return ErrNoRole
+	}
+
+	return role.Revoke(perm)
+}
+
+// Deny denies the permission to the role with the name, see Permit.
+//
+// Returns ErrNoDenials if the role is not a Denier.
+func (reg *Registry) Deny(name, perm string) error {
+	defer reg.refreshRoles(name)
+
+	role := reg.Get(name)
+	if role == nil {
+		return ErrNoRole
+	}
+
+	return deny(role, perm)
+}
+
+// Undeny removes the denial of the permission from the role with the name,
+// see Deny.
+func (reg *Registry) Undeny(name, perm string) error {
+	defer reg.refreshRoles(name)
+
+	role := reg.Get(name)
+	if role == nil {
+		return ErrNoRole
+	}
+
+	return undeny(role, perm)
+}
+
+// IsAllowed checks the permissions of the role with the name.
+// If the registry does not have the role, the function returns false.
+func (reg *Registry) IsAllowed(name string, perms ...string) bool {
+	role := reg.Get(name)
+	if role == nil {
+		return false
+	}
+
+	return role.IsAllowed(perms...)
+}
+
+// IsAllowedContext is like IsAllowed, but passes ctx to roles that take
+// a context for their checks, such as AuditedRole.
+func (reg *Registry) IsAllowedContext(ctx context.Context, name string, perms ...string) bool {
+	role := reg.Get(name)
+	if role == nil {
+		return false
+	}
+
+	if r, ok := role.(interface {
+		IsAllowedContext(context.Context, ...string) bool
+	}); ok {
+		return r.IsAllowedContext(ctx, perms...)
+	}
+	return role.IsAllowed(perms...)
+}
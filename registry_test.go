@@ -0,0 +1,137 @@
+package grbac
+
+import "testing"
+
+func registryCreate(newFunc NewFunc, t *testing.T) {
+	reg := NewRegistry(RoleFactory(newFunc))
+
+	roleUser, err := reg.Create("User")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r := reg.Get("User"); r != roleUser {
+		t.Errorf("expected that Get returns the created User role")
+	}
+
+	if _, err := reg.Create("User"); err != ErrRoleExists {
+		t.Errorf("expected \"%v\"", ErrRoleExists)
+	}
+
+	if err := reg.Add(newFunc("User")); err != ErrRoleExists {
+		t.Errorf("expected \"%v\"", ErrRoleExists)
+	}
+
+	if err := reg.Add(newFunc("Admin")); err != nil {
+		t.Error(err)
+	}
+
+	roles := reg.Roles()
+	if _, ok := roles["User"]; !ok || len(roles) != 2 || !reg.Has("Admin") {
+		t.Errorf("expected that the registry has User and Admin roles")
+		t.Log(roles)
+	}
+
+	if r := reg.Get("No Role!"); r != nil {
+		t.Errorf("expected that the registry does not have \"No Role!\"")
+	}
+}
+
+func registrySetParent(newFunc NewFunc, t *testing.T) {
+	reg := NewRegistry(RoleFactory(newFunc))
+
+	roleUser, _ := reg.Create("User")
+	roleUser.Permit("ReadMsg")
+	reg.Create("Admin")
+
+	if err := reg.SetParent("Admin", "User"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reg.IsAllowed("Admin", "ReadMsg") {
+		t.Errorf("expected that Admin role inherits ReadMsg from User role")
+	}
+
+	if err := reg.SetParent("Admin", "No Role!"); err != ErrNoRole {
+		t.Errorf("expected \"%v\"", ErrNoRole)
+	}
+
+	if err := reg.RemoveParent("Admin", "User"); err != nil {
+		t.Error(err)
+	}
+
+	if reg.IsAllowed("Admin", "ReadMsg") {
+		t.Errorf("expected that Admin role does not have ReadMsg now")
+	}
+}
+
+func registryRemove(newFunc NewFunc, t *testing.T) {
+	reg := NewRegistry(RoleFactory(newFunc))
+
+	reg.Create("User")
+	roleAdmin, _ := reg.Create("Admin")
+	reg.SetParent("Admin", "User")
+
+	if err := reg.Remove("User"); err != nil {
+		t.Fatal(err)
+	}
+
+	if reg.Has("User") {
+		t.Errorf("expected that the registry does not have User role")
+	}
+
+	if roleAdmin.HasParent("User") {
+		t.Errorf("expected that Admin role does not have User role in parents")
+	}
+
+	if err := reg.Remove("User"); err != ErrNoRole {
+		t.Errorf("expected \"%v\"", ErrNoRole)
+	}
+
+	// A removed role leaves its parents, so a new role with its name can
+	// take its place.
+	reg.Create("User")
+	reg.SetParent("Admin", "User")
+	if err := reg.Remove("Admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	if roleAdmin.HasParent("User") {
+		t.Errorf("expected that the removed Admin role does not have User role in parents")
+	}
+
+	reg.Create("Admin")
+	if err := reg.SetParent("Admin", "User"); err != nil {
+		t.Errorf("expected that the new Admin role can inherit User role: %v", err)
+	}
+
+	if c, ok := reg.Get("User").(*CachedRole); ok {
+		if err := c.Verify(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDefaultRoleRegistryCreate(t *testing.T) {
+	registryCreate(newRole, t)
+}
+
+func TestCachedRoleRegistryCreate(t *testing.T) {
+	registryCreate(newCachedRole, t)
+}
+
+func TestDefaultRoleRegistrySetParent(t *testing.T) {
+	registrySetParent(newRole, t)
+}
+
+func TestCachedRoleRegistrySetParent(t *testing.T) {
+	registrySetParent(newCachedRole, t)
+}
+
+func TestDefaultRoleRegistryRemove(t *testing.T) {
+	registryRemove(newRole, t)
+}
+
+func TestCachedRoleRegistryRemove(t *testing.T) {
+	registryRemove(newCachedRole, t)
+}
@@ -5,6 +5,7 @@ package grbac
 
 import (
 	"errors"
+	"strings"
 	"sync"
 )
 
@@ -12,10 +13,68 @@ import (
 var (
 	ErrRoleHasPerm   = errors.New("role already has permission")
 	ErrRoleNotPerm   = errors.New("role does not have permission")
+	ErrRoleHasDeny   = errors.New("role already denies permission")
+	ErrRoleNotDeny   = errors.New("role does not deny permission")
 	ErrRoleHasParent = errors.New("role already has the parent")
 	ErrNoParent      = errors.New("parent does not exist")
+	ErrCycle         = errors.New("parent would create a cycle")
+	ErrNoDenials     = errors.New("role does not support denials")
 )
 
+// hierarchyMutex serializes changes of parents, so that two concurrent
+// SetParent calls cannot close a cycle that neither of them sees alone.
+// It also serializes the changes of the CachedRole caches, which are
+// propagated by deltas and must see each other in order. It is shared by
+// all the roles of the process, see CachedRole for what that costs.
+var hierarchyMutex sync.Mutex
+
+// CycleError is returned by SetParent when the new parent would make a role
+// its own ancestor.
+type CycleError struct {
+	// Path is the chain of role names from the role through the new parent
+	// back to the role itself.
+	Path []string
+}
+
+func (e *CycleError) Error() string {
+	return ErrCycle.Error() + ": " + strings.Join(e.Path, " -> ")
+}
+
+// Unwrap returns ErrCycle.
+func (e *CycleError) Unwrap() error {
+	return ErrCycle
+}
+
+// checkCycle returns a CycleError if making parent a parent of the role named
+// name would close a cycle.
+func checkCycle(name string, parent Roler) error {
+	path := findAncestor(parent, name, make(map[string]bool))
+	if path == nil {
+		return nil
+	}
+	return &CycleError{Path: append([]string{name}, path...)}
+}
+
+// findAncestor returns the chain of role names from role up to the ancestor
+// named target, or nil if role does not inherit target.
+func findAncestor(role Roler, target string, visited map[string]bool) []string {
+	if role.Name() == target {
+		return []string{target}
+	}
+
+	if visited[role.Name()] {
+		return nil
+	}
+	visited[role.Name()] = true
+
+	for _, p := range role.Parents() {
+		if path := findAncestor(p, target, visited); path != nil {
+			return append([]string{role.Name()}, path...)
+		}
+	}
+	return nil
+}
+
 // Roler represents a role in RBAC and describes minimum set of functions
 // for storing, managing and checking permissions associated with the role.
 type Roler interface {
@@ -33,10 +92,96 @@ type Roler interface {
 	RemoveParent(string) error
 }
 
+// Denier is implemented by roles that can deny permissions, such as Role.
+// A denied permission is not allowed for the role and its children, even if
+// it is granted. Rolers without Denier deny nothing.
+type Denier interface {
+	IsGranted(string) bool
+	Denials() map[string]bool
+	AllDenials() map[string]bool
+	EffectivePermissions() map[string]bool
+	Deny(string) error
+	IsDenied(string) bool
+	Undeny(string) error
+}
+
+// permChecker is implemented by the roles that check the grants and
+// the denials of a permission in one walk over their ancestors.
+type permChecker interface {
+	checkPerm(perm string) (granted, denied bool)
+}
+
+// checkPerm checks that the role grants and denies the permission.
+func checkPerm(role Roler, perm string) (granted, denied bool) {
+	c, ok := role.(permChecker)
+	if !ok {
+		c, ok = unwrapRole(role).(permChecker)
+	}
+	if ok {
+		return c.checkPerm(perm)
+	}
+	if d, ok := role.(Denier); ok {
+		return d.IsGranted(perm), d.IsDenied(perm)
+	}
+	return role.IsAllowed(perm), false
+}
+
+// isGranted checks that the role grants the permission, regardless of
+// its denials.
+func isGranted(role Roler, perm string) bool {
+	if d, ok := role.(Denier); ok {
+		return d.IsGranted(perm)
+	}
+	return role.IsAllowed(perm)
+}
+
+// isDenied checks that the role denies the permission.
+func isDenied(role Roler, perm string) bool {
+	d, ok := role.(Denier)
+	return ok && d.IsDenied(perm)
+}
+
+// denialsOf returns the own denials of the role.
+func denialsOf(role Roler) map[string]bool {
+	if d, ok := role.(Denier); ok {
+		return d.Denials()
+	}
+	return make(map[string]bool)
+}
+
+// allDenialsOf returns the denials of the role and its parents.
+func allDenialsOf(role Roler) map[string]bool {
+	if d, ok := role.(Denier); ok {
+		return d.AllDenials()
+	}
+	return make(map[string]bool)
+}
+
+// deny adds a denial to the role, see Denier.
+//
+// Returns ErrNoDenials if the role is not a Denier.
+func deny(role Roler, perm string) error {
+	if d, ok := role.(Denier); ok {
+		return d.Deny(perm)
+	}
+	return ErrNoDenials
+}
+
+// undeny removes a denial from the role, see Denier.
+//
+// Returns ErrNoDenials if the role is not a Denier.
+func undeny(role Roler, perm string) error {
+	if d, ok := role.(Denier); ok {
+		return d.Undeny(perm)
+	}
+	return ErrNoDenials
+}
+
 // Role is default implementation of Roler.
 type Role struct {
 	name        string
-	permissions map[string]bool
+	permissions permSet
+	denials     permSet
 	parents     map[string]Roler
 
 	mutex sync.RWMutex
@@ -46,7 +191,8 @@ type Role struct {
 func NewRole(name string) *Role {
 	return &Role{
 		name:        name,
-		permissions: make(map[string]bool),
+		permissions: newPermSet(),
+		denials:     newPermSet(),
 		parents:     make(map[string]Roler),
 		mutex:       sync.RWMutex{},
 	}
@@ -65,7 +211,7 @@ func (r *Role) Permissions() map[string]bool {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
-	for k, v := range r.permissions {
+	for k, v := range r.permissions.perms {
 		newPerms[k] = v
 	}
 	return newPerms
@@ -79,7 +225,7 @@ func (r *Role) AllPermissions() map[string]bool {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
-	for permission := range r.permissions {
+	for permission := range r.permissions.perms {
 		newPerms[permission] = true
 	}
 
@@ -99,40 +245,92 @@ func (r *Role) Permit(perm string) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	if r.permissions[perm] {
+	if !r.permissions.add(perm) {
 		return ErrRoleHasPerm
 	}
-	r.permissions[perm] = true
 	return nil
 }
 
 // IsAllowed checks permissions listed in the perms.
 // IsAllowed  returns true only if all permissions from perms are present
-// in the role.
+// in the role or matched by its permission patterns, and none of them is
+// denied by the role or its parents.
 func (r *Role) IsAllowed(perms ...string) bool {
 	r.mutex.RLock()
 	defer r.mutex.RUnlock()
 
 	for _, perm := range perms {
-
-		if r.permissions[perm] {
-			continue
+		if granted, denied := r.check(perm); !granted || denied {
+			return false
 		}
+	}
+
+	return true
+}
 
-		isFound := false
-		for _, p := range r.parents {
-			if p.IsAllowed(perm) {
-				isFound = true
-				break
-			}
+func (r *Role) checkPerm(perm string) (granted, denied bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.check(perm)
+}
+
+// check checks the grants and the denials of the permission in one walk
+// over the ancestors, which stops at the first denial.
+// The caller must hold the lock of the role.
+func (r *Role) check(perm string) (granted, denied bool) {
+	if len(r.denials.perms) != 0 && r.denials.match(perm) {
+		return false, true
+	}
+	granted = r.permissions.match(perm)
+
+	for _, p := range r.parents {
+		g, d := checkPerm(p, perm)
+		if d {
+			return false, true
 		}
+		granted = granted || g
+	}
+	return granted, false
+}
 
-		if !isFound {
-			return false
+// IsGranted checks that the role or any of its parents grants
+// the permission. Unlike IsAllowed it does not take denials into account.
+func (r *Role) IsGranted(perm string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.isGranted(perm)
+}
+
+// isGranted checks that the role or its parents grant the permission.
+// The caller must hold the lock of the role.
+func (r *Role) isGranted(perm string) bool {
+	if r.permissions.match(perm) {
+		return true
+	}
+
+	for _, p := range r.parents {
+		if isGranted(p, perm) {
+			return true
 		}
 	}
+	return false
+}
 
-	return true
+// isDenied checks that the role or its parents deny the permission.
+// The caller must hold the lock of the role.
+func (r *Role) isDenied(perm string) bool {
+	if r.denials.match(perm) {
+		return true
+	}
+
+	for _, p := range r.parents {
+		if isDenied(p, perm) {
+			return true
+		}
+	}
+	return false
 }
 
 // Revoke revokes permission from the role
@@ -141,11 +339,103 @@ func (r *Role) Revoke(perm string) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
-	if !r.permissions[perm] {
+	if !r.permissions.remove(perm) {
 		return ErrRoleNotPerm
 	}
+	return nil
+}
+
+// Denials returns a copy of the list of the permissions the role denies,
+// but does not include parental denials.
+func (r *Role) Denials() map[string]bool {
+	newPerms := make(map[string]bool)
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for k, v := range r.denials.perms {
+		newPerms[k] = v
+	}
+	return newPerms
+}
+
+// AllDenials returns a list of all the permissions the role denies
+// including parental denials.
+func (r *Role) AllDenials() map[string]bool {
+	newPerms := make(map[string]bool)
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	for permission := range r.denials.perms {
+		newPerms[permission] = true
+	}
+
+	for _, parent := range r.parents {
+		for permission := range allDenialsOf(parent) {
+			newPerms[permission] = true
+		}
+	}
+
+	return newPerms
+}
+
+// EffectivePermissions returns a list of all the permissions of the role
+// including parental permissions, except the denied ones.
+//
+// A granted pattern stays in the list even if some permissions it matches
+// are denied; IsAllowed gives the exact answer for them.
+func (r *Role) EffectivePermissions() map[string]bool {
+	return effectivePermissions(r.AllPermissions(), r.AllDenials())
+}
+
+func effectivePermissions(grants, denials map[string]bool) map[string]bool {
+	if len(denials) == 0 {
+		return grants
+	}
+
+	denied := permSetOf(denials)
+	for perm := range grants {
+		if denied.match(perm) {
+			delete(grants, perm)
+		}
+	}
+	return grants
+}
+
+// Deny adds a denial of the permission to the role. A denied permission is
+// not allowed for the role and its children, even if the role or any of its
+// parents grants it.
+//
+// Returns ErrRoleHasDeny if the role already denies the permission.
+func (r *Role) Deny(perm string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.denials.add(perm) {
+		return ErrRoleHasDeny
+	}
+	return nil
+}
+
+// IsDenied checks that the role or any of its parents denies the permission.
+func (r *Role) IsDenied(perm string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
 
-	delete(r.permissions, perm)
+	return r.isDenied(perm)
+}
+
+// Undeny removes the denial of the permission from the role.
+//
+// Returns ErrRoleNotDeny if the role does not deny the permission.
+func (r *Role) Undeny(perm string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.denials.remove(perm) {
+		return ErrRoleNotDeny
+	}
 	return nil
 }
 
@@ -205,8 +495,22 @@ func (r *Role) HasParent(name string) bool {
 }
 
 // SetParent adds to the Role a new parent.
-// Returns ErrRoleHasAlreadyParent if a parent is already available.
+// Returns ErrRoleHasAlreadyParent if a parent is already available
+// and a CycleError if the role is already an ancestor of the parent.
 func (r *Role) SetParent(role Roler) error {
+	hierarchyMutex.Lock()
+	defer hierarchyMutex.Unlock()
+
+	if err := checkCycle(r.name, role); err != nil {
+		return err
+	}
+
+	return r.setParent(role)
+}
+
+// setParent adds the parent without the cycle check.
+// The caller must hold hierarchyMutex.
+func (r *Role) setParent(role Roler) error {
 	r.mutex.Lock()
 	defer r.mutex.Unlock()
 
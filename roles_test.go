@@ -1,6 +1,12 @@
 package grbac
 
-import "testing"
+import (
+	"math/rand"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
 
 type NewFunc func(string) Roler
 type NewCachedFunc func(string) CachedRoler
@@ -105,11 +111,150 @@ func setParents(newFunc NewFunc, t *testing.T) {
 	}
 }
 
-func setNoCachedParent(newFunc NewCachedFunc, t *testing.T) {
+func setCycleParent(newFunc NewFunc, t *testing.T) {
+	roleA := newFunc("RoleA")
+	roleB := newFunc("RoleB")
+	roleC := newFunc("RoleC")
+
+	if err := roleB.SetParent(roleA); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := roleC.SetParent(roleB); err != nil {
+		t.Fatal(err)
+	}
+
+	err := roleA.SetParent(roleC)
+	cycleErr, ok := err.(*CycleError)
+	if !ok {
+		t.Fatalf("expected CycleError, got \"%v\"", err)
+	}
+
+	if cycleErr.Error() != "parent would create a cycle: RoleA -> RoleC -> RoleB -> RoleA" {
+		t.Errorf("CycleError returned an incorrect path: %v", cycleErr)
+	}
+
+	if roleA.HasParent(roleC.Name()) {
+		t.Errorf("expected that RoleA does not have RoleC in parents")
+	}
+
+	if _, ok := roleA.SetParent(roleA).(*CycleError); !ok {
+		t.Errorf("expected that RoleA cannot be a parent of itself")
+	}
+
+	// The graph must still be usable after the refused edges.
+	roleA.Permit("PermA")
+	if !roleC.IsAllowed("PermA") {
+		t.Errorf("expected that RoleC inherits PermA from RoleA")
+	}
+}
+
+func setConcurrentCycleParent(newFunc NewFunc, t *testing.T) {
+	for i := 0; i < 100; i++ {
+		roleA := newFunc("RoleA")
+		roleB := newFunc("RoleB")
+
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs[0] = roleA.SetParent(roleB)
+		}()
+		go func() {
+			defer wg.Done()
+			errs[1] = roleB.SetParent(roleA)
+		}()
+		wg.Wait()
+
+		if (errs[0] == nil) == (errs[1] == nil) {
+			t.Fatalf("expected that exactly one of the edges is refused: %v", errs)
+		}
+	}
+}
+
+// customRole is a Roler of another package, which CachedRole knows
+// nothing about.
+type customRole struct {
+	*Role
+}
+
+// minimalRole is a Roler without denials: only the methods of Roler are
+// promoted from the embedded interface.
+type minimalRole struct {
+	Roler
+}
+
+func minimalParent(newFunc NewFunc, t *testing.T) {
+	roleBase := minimalRole{NewRole("Base")}
+	roleBase.Permit("ReadMsg")
+
+	if _, ok := Roler(roleBase).(Denier); ok {
+		t.Fatalf("expected that minimalRole is not a Denier")
+	}
+
+	roleUser := newFunc("User")
+	if err := roleUser.SetParent(roleBase); err != nil {
+		t.Fatal(err)
+	}
+	roleUser.(Denier).Deny("SendMsg")
+	roleBase.Permit("SendMsg")
+
+	if !roleUser.IsAllowed("ReadMsg") || roleUser.IsAllowed("SendMsg") {
+		t.Errorf("expected that User inherits from the minimal parent")
+	}
+
+	if err := DenyPermission(roleBase, Permission{Action: "read", Resource: "msg"}); err != ErrNoDenials {
+		t.Errorf("expected \"%v\", got \"%v\"", ErrNoDenials, err)
+	}
+
+	if d := roleUser.(Denier).AllDenials(); len(d) != 1 || !d["SendMsg"] {
+		t.Errorf("expected only the denial of User: %v", d)
+	}
+}
+
+func setPlainParent(newFunc NewCachedFunc, t *testing.T) {
+	roleBase := NewRole("Base")
+	roleBase.Permit("ReadMsg")
+
+	roleCustom := customRole{NewRole("Custom")}
+	roleCustom.Deny("DeleteMsg")
+
 	roleGeneral := newFunc("General")
-	simpleRole := NewRole("SimpleRole")
-	if err := roleGeneral.SetParent(simpleRole); err != ErrNoCachedRoler {
-		t.Errorf("expected \"%v\"", ErrNoCachedRoler)
+	if err := roleGeneral.SetParent(roleBase); err != nil {
+		t.Fatal(err)
+	}
+	if err := roleGeneral.SetParent(roleCustom); err != nil {
+		t.Fatal(err)
+	}
+
+	roleUser := newFunc("User")
+	roleUser.Permit("DeleteMsg")
+	if err := roleUser.SetParent(roleGeneral); err != nil {
+		t.Fatal(err)
+	}
+
+	if !roleUser.IsAllowed("ReadMsg") || roleUser.IsAllowed("DeleteMsg") {
+		t.Errorf("expected that User inherits the rules of the plain parents")
+	}
+
+	// The plain parents are not cached, so their changes are seen at once.
+	roleBase.Permit("SendMsg")
+	roleCustom.Undeny("DeleteMsg")
+	if !roleUser.IsAllowed("SendMsg", "DeleteMsg") || !roleUser.AllPermissions()["SendMsg"] {
+		t.Errorf("expected that User sees the changes of the plain parents")
+	}
+
+	if err := roleGeneral.RemoveParent("Base"); err != nil {
+		t.Fatal(err)
+	}
+	if roleUser.(Denier).IsGranted("ReadMsg") || roleUser.IsAllowed("SendMsg") {
+		t.Errorf("expected that User does not inherit from the removed Base")
+	}
+
+	if err := roleUser.(*CachedRole).Verify(); err != nil {
+		t.Error(err)
 	}
 }
 
@@ -377,6 +522,75 @@ func isAllowedMultipleArguments(newFunc NewFunc, t *testing.T) {
 	}
 }
 
+func denyPermissions(newFunc NewFunc, t *testing.T) {
+	roleEmployee := newFunc("Employee")
+	roleEmployee.Permit("ReadData")
+	roleEmployee.Permit("ExportData")
+	roleEmployee.Permit("report:*")
+
+	roleContractor := newFunc("Contractor")
+	if err := roleContractor.SetParent(roleEmployee); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := roleContractor.(Denier).Deny("ExportData"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := roleContractor.(Denier).Deny("ExportData"); err != ErrRoleHasDeny {
+		t.Errorf("expected \"%v\"", ErrRoleHasDeny)
+	}
+
+	roleContractor.(Denier).Deny("report:salary")
+
+	roleIntern := newFunc("Intern")
+	roleIntern.Permit("ExportData")
+	roleIntern.SetParent(roleContractor)
+
+	if !roleContractor.IsAllowed("ReadData", "report:sales") {
+		t.Errorf("expected that Contractor role inherits ReadData and report:sales")
+	}
+
+	if roleContractor.IsAllowed("ExportData") || roleContractor.IsAllowed("report:salary") {
+		t.Errorf("expected that denials of Contractor role override inherited grants")
+	}
+
+	if !roleContractor.(Denier).IsGranted("ExportData") {
+		t.Errorf("expected that ExportData is still granted to Contractor role")
+	}
+
+	if roleIntern.IsAllowed("ExportData") || !roleIntern.(Denier).IsDenied("ExportData") {
+		t.Errorf("expected that the inherited denial overrides own grant of Intern role")
+	}
+
+	if !roleEmployee.IsAllowed("ExportData") {
+		t.Errorf("expected that denials of a child do not affect its parent")
+	}
+
+	if d := roleIntern.(Denier).AllDenials(); !(d["ExportData"] && d["report:salary"]) {
+		t.Errorf("expected that Intern role inherits all denials")
+		t.Log(d)
+	}
+
+	perms := roleIntern.(Denier).EffectivePermissions()
+	if perms["ExportData"] || !perms["ReadData"] {
+		t.Errorf("expected that effective permissions exclude denied ones")
+		t.Log(perms)
+	}
+
+	if err := roleContractor.(Denier).Undeny("ExportData"); err != nil {
+		t.Error(err)
+	}
+
+	if err := roleContractor.(Denier).Undeny("ExportData"); err != ErrRoleNotDeny {
+		t.Errorf("expected \"%v\"", ErrRoleNotDeny)
+	}
+
+	if !roleIntern.IsAllowed("ExportData") {
+		t.Errorf("expected that Intern role has ExportData after Undeny")
+	}
+}
+
 func setChild(newFunc NewCachedFunc, t *testing.T) {
 	roleAdmin := newFunc("Admin")
 
@@ -411,6 +625,123 @@ func setChild(newFunc NewCachedFunc, t *testing.T) {
 	}
 }
 
+func diamondPermissions(newFunc NewFunc, t *testing.T) {
+	roleBase := newFunc("Base")
+	roleBase.Permit("ReadMsg")
+	roleBase.Permit("doc:*")
+	roleBase.(Denier).Deny("DeleteMsg")
+
+	roleLeft := newFunc("Left")
+	roleLeft.Permit("ReadMsg")
+	roleLeft.Permit("DeleteMsg")
+	roleLeft.SetParent(roleBase)
+
+	roleRight := newFunc("Right")
+	roleRight.SetParent(roleBase)
+
+	roleBottom := newFunc("Bottom")
+	roleBottom.SetParent(roleLeft)
+	roleBottom.SetParent(roleRight)
+
+	if !roleBottom.IsAllowed("ReadMsg", "doc:read") || roleBottom.IsAllowed("DeleteMsg") {
+		t.Fatalf("expected that Bottom inherits the rules of Base by both paths")
+	}
+
+	if err := roleBase.Revoke("ReadMsg"); err != nil {
+		t.Fatal(err)
+	}
+	if !roleBottom.IsAllowed("ReadMsg") {
+		t.Errorf("expected that Bottom keeps ReadMsg of Left")
+	}
+
+	if err := roleBottom.RemoveParent("Left"); err != nil {
+		t.Fatal(err)
+	}
+	if roleBottom.IsAllowed("ReadMsg") || !roleBottom.IsAllowed("doc:read") {
+		t.Errorf("expected that Bottom has only the rules of Right and Base")
+	}
+
+	if err := roleBase.(Denier).Undeny("DeleteMsg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := roleRight.(Denier).Deny("DeleteMsg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := roleBase.Revoke("doc:*"); err != nil {
+		t.Fatal(err)
+	}
+
+	if roleBottom.IsAllowed("doc:read") || !roleBottom.(Denier).IsDenied("DeleteMsg") {
+		t.Errorf("expected that Bottom follows the changes of Base and Right")
+	}
+}
+
+// randomHierarchy applies the same random changes to a hierarchy of Role
+// and one of CachedRole, and checks that the caches stay equal to
+// the rules computed by Role.
+func randomHierarchy(newFunc NewFunc, t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	const count = 12
+	plain := make([]Roler, count)
+	roles := make([]Roler, count)
+	for i := range roles {
+		name := "role" + strconv.Itoa(i)
+		plain[i] = NewRole(name)
+		roles[i] = newFunc(name)
+	}
+
+	for step := 0; step < 2000; step++ {
+		i := rnd.Intn(count)
+		perm := "perm" + strconv.Itoa(rnd.Intn(8))
+		if rnd.Intn(4) == 0 {
+			perm = "ns" + strconv.Itoa(rnd.Intn(2)) + ":*"
+		}
+
+		switch rnd.Intn(6) {
+		case 0:
+			roles[i].Permit(perm)
+			plain[i].Permit(perm)
+		case 1:
+			roles[i].Revoke(perm)
+			plain[i].Revoke(perm)
+		case 2:
+			roles[i].(Denier).Deny(perm)
+			plain[i].(Denier).Deny(perm)
+		case 3:
+			roles[i].(Denier).Undeny(perm)
+			plain[i].(Denier).Undeny(perm)
+		case 4:
+			// Parents have lower indexes, so there are no cycles.
+			if j := rnd.Intn(count); j < i {
+				roles[i].SetParent(roles[j])
+				plain[i].SetParent(plain[j])
+			}
+		case 5:
+			name := "role" + strconv.Itoa(rnd.Intn(count))
+			roles[i].RemoveParent(name)
+			plain[i].RemoveParent(name)
+		}
+
+		for k := range roles {
+			if !reflect.DeepEqual(roles[k].AllPermissions(), plain[k].AllPermissions()) ||
+				!reflect.DeepEqual(roles[k].(Denier).AllDenials(), plain[k].(Denier).AllDenials()) {
+				t.Fatalf("step %d: rules of %s differ: %v %v, expected %v %v", step, roles[k].Name(),
+					roles[k].AllPermissions(), roles[k].(Denier).AllDenials(),
+					plain[k].AllPermissions(), plain[k].(Denier).AllDenials())
+			}
+		}
+	}
+
+	for _, role := range roles {
+		if c, ok := role.(*CachedRole); ok {
+			if err := c.Verify(); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
 func TestDefaultRoleSetPermissions(t *testing.T) {
 	setPermissions(newRole, t)
 }
@@ -435,8 +766,32 @@ func TestCachedRoleSetParent(t *testing.T) {
 	setParents(newCachedRole, t)
 }
 
-func TestCachedRoleSetNoCachedParent(t *testing.T) {
-	setNoCachedParent(newCachedRoleCR, t)
+func TestDefaultRoleSetCycleParent(t *testing.T) {
+	setCycleParent(newRole, t)
+}
+
+func TestCachedRoleSetCycleParent(t *testing.T) {
+	setCycleParent(newCachedRole, t)
+}
+
+func TestDefaultRoleSetConcurrentCycleParent(t *testing.T) {
+	setConcurrentCycleParent(newRole, t)
+}
+
+func TestCachedRoleSetConcurrentCycleParent(t *testing.T) {
+	setConcurrentCycleParent(newCachedRole, t)
+}
+
+func TestDefaultRoleMinimalParent(t *testing.T) {
+	minimalParent(newRole, t)
+}
+
+func TestCachedRoleMinimalParent(t *testing.T) {
+	minimalParent(newCachedRole, t)
+}
+
+func TestCachedRoleSetPlainParent(t *testing.T) {
+	setPlainParent(newCachedRoleCR, t)
 }
 
 func TestDefaultRoleRemoveParent(t *testing.T) {
@@ -487,6 +842,26 @@ func TestCachedRoleIsAllowedMultipleArguments(t *testing.T) {
 	isAllowedMultipleArguments(newCachedRole, t)
 }
 
+func TestDefaultRoleDenyPermissions(t *testing.T) {
+	denyPermissions(newRole, t)
+}
+
+func TestCachedRoleDenyPermissions(t *testing.T) {
+	denyPermissions(newCachedRole, t)
+}
+
 func TestCachedRoleSetChild(t *testing.T) {
 	setChild(newCachedRoleCR, t)
 }
+
+func TestDefaultRoleDiamondPermissions(t *testing.T) {
+	diamondPermissions(newRole, t)
+}
+
+func TestCachedRoleDiamondPermissions(t *testing.T) {
+	diamondPermissions(newCachedRole, t)
+}
+
+func TestCachedRoleRandomHierarchy(t *testing.T) {
+	randomHierarchy(newCachedRole, t)
+}
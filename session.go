@@ -0,0 +1,281 @@
+package grbac
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Error codes returned by failures to change sessions.
+var (
+	ErrSessionClosed = errors.New("session is dropped or expired")
+	ErrRoleActive    = errors.New("role is already active in the session")
+	ErrRoleNotActive = errors.New("role is not active in the session")
+)
+
+// Session is a set of roles activated by a subject.
+//
+// A subject may have many assigned roles, but a session answers permission
+// checks only against the roles activated in it, so the subject works with
+// least privilege until it explicitly activates more roles.
+type Session struct {
+	registry *Registry
+	subject  string
+	active   map[string]Roler
+	expires  time.Time
+	dropped  bool
+
+	mutex sync.RWMutex
+}
+
+// NewSession creates a new session of the subject without active roles.
+//
+// The session expires after ttl. If ttl is zero, the session lives until it
+// is dropped. The registry keeps an expired session until the next
+// NewSession of the subject or PruneSessions, so call PruneSessions from
+// time to time if subjects come and go.
+func (reg *Registry) NewSession(subject string, ttl time.Duration) *Session {
+	s := &Session{
+		registry: reg,
+		subject:  subject,
+		active:   make(map[string]Roler),
+	}
+
+	if ttl > 0 {
+		s.expires = time.Now().Add(ttl)
+	}
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	sessions := reg.sessions[subject]
+	if sessions == nil {
+		sessions = make(map[*Session]bool)
+		reg.sessions[subject] = sessions
+	}
+
+	reg.pruneSessions(subject)
+	sessions[s] = true
+	return s
+}
+
+// PruneSessions forgets the expired sessions of all the subjects and returns
+// the number of them.
+func (reg *Registry) PruneSessions() int {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	count := 0
+	for subject := range reg.sessions {
+		count += reg.pruneSessions(subject)
+		if len(reg.sessions[subject]) == 0 {
+			delete(reg.sessions, subject)
+		}
+	}
+	return count
+}
+
+// pruneSessions forgets the closed sessions of the subject, deactivating
+// their roles, and returns the number of them.
+// The caller must hold the write lock of the registry.
+func (reg *Registry) pruneSessions(subject string) int {
+	count := 0
+	for s := range reg.sessions[subject] {
+		s.mutex.Lock()
+		if s.isClosed() {
+			s.active = make(map[string]Roler)
+			delete(reg.sessions[subject], s)
+			count++
+		}
+		s.mutex.Unlock()
+	}
+	return count
+}
+
+// SessionsOf returns the live sessions of the subject.
+func (reg *Registry) SessionsOf(subject string) []*Session {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	sessions := make([]*Session, 0, len(reg.sessions[subject]))
+	for s := range reg.sessions[subject] {
+		if !s.IsClosed() {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+// deactivateRole removes the role from all sessions of the subject.
+// If subject is empty, the role is removed from all sessions.
+// The caller must hold the write lock of the registry.
+func (reg *Registry) deactivateRole(subject, role string) {
+	for subj, sessions := range reg.sessions {
+		if subject != "" && subj != subject {
+			continue
+		}
+
+		for s := range sessions {
+			s.mutex.Lock()
+			delete(s.active, role)
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// rebindSessions deactivates the roles no longer assigned to the subjects
+// of the sessions and replaces the active roles found in roles.
+// The caller must hold the write lock of the registry.
+func (reg *Registry) rebindSessions(roles map[string]Roler) {
+	for subject, sessions := range reg.sessions {
+		for s := range sessions {
+			s.mutex.Lock()
+			for name := range s.active {
+				if !reg.assignments[subject][name] {
+					delete(s.active, name)
+				} else if role, ok := roles[name]; ok {
+					s.active[name] = role
+				}
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// Subject returns the subject of the session.
+func (s *Session) Subject() string {
+	return s.subject
+}
+
+// Expires returns the time the session expires at.
+// The zero time means that the session never expires.
+func (s *Session) Expires() time.Time {
+	return s.expires
+}
+
+// IsClosed checks that the session is dropped or expired.
+func (s *Session) IsClosed() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.isClosed()
+}
+
+func (s *Session) isClosed() bool {
+	return s.dropped || (!s.expires.IsZero() && time.Now().After(s.expires))
+}
+
+// Activate activates the role with the name in the session.
+//
+// Returns ErrSessionClosed if the session is dropped or expired,
+// ErrRoleNotAssigned if the role is not assigned to the subject,
+// ErrRoleActive if the role is already active and a SoDError if the role
+// together with the active roles would violate a dynamic separation of duty
+// constraint.
+func (s *Session) Activate(role string) error {
+	s.registry.mutex.RLock()
+	defer s.registry.mutex.RUnlock()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.isClosed() {
+		return ErrSessionClosed
+	}
+
+	if !s.registry.assignments[s.subject][role] {
+		return ErrRoleNotAssigned
+	}
+
+	if _, ok := s.active[role]; ok {
+		return ErrRoleActive
+	}
+
+	if err := s.registry.checkActivateDSD(s.subject, s.active, role); err != nil {
+		return err
+	}
+
+	s.active[role] = s.registry.roles[role]
+	return nil
+}
+
+// Deactivate deactivates the role with the name in the session.
+//
+// Returns ErrSessionClosed if the session is dropped or expired and
+// ErrRoleNotActive if the role is not active.
+func (s *Session) Deactivate(role string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.isClosed() {
+		return ErrSessionClosed
+	}
+
+	if _, ok := s.active[role]; !ok {
+		return ErrRoleNotActive
+	}
+
+	delete(s.active, role)
+	return nil
+}
+
+// ActiveRoles returns a map of the roles active in the session.
+// A closed session has no active roles.
+//
+// Key of the map - a name of the role.
+func (s *Session) ActiveRoles() map[string]Roler {
+	newRoles := make(map[string]Roler)
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.isClosed() {
+		return newRoles
+	}
+
+	for k, v := range s.active {
+		newRoles[k] = v
+	}
+	return newRoles
+}
+
+// IsAllowed checks permissions listed in the perms.
+// IsAllowed returns true only if every permission from perms is granted by
+// at least one of the active roles and denied by none of them, including
+// permissions they inherit from their parents. A closed session allows
+// nothing. The decision is reported to the auditor of the registry, see
+// Registry.SetAuditor.
+func (s *Session) IsAllowed(perms ...string) bool {
+	return s.IsAllowedContext(context.Background(), perms...)
+}
+
+// IsAllowedContext is like IsAllowed, the decision has the actor of ctx.
+func (s *Session) IsAllowedContext(ctx context.Context, perms ...string) bool {
+	roles := s.ActiveRoles()
+
+	s.registry.mutex.RLock()
+	auditor := s.registry.auditor
+	s.registry.mutex.RUnlock()
+
+	allowed := anyAllowed(roles, perms)
+	auditCheck(ctx, auditor, s.subject, roles, perms, allowed)
+	return allowed
+}
+
+// Drop closes the session and deactivates all its roles.
+func (s *Session) Drop() {
+	s.registry.mutex.Lock()
+	defer s.registry.mutex.Unlock()
+
+	s.mutex.Lock()
+	s.dropped = true
+	s.active = make(map[string]Roler)
+	s.mutex.Unlock()
+
+	sessions := s.registry.sessions[s.subject]
+	delete(sessions, s)
+	if len(sessions) == 0 {
+		delete(s.registry.sessions, s.subject)
+	}
+}
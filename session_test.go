@@ -0,0 +1,131 @@
+package grbac
+
+import (
+	"testing"
+	"time"
+)
+
+func sessionActivate(newFunc NewFunc, t *testing.T) {
+	reg := newSubjectRegistry(newFunc, t)
+	reg.Assign("alice", "Admin")
+	reg.Assign("alice", "Writer")
+
+	s := reg.NewSession("alice", 0)
+
+	if s.IsAllowed("ReadMsg") {
+		t.Errorf("expected that the session without active roles allows nothing")
+	}
+
+	if err := s.Activate("Admin"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Activate("Admin"); err != ErrRoleActive {
+		t.Errorf("expected \"%v\"", ErrRoleActive)
+	}
+
+	if err := s.Activate("User"); err != ErrRoleNotAssigned {
+		t.Errorf("expected \"%v\"", ErrRoleNotAssigned)
+	}
+
+	if !s.IsAllowed("DelMsg", "ReadMsg") {
+		t.Errorf("expected that the session allows permissions of Admin role and its parents")
+	}
+
+	if s.IsAllowed("CreateMsg") {
+		t.Errorf("expected that the session does not allow CreateMsg of inactive Writer role")
+	}
+
+	s.Activate("Writer")
+	if !s.IsAllowed("CreateMsg", "DelMsg") {
+		t.Errorf("expected that the session allows permissions of Admin and Writer roles")
+	}
+
+	if err := s.Deactivate("Admin"); err != nil {
+		t.Error(err)
+	}
+
+	if err := s.Deactivate("Admin"); err != ErrRoleNotActive {
+		t.Errorf("expected \"%v\"", ErrRoleNotActive)
+	}
+
+	if s.IsAllowed("DelMsg") {
+		t.Errorf("expected that the session does not allow DelMsg now")
+	}
+
+	reg.Unassign("alice", "Writer")
+	if _, ok := s.ActiveRoles()["Writer"]; ok {
+		t.Errorf("expected that unassigned Writer role is not active")
+	}
+}
+
+func sessionClose(newFunc NewFunc, t *testing.T) {
+	reg := newSubjectRegistry(newFunc, t)
+	reg.Assign("alice", "User")
+
+	s := reg.NewSession("alice", 0)
+	s.Activate("User")
+
+	if sessions := reg.SessionsOf("alice"); len(sessions) != 1 || sessions[0] != s {
+		t.Errorf("expected that alice has one session")
+	}
+
+	s.Drop()
+
+	if !s.IsClosed() || s.IsAllowed("ReadMsg") {
+		t.Errorf("expected that the dropped session allows nothing")
+	}
+
+	if err := s.Activate("User"); err != ErrSessionClosed {
+		t.Errorf("expected \"%v\"", ErrSessionClosed)
+	}
+
+	if len(reg.SessionsOf("alice")) != 0 {
+		t.Errorf("expected that alice does not have sessions")
+	}
+
+	s = reg.NewSession("alice", time.Millisecond)
+	s.Activate("User")
+	time.Sleep(5 * time.Millisecond)
+
+	if !s.IsClosed() || s.IsAllowed("ReadMsg") {
+		t.Errorf("expected that the expired session allows nothing")
+	}
+
+	if err := s.Deactivate("User"); err != ErrSessionClosed {
+		t.Errorf("expected \"%v\"", ErrSessionClosed)
+	}
+
+	// The expired sessions are kept until pruned.
+	live := reg.NewSession("alice", 0)
+	reg.NewSession("bob", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	if count := reg.PruneSessions(); count != 1 {
+		t.Errorf("expected that one expired session is pruned, got %d", count)
+	}
+
+	if len(reg.sessions) != 1 || len(reg.sessions["alice"]) != 1 || !reg.sessions["alice"][live] {
+		t.Errorf("expected that only the live session is kept: %v", reg.sessions)
+	}
+
+	if count := reg.PruneSessions(); count != 0 {
+		t.Errorf("expected that nothing is pruned again, got %d", count)
+	}
+}
+
+func TestDefaultRoleSessionActivate(t *testing.T) {
+	sessionActivate(newRole, t)
+}
+
+func TestCachedRoleSessionActivate(t *testing.T) {
+	sessionActivate(newCachedRole, t)
+}
+
+func TestDefaultRoleSessionClose(t *testing.T) {
+	sessionClose(newRole, t)
+}
+
+func TestCachedRoleSessionClose(t *testing.T) {
+	sessionClose(newCachedRole, t)
+}
@@ -0,0 +1,367 @@
+package grbac
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Error codes returned by failures to manage separation of duty constraints.
+var (
+	ErrConstraintExists  = errors.New("constraint already exists")
+	ErrNoConstraint      = errors.New("constraint does not exist")
+	ErrInvalidConstraint = errors.New("constraint needs a cardinality from 2 to the number of its roles")
+)
+
+// SoDConstraint is a separation of duty constraint: nobody may hold
+// Cardinality or more roles from Roles at the same time.
+//
+// With Cardinality 2 the roles are mutually exclusive.
+type SoDConstraint struct {
+	Name        string   `json:"name"`
+	Roles       []string `json:"roles"`
+	Cardinality int      `json:"cardinality"`
+}
+
+// newSoDConstraint validates the arguments and makes a constraint.
+func newSoDConstraint(name string, n int, roles []string) (SoDConstraint, error) {
+	set := make(map[string]bool)
+	for _, role := range roles {
+		set[role] = true
+	}
+
+	if n < 2 || n > len(set) {
+		return SoDConstraint{}, ErrInvalidConstraint
+	}
+
+	c := SoDConstraint{Name: name, Roles: setToSlice(set), Cardinality: n}
+	return c, nil
+}
+
+// check returns a SoDError if the set of role names violates the constraint.
+func (c SoDConstraint) check(roles map[string]bool) *SoDError {
+	var conflicts []string
+	for _, role := range c.Roles {
+		if roles[role] {
+			conflicts = append(conflicts, role)
+		}
+	}
+
+	if len(conflicts) < c.Cardinality {
+		return nil
+	}
+
+	return &SoDError{Constraint: c, Roles: conflicts}
+}
+
+// SoDError is returned when a change would violate a separation of duty
+// constraint.
+type SoDError struct {
+	Constraint SoDConstraint
+
+	// Dynamic is true if the constraint is a dynamic one, checked at
+	// activation of roles in a session.
+	Dynamic bool
+
+	// Subject is the subject that would hold the conflicting roles. It is
+	// empty if a role hierarchy itself includes them.
+	Subject string
+
+	// Role is the role whose hierarchy would include the conflicting roles.
+	// It is empty if the roles come from several assigned roles.
+	Role string
+
+	// Roles are the names of the conflicting roles.
+	Roles []string
+}
+
+func (e *SoDError) Error() string {
+	kind := "static"
+	if e.Dynamic {
+		kind = "dynamic"
+	}
+
+	var holder string
+	switch {
+	case e.Subject != "" && e.Role != "":
+		holder = fmt.Sprintf("subject %q through role %q", e.Subject, e.Role)
+	case e.Subject != "":
+		holder = fmt.Sprintf("subject %q", e.Subject)
+	default:
+		holder = fmt.Sprintf("role %q", e.Role)
+	}
+
+	return fmt.Sprintf("%s separation of duty %q is violated: %s would hold %s, "+
+		"but less than %d of [%s] are allowed", kind, e.Constraint.Name, holder,
+		strings.Join(e.Roles, ", "), e.Constraint.Cardinality,
+		strings.Join(e.Constraint.Roles, ", "))
+}
+
+// expandRoles returns the names of the roles and all their ancestors.
+func expandRoles(roles map[string]Roler) map[string]bool {
+	names := make(map[string]bool)
+	for name, role := range roles {
+		names[name] = true
+		for parent := range role.AllParents() {
+			names[parent] = true
+		}
+	}
+	return names
+}
+
+func setToSlice(set map[string]bool) []string {
+	list := make([]string, 0, len(set))
+	for k := range set {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// AddSSD adds a static separation of duty constraint: no subject may be
+// assigned n or more roles from roles, neither directly nor through
+// the parents of its roles.
+//
+// Returns ErrConstraintExists if a static constraint with the name already
+// exists, ErrInvalidConstraint if n is out of range and a SoDError if the
+// current assignments or hierarchies already violate the constraint.
+func (reg *Registry) AddSSD(name string, n int, roles ...string) error {
+	c, err := newSoDConstraint(name, n, roles)
+	if err != nil {
+		return err
+	}
+
+	reg.writeMutex.Lock()
+	defer reg.writeMutex.Unlock()
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	if _, ok := reg.ssd[name]; ok {
+		return ErrConstraintExists
+	}
+
+	for roleName, role := range reg.roles {
+		if err := c.check(expandRoles(map[string]Roler{roleName: role})); err != nil {
+			err.Role = roleName
+			return err
+		}
+	}
+
+	for subject := range reg.assignments {
+		if err := c.check(expandRoles(reg.assignedRoles(subject))); err != nil {
+			err.Subject = subject
+			return err
+		}
+	}
+
+	reg.ssd[name] = c
+	return nil
+}
+
+// RemoveSSD removes the static separation of duty constraint with the name.
+//
+// Returns ErrNoConstraint if the constraint does not exist.
+func (reg *Registry) RemoveSSD(name string) error {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	return removeConstraint(reg.ssd, name)
+}
+
+// SSD returns the static separation of duty constraints.
+//
+// Key of the map - a name of the constraint.
+func (reg *Registry) SSD() map[string]SoDConstraint {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	return copyConstraints(reg.ssd)
+}
+
+// AddDSD adds a dynamic separation of duty constraint: a subject may be
+// assigned any of roles, but no session may have n or more of them active
+// at the same time, neither directly nor through the parents of active roles.
+//
+// Returns ErrConstraintExists if a dynamic constraint with the name already
+// exists, ErrInvalidConstraint if n is out of range and a SoDError if a live
+// session already violates the constraint.
+func (reg *Registry) AddDSD(name string, n int, roles ...string) error {
+	c, err := newSoDConstraint(name, n, roles)
+	if err != nil {
+		return err
+	}
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	if _, ok := reg.dsd[name]; ok {
+		return ErrConstraintExists
+	}
+
+	for subject, sessions := range reg.sessions {
+		for s := range sessions {
+			if err := c.check(expandRoles(s.ActiveRoles())); err != nil {
+				err.Dynamic = true
+				err.Subject = subject
+				return err
+			}
+		}
+	}
+
+	reg.dsd[name] = c
+	return nil
+}
+
+// RemoveDSD removes the dynamic separation of duty constraint with the name.
+//
+// Returns ErrNoConstraint if the constraint does not exist.
+func (reg *Registry) RemoveDSD(name string) error {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	return removeConstraint(reg.dsd, name)
+}
+
+// DSD returns the dynamic separation of duty constraints.
+//
+// Key of the map - a name of the constraint.
+func (reg *Registry) DSD() map[string]SoDConstraint {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	return copyConstraints(reg.dsd)
+}
+
+func removeConstraint(constraints map[string]SoDConstraint, name string) error {
+	if _, ok := constraints[name]; !ok {
+		return ErrNoConstraint
+	}
+
+	delete(constraints, name)
+	return nil
+}
+
+func copyConstraints(constraints map[string]SoDConstraint) map[string]SoDConstraint {
+	newConstraints := make(map[string]SoDConstraint)
+	for k, v := range constraints {
+		newConstraints[k] = v
+	}
+	return newConstraints
+}
+
+// checkConstraints checks the set of role names against all the constraints.
+func checkConstraints(constraints map[string]SoDConstraint, roles map[string]bool) *SoDError {
+	for _, c := range constraints {
+		if err := c.check(roles); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkAssignSSD checks that the subject can be assigned the role.
+// The caller must hold the lock of the registry.
+func (reg *Registry) checkAssignSSD(subject, role string) error {
+	if len(reg.ssd) == 0 {
+		return nil
+	}
+
+	roles := reg.assignedRoles(subject)
+	roles[role] = reg.roles[role]
+
+	if err := checkConstraints(reg.ssd, expandRoles(roles)); err != nil {
+		err.Subject = subject
+		return err
+	}
+	return nil
+}
+
+// checkParentSSD checks that the role named parent can become a parent of
+// the role named child: neither the child, nor its descendants, nor the
+// subjects holding them may inherit conflicting roles.
+// The caller must hold the lock of the registry.
+func (reg *Registry) checkParentSSD(child, parent string) error {
+	if len(reg.ssd) == 0 {
+		return nil
+	}
+
+	inherited := expandRoles(map[string]Roler{parent: reg.roles[parent]})
+
+	affected := make(map[string]bool)
+	for name, role := range reg.roles {
+		if _, ok := role.AllParents()[child]; name != child && !ok {
+			continue
+		}
+		affected[name] = true
+
+		roles := expandRoles(map[string]Roler{name: role})
+		for k := range inherited {
+			roles[k] = true
+		}
+
+		if err := checkConstraints(reg.ssd, roles); err != nil {
+			err.Role = name
+			return err
+		}
+	}
+
+	for subject, assigned := range reg.assignments {
+		isAffected := false
+		for name := range assigned {
+			if affected[name] {
+				isAffected = true
+				break
+			}
+		}
+
+		if !isAffected {
+			continue
+		}
+
+		roles := expandRoles(reg.assignedRoles(subject))
+		for k := range inherited {
+			roles[k] = true
+		}
+
+		if err := checkConstraints(reg.ssd, roles); err != nil {
+			err.Subject = subject
+			return err
+		}
+	}
+	return nil
+}
+
+// assignedRoles returns a new map of the roles assigned to the subject.
+// The caller must hold the lock of the registry.
+func (reg *Registry) assignedRoles(subject string) map[string]Roler {
+	roles := make(map[string]Roler)
+	for name := range reg.assignments[subject] {
+		roles[name] = reg.roles[name]
+	}
+	return roles
+}
+
+// checkActivateDSD checks that the role can be activated in addition to the
+// active roles of a session of the subject.
+// The caller must hold the lock of the registry.
+func (reg *Registry) checkActivateDSD(subject string, active map[string]Roler, role string) error {
+	if len(reg.dsd) == 0 {
+		return nil
+	}
+
+	roles := make(map[string]Roler)
+	for k, v := range active {
+		roles[k] = v
+	}
+	roles[role] = reg.roles[role]
+
+	if err := checkConstraints(reg.dsd, expandRoles(roles)); err != nil {
+		err.Dynamic = true
+		err.Subject = subject
+		err.Role = role
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package grbac
+
+import "testing"
+
+func newSoDRegistry(newFunc NewFunc, t *testing.T) *Registry {
+	reg := NewRegistry(RoleFactory(newFunc))
+
+	for _, name := range []string{"Employee", "Requester", "Approver", "Auditor", "Manager"} {
+		if _, err := reg.Create(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := reg.SetParent("Requester", "Employee"); err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+func staticSoDAssign(newFunc NewFunc, t *testing.T) {
+	reg := newSoDRegistry(newFunc, t)
+
+	if err := reg.AddSSD("payments", 1, "Requester", "Approver"); err != ErrInvalidConstraint {
+		t.Errorf("expected \"%v\"", ErrInvalidConstraint)
+	}
+
+	if err := reg.AddSSD("payments", 2, "Requester", "Approver"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reg.AddSSD("payments", 2, "Requester", "Auditor"); err != ErrConstraintExists {
+		t.Errorf("expected \"%v\"", ErrConstraintExists)
+	}
+
+	if err := reg.Assign("alice", "Requester"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := reg.Assign("alice", "Approver")
+	sodErr, ok := err.(*SoDError)
+	if !ok {
+		t.Fatalf("expected SoDError, got \"%v\"", err)
+	}
+
+	if sodErr.Subject != "alice" || sodErr.Dynamic ||
+		len(sodErr.Roles) != 2 || sodErr.Constraint.Name != "payments" {
+		t.Errorf("SoDError has incorrect fields: %#v", sodErr)
+	}
+
+	if _, ok := reg.RolesOf("alice")["Approver"]; ok {
+		t.Errorf("expected that Approver role is not assigned to alice")
+	}
+
+	if err := reg.RemoveSSD("payments"); err != nil {
+		t.Error(err)
+	}
+
+	if err := reg.Assign("alice", "Approver"); err != nil {
+		t.Error(err)
+	}
+
+	if err := reg.AddSSD("payments", 2, "Requester", "Approver"); err == nil {
+		t.Errorf("expected that the constraint is refused for current assignments")
+	}
+}
+
+func staticSoDCardinality(newFunc NewFunc, t *testing.T) {
+	reg := newSoDRegistry(newFunc, t)
+
+	if err := reg.AddSSD("control", 3, "Requester", "Approver", "Auditor"); err != nil {
+		t.Fatal(err)
+	}
+
+	reg.Assign("alice", "Requester")
+	if err := reg.Assign("alice", "Approver"); err != nil {
+		t.Errorf("expected that 2 of 3 roles are allowed: %v", err)
+	}
+
+	if _, ok := reg.Assign("alice", "Auditor").(*SoDError); !ok {
+		t.Errorf("expected that 3 of 3 roles are refused")
+	}
+}
+
+func staticSoDInherited(newFunc NewFunc, t *testing.T) {
+	reg := newSoDRegistry(newFunc, t)
+	reg.AddSSD("payments", 2, "Requester", "Approver")
+
+	// Manager inherits Requester through a grandparent.
+	reg.SetParent("Employee", "Auditor")
+	if err := reg.SetParent("Manager", "Requester"); err != nil {
+		t.Fatal(err)
+	}
+
+	reg.Assign("bob", "Manager")
+	if _, ok := reg.Assign("bob", "Approver").(*SoDError); !ok {
+		t.Errorf("expected that Approver conflicts with inherited Requester")
+	}
+
+	reg.Assign("carol", "Approver")
+	err := reg.SetParent("Auditor", "Approver")
+	sodErr, ok := err.(*SoDError)
+	if !ok {
+		t.Fatalf("expected SoDError, got \"%v\"", err)
+	}
+
+	if sodErr.Role == "" {
+		t.Errorf("expected that SoDError names the role with the conflicting hierarchy")
+	}
+
+	if reg.Get("Auditor").HasParent("Approver") {
+		t.Errorf("expected that the refused parent is not set")
+	}
+
+	reg.RemoveSSD("payments")
+	reg.AddSSD("review", 2, "Manager", "Approver")
+
+	// Only the subject would hold both roles, no single hierarchy would.
+	reg.Create("Clerk")
+	reg.Assign("carol", "Clerk")
+	err = reg.SetParent("Clerk", "Manager")
+	if sodErr, ok := err.(*SoDError); !ok || sodErr.Subject != "carol" {
+		t.Errorf("expected SoDError for subject carol, got \"%v\"", err)
+	}
+
+	reg.Unassign("carol", "Approver")
+	if err := reg.SetParent("Clerk", "Manager"); err != nil {
+		t.Error(err)
+	}
+}
+
+func dynamicSoDActivate(newFunc NewFunc, t *testing.T) {
+	reg := newSoDRegistry(newFunc, t)
+	reg.SetParent("Manager", "Requester")
+
+	if err := reg.AddDSD("payments", 2, "Requester", "Approver"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Dynamic constraints do not limit assignment.
+	if err := reg.Assign("alice", "Manager"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reg.Assign("alice", "Approver"); err != nil {
+		t.Fatal(err)
+	}
+
+	s := reg.NewSession("alice", 0)
+	if err := s.Activate("Approver"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s.Activate("Manager")
+	sodErr, ok := err.(*SoDError)
+	if !ok {
+		t.Fatalf("expected SoDError, got \"%v\"", err)
+	}
+
+	if !sodErr.Dynamic || sodErr.Subject != "alice" || sodErr.Role != "Manager" ||
+		len(sodErr.Roles) != 2 {
+		t.Errorf("SoDError has incorrect fields: %#v", sodErr)
+	}
+
+	if _, ok := s.ActiveRoles()["Manager"]; ok {
+		t.Errorf("expected that Manager role is not active")
+	}
+
+	s.Deactivate("Approver")
+	if err := s.Activate("Manager"); err != nil {
+		t.Error(err)
+	}
+
+	other := reg.NewSession("alice", 0)
+	if err := other.Activate("Approver"); err != nil {
+		t.Errorf("expected that another session may activate Approver: %v", err)
+	}
+
+	if err := reg.RemoveDSD("payments"); err != nil {
+		t.Error(err)
+	}
+
+	if err := s.Activate("Approver"); err != nil {
+		t.Error(err)
+	}
+
+	if _, ok := reg.AddDSD("payments", 2, "Requester", "Approver").(*SoDError); !ok {
+		t.Errorf("expected that the constraint is refused for live sessions")
+	}
+
+	if len(reg.DSD()) != 0 {
+		t.Errorf("expected that the registry does not have dynamic constraints")
+	}
+}
+
+func TestDefaultRoleStaticSoDAssign(t *testing.T) {
+	staticSoDAssign(newRole, t)
+}
+
+func TestCachedRoleStaticSoDAssign(t *testing.T) {
+	staticSoDAssign(newCachedRole, t)
+}
+
+func TestDefaultRoleStaticSoDCardinality(t *testing.T) {
+	staticSoDCardinality(newRole, t)
+}
+
+func TestCachedRoleStaticSoDCardinality(t *testing.T) {
+	staticSoDCardinality(newCachedRole, t)
+}
+
+func TestDefaultRoleStaticSoDInherited(t *testing.T) {
+	staticSoDInherited(newRole, t)
+}
+
+func TestCachedRoleStaticSoDInherited(t *testing.T) {
+	staticSoDInherited(newCachedRole, t)
+}
+
+func TestDefaultRoleDynamicSoDActivate(t *testing.T) {
+	dynamicSoDActivate(newRole, t)
+}
+
+func TestCachedRoleDynamicSoDActivate(t *testing.T) {
+	dynamicSoDActivate(newCachedRole, t)
+}
@@ -0,0 +1,449 @@
+// Package sqlstore keeps grbac roles and assignments in a relational
+// database through database/sql.
+//
+// The tables are described by Schema and can be created with CreateSchema.
+// Every change is written in its own transaction, so a role never has only
+// a part of its permissions or parents stored.
+//
+// The queries use "?" placeholders, which SQLite and MySQL drivers accept.
+//
+// A Store is usually loaded into a registry with grbac.LoadRegistry, which
+// reads all the tables at once through LoadPolicy:
+//
+//	db, err := sql.Open("sqlite3", "roles.db")
+//	...
+//	if err := sqlstore.CreateSchema(db); err != nil {
+//		...
+//	}
+//
+//	reg, err := grbac.LoadRegistry(sqlstore.New(db), func(name string) grbac.Roler {
+//		return grbac.NewCachedRole(name)
+//	})
+package sqlstore
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/deterok/grbac"
+)
+
+// Schema is the SQL that creates the tables of the store.
+//
+// role_permissions keeps both the permissions and the denials of the roles,
+// the latter are marked by denied.
+const Schema = `
+CREATE TABLE IF NOT EXISTS roles (
+	name VARCHAR(255) NOT NULL PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS role_permissions (
+	role       VARCHAR(255) NOT NULL,
+	permission VARCHAR(255) NOT NULL,
+	denied     BOOLEAN NOT NULL,
+	PRIMARY KEY (role, permission, denied)
+);
+
+CREATE TABLE IF NOT EXISTS role_parents (
+	role   VARCHAR(255) NOT NULL,
+	parent VARCHAR(255) NOT NULL,
+	PRIMARY KEY (role, parent)
+);
+
+CREATE TABLE IF NOT EXISTS assignments (
+	subject VARCHAR(255) NOT NULL,
+	role    VARCHAR(255) NOT NULL,
+	PRIMARY KEY (subject, role)
+);
+`
+
+// CreateSchema creates the tables of the store if they do not exist.
+func CreateSchema(db *sql.DB) error {
+	for _, stmt := range strings.Split(Schema, ";") {
+		if strings.TrimSpace(stmt) == "" {
+			continue
+		}
+
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Store is a grbac.Store that keeps the records in a database. It is also
+// a grbac.AssignmentStore and a grbac.PolicyLoader.
+//
+// Watch reports only the changes made through this Store.
+type Store struct {
+	db *sql.DB
+
+	watchers map[int]func(grbac.StoreEvent)
+	next     int
+
+	mutex sync.Mutex
+}
+
+// New creates a store over the database. The tables must already exist,
+// see CreateSchema.
+func New(db *sql.DB) *Store {
+	return &Store{db: db, watchers: make(map[int]func(grbac.StoreEvent))}
+}
+
+// LoadRole returns the record of the role.
+func (s *Store) LoadRole(name string) (grbac.RoleRecord, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return grbac.RoleRecord{}, err
+	}
+	defer tx.Rollback()
+
+	ok, err := exists(tx, "SELECT COUNT(*) FROM roles WHERE name = ?", name)
+	if err != nil {
+		return grbac.RoleRecord{}, err
+	}
+	if !ok {
+		return grbac.RoleRecord{}, grbac.ErrNoRole
+	}
+
+	records := map[string]*grbac.RoleRecord{name: {Name: name}}
+
+	rows, err := tx.Query("SELECT role, permission, denied FROM role_permissions WHERE role = ?", name)
+	if err != nil {
+		return grbac.RoleRecord{}, err
+	}
+	if err := scanPermissions(rows, records); err != nil {
+		return grbac.RoleRecord{}, err
+	}
+
+	rows, err = tx.Query("SELECT role, parent FROM role_parents WHERE role = ?", name)
+	if err != nil {
+		return grbac.RoleRecord{}, err
+	}
+	if err := scanParents(rows, records); err != nil {
+		return grbac.RoleRecord{}, err
+	}
+
+	return sortRecord(*records[name]), nil
+}
+
+// SaveRole adds or replaces the record of the role.
+func (s *Store) SaveRole(rec grbac.RoleRecord) error {
+	err := s.update(func(tx *sql.Tx) error {
+		ok, err := exists(tx, "SELECT COUNT(*) FROM roles WHERE name = ?", rec.Name)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			if _, err := tx.Exec("INSERT INTO roles (name) VALUES (?)", rec.Name); err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.Exec("DELETE FROM role_permissions WHERE role = ?", rec.Name); err != nil {
+			return err
+		}
+
+		for _, perm := range rec.Permissions {
+			if _, err := tx.Exec("INSERT INTO role_permissions (role, permission, denied) VALUES (?, ?, ?)",
+				rec.Name, perm, false); err != nil {
+				return err
+			}
+		}
+
+		for _, perm := range rec.Denials {
+			if _, err := tx.Exec("INSERT INTO role_permissions (role, permission, denied) VALUES (?, ?, ?)",
+				rec.Name, perm, true); err != nil {
+				return err
+			}
+		}
+
+		if _, err := tx.Exec("DELETE FROM role_parents WHERE role = ?", rec.Name); err != nil {
+			return err
+		}
+
+		for _, parent := range rec.Parents {
+			if _, err := tx.Exec("INSERT INTO role_parents (role, parent) VALUES (?, ?)",
+				rec.Name, parent); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	rec = sortRecord(rec)
+	s.notify(rec.Name, &rec)
+	return nil
+}
+
+// ListRoles returns the sorted names of all the roles in the store.
+func (s *Store) ListRoles() ([]string, error) {
+	rows, err := s.db.Query("SELECT name FROM roles ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// DeleteRole deletes the record of the role together with its assignments
+// and the links of other roles to it.
+func (s *Store) DeleteRole(name string) error {
+	err := s.update(func(tx *sql.Tx) error {
+		res, err := tx.Exec("DELETE FROM roles WHERE name = ?", name)
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return grbac.ErrNoRole
+		}
+
+		if _, err := tx.Exec("DELETE FROM role_permissions WHERE role = ?", name); err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM role_parents WHERE role = ? OR parent = ?", name, name); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec("DELETE FROM assignments WHERE role = ?", name)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.notify(name, nil)
+	return nil
+}
+
+// SaveAssignment assigns the role to the subject.
+func (s *Store) SaveAssignment(subject, role string) error {
+	return s.update(func(tx *sql.Tx) error {
+		ok, err := exists(tx, "SELECT COUNT(*) FROM assignments WHERE subject = ? AND role = ?", subject, role)
+		if err != nil || ok {
+			return err
+		}
+
+		_, err = tx.Exec("INSERT INTO assignments (subject, role) VALUES (?, ?)", subject, role)
+		return err
+	})
+}
+
+// DeleteAssignment takes the role away from the subject.
+func (s *Store) DeleteAssignment(subject, role string) error {
+	_, err := s.db.Exec("DELETE FROM assignments WHERE subject = ? AND role = ?", subject, role)
+	return err
+}
+
+// LoadPolicy reads all the roles and assignments of the store in one
+// transaction.
+func (s *Store) LoadPolicy() (*grbac.Policy, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	records := make(map[string]*grbac.RoleRecord)
+
+	rows, err := tx.Query("SELECT name FROM roles")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		records[name] = &grbac.RoleRecord{Name: name}
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query("SELECT role, permission, denied FROM role_permissions")
+	if err != nil {
+		return nil, err
+	}
+	if err := scanPermissions(rows, records); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query("SELECT role, parent FROM role_parents")
+	if err != nil {
+		return nil, err
+	}
+	if err := scanParents(rows, records); err != nil {
+		return nil, err
+	}
+
+	p := &grbac.Policy{Roles: make([]grbac.RoleRecord, 0, len(records))}
+	for _, rec := range records {
+		p.Roles = append(p.Roles, sortRecord(*rec))
+	}
+	sort.Sort(recordsByName(p.Roles))
+
+	rows, err = tx.Query("SELECT subject, role FROM assignments ORDER BY subject, role")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var subject, role string
+		if err := rows.Scan(&subject, &role); err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		if p.Assignments == nil {
+			p.Assignments = make(map[string][]string)
+		}
+		p.Assignments[subject] = append(p.Assignments[subject], role)
+	}
+	if err := closeRows(rows); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Watch calls fn for every change made through the store until cancel is
+// called.
+func (s *Store) Watch(fn func(grbac.StoreEvent)) (cancel func()) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	id := s.next
+	s.next++
+	s.watchers[id] = fn
+
+	return func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+
+		delete(s.watchers, id)
+	}
+}
+
+func (s *Store) notify(role string, rec *grbac.RoleRecord) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, fn := range s.watchers {
+		fn(grbac.StoreEvent{Role: role, Record: rec})
+	}
+}
+
+// update runs fn in a transaction and commits it if fn succeeds.
+func (s *Store) update(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func exists(tx *sql.Tx, query string, args ...interface{}) (bool, error) {
+	var n int
+	if err := tx.QueryRow(query, args...).Scan(&n); err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// scanPermissions adds the permissions and denials of the rows to
+// the records. Rows of unknown roles are skipped.
+func scanPermissions(rows *sql.Rows, records map[string]*grbac.RoleRecord) error {
+	for rows.Next() {
+		var role, perm string
+		var denied bool
+		if err := rows.Scan(&role, &perm, &denied); err != nil {
+			rows.Close()
+			return err
+		}
+
+		rec, ok := records[role]
+		if !ok {
+			continue
+		}
+
+		if denied {
+			rec.Denials = append(rec.Denials, perm)
+		} else {
+			rec.Permissions = append(rec.Permissions, perm)
+		}
+	}
+	return closeRows(rows)
+}
+
+// scanParents adds the parents of the rows to the records. Rows of unknown
+// roles are skipped.
+func scanParents(rows *sql.Rows, records map[string]*grbac.RoleRecord) error {
+	for rows.Next() {
+		var role, parent string
+		if err := rows.Scan(&role, &parent); err != nil {
+			rows.Close()
+			return err
+		}
+
+		if rec, ok := records[role]; ok {
+			rec.Parents = append(rec.Parents, parent)
+		}
+	}
+	return closeRows(rows)
+}
+
+func closeRows(rows *sql.Rows) error {
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return err
+	}
+	return rows.Close()
+}
+
+func sortRecord(rec grbac.RoleRecord) grbac.RoleRecord {
+	rec.Permissions = sortedCopy(rec.Permissions)
+	rec.Denials = sortedCopy(rec.Denials)
+	rec.Parents = sortedCopy(rec.Parents)
+	return rec
+}
+
+func sortedCopy(list []string) []string {
+	if len(list) == 0 {
+		return nil
+	}
+
+	list = append([]string(nil), list...)
+	sort.Strings(list)
+	return list
+}
+
+type recordsByName []grbac.RoleRecord
+
+func (r recordsByName) Len() int           { return len(r) }
+func (r recordsByName) Less(i, j int) bool { return r[i].Name < r[j].Name }
+func (r recordsByName) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
@@ -0,0 +1,162 @@
+package sqlstore
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/deterok/grbac"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openDB(path string, t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every connection to ":memory:" has its own database.
+	db.SetMaxOpenConns(1)
+
+	if err := CreateSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func newCachedRole(name string) grbac.Roler {
+	return grbac.NewCachedRole(name)
+}
+
+func TestStore(t *testing.T) {
+	db := openDB(":memory:", t)
+	defer db.Close()
+
+	store := New(db)
+
+	var events []grbac.StoreEvent
+	cancel := store.Watch(func(e grbac.StoreEvent) { events = append(events, e) })
+
+	user := grbac.RoleRecord{Name: "User", Permissions: []string{"SendMsg", "ReadMsg"}, Denials: []string{"DelMsg"}}
+	if err := store.SaveRole(user); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := grbac.RoleRecord{Name: "Admin", Parents: []string{"User"}}
+	if err := store.SaveRole(admin); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := store.LoadRole("User")
+	expected := grbac.RoleRecord{Name: "User", Permissions: []string{"ReadMsg", "SendMsg"}, Denials: []string{"DelMsg"}}
+	if err != nil || !reflect.DeepEqual(rec, expected) {
+		t.Errorf("LoadRole returned an incorrect record: %#v, %v", rec, err)
+	}
+
+	user.Permissions = []string{"ReadMsg"}
+	if err := store.SaveRole(user); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec, _ := store.LoadRole("User"); !reflect.DeepEqual(rec.Permissions, []string{"ReadMsg"}) {
+		t.Errorf("expected that SaveRole replaces the permissions: %v", rec.Permissions)
+	}
+
+	names, err := store.ListRoles()
+	if err != nil || !reflect.DeepEqual(names, []string{"Admin", "User"}) {
+		t.Errorf("ListRoles returned incorrect names: %v, %v", names, err)
+	}
+
+	if err := store.SaveAssignment("alice", "User"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.DeleteRole("User"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := store.LoadRole("User"); err != grbac.ErrNoRole {
+		t.Errorf("expected \"%v\"", grbac.ErrNoRole)
+	}
+
+	if err := store.DeleteRole("User"); err != grbac.ErrNoRole {
+		t.Errorf("expected \"%v\"", grbac.ErrNoRole)
+	}
+
+	p, err := store.LoadPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(p, &grbac.Policy{Roles: []grbac.RoleRecord{{Name: "Admin"}}}) {
+		t.Errorf("expected that DeleteRole removes the links and the assignments: %#v", p)
+	}
+
+	cancel()
+	store.SaveRole(user)
+
+	if len(events) != 4 || events[3].Role != "User" || events[3].Record != nil {
+		t.Errorf("Watch reported incorrect events: %#v", events)
+	}
+}
+
+func TestLoadRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grbac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "roles.db")
+
+	db := openDB(path, t)
+	reg, err := grbac.LoadRegistry(New(db), newCachedRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user, _ := reg.Create("User")
+	user.Permit("ReadMsg")
+	user.Permit("SendMsg")
+
+	admin, _ := reg.Create("Admin")
+	admin.Permit("DelMsg")
+	reg.SetParent("Admin", "User")
+
+	guest, _ := reg.Create("Guest")
+	guest.(grbac.Denier).Deny("SendMsg")
+	reg.SetParent("Guest", "User")
+
+	reg.Assign("alice", "Admin")
+	reg.Assign("bob", "Guest")
+	reg.Assign("bob", "User")
+	reg.Unassign("bob", "User")
+	db.Close()
+
+	db = openDB(path, t)
+	defer db.Close()
+
+	loaded, err := grbac.LoadRegistry(New(db), newCachedRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !loaded.IsAllowed("Admin", "ReadMsg", "SendMsg", "DelMsg") {
+		t.Errorf("expected that Admin role has all the permissions")
+	}
+
+	if loaded.IsAllowed("Guest", "SendMsg") || !loaded.IsAllowed("Guest", "ReadMsg") {
+		t.Errorf("expected that Guest role denies SendMsg and inherits ReadMsg")
+	}
+
+	if !loaded.Can("alice", "DelMsg") || loaded.Can("bob", "SendMsg") {
+		t.Errorf("expected that the assignments are loaded")
+	}
+
+	if _, ok := loaded.Get("Admin").(*grbac.StoredRole).Unwrap().(*grbac.CachedRole); !ok {
+		t.Errorf("expected that the roles are made with the factory")
+	}
+}
@@ -0,0 +1,515 @@
+package grbac
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+// Store keeps role records outside of process memory.
+//
+// LoadRole and DeleteRole return ErrNoRole if the store does not have
+// the role.
+type Store interface {
+	LoadRole(name string) (RoleRecord, error)
+	SaveRole(rec RoleRecord) error
+	ListRoles() ([]string, error)
+	DeleteRole(name string) error
+
+	// Watch calls fn for every change made through the store until cancel
+	// is called. fn must not call the store.
+	Watch(fn func(StoreEvent)) (cancel func())
+}
+
+// PolicyLoader is implemented by stores that can read all their records at
+// once faster than role by role. LoadRegistry uses it if it is available.
+type PolicyLoader interface {
+	LoadPolicy() (*Policy, error)
+}
+
+// AssignmentStore is implemented by stores that also keep the assignments of
+// roles to subjects. A registry bound to such a store writes Assign and
+// Unassign through to it, and its LoadPolicy is expected to return
+// the assignments.
+type AssignmentStore interface {
+	SaveAssignment(subject, role string) error
+	DeleteAssignment(subject, role string) error
+}
+
+// StoreEvent describes a change of a store.
+type StoreEvent struct {
+	Role string
+
+	// Record is the saved record of the role, nil if the role is deleted.
+	Record *RoleRecord
+}
+
+// storeWatchers is a list of Watch callbacks shared by the stores.
+type storeWatchers struct {
+	fns  map[int]func(StoreEvent)
+	next int
+
+	mutex sync.Mutex
+}
+
+func (w *storeWatchers) add(fn func(StoreEvent)) (cancel func()) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.fns == nil {
+		w.fns = make(map[int]func(StoreEvent))
+	}
+
+	id := w.next
+	w.next++
+	w.fns[id] = fn
+
+	return func() {
+		w.mutex.Lock()
+		defer w.mutex.Unlock()
+
+		delete(w.fns, id)
+	}
+}
+
+func (w *storeWatchers) notify(role string, rec *RoleRecord) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, fn := range w.fns {
+		fn(StoreEvent{Role: role, Record: rec})
+	}
+}
+
+// MemoryStore is a Store that keeps the records in memory.
+// It is the reference implementation of Store.
+type MemoryStore struct {
+	records  map[string]RoleRecord
+	watchers storeWatchers
+
+	mutex sync.RWMutex
+}
+
+// NewMemoryStore creates a new empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]RoleRecord)}
+}
+
+// LoadRole returns the record of the role.
+func (s *MemoryStore) LoadRole(name string) (RoleRecord, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	rec, ok := s.records[name]
+	if !ok {
+		return RoleRecord{}, ErrNoRole
+	}
+	return copyRecord(rec), nil
+}
+
+// SaveRole adds or replaces the record of the role.
+func (s *MemoryStore) SaveRole(rec RoleRecord) error {
+	rec = copyRecord(rec)
+
+	s.mutex.Lock()
+	s.records[rec.Name] = rec
+	s.mutex.Unlock()
+
+	s.watchers.notify(rec.Name, &rec)
+	return nil
+}
+
+// ListRoles returns the sorted names of all the roles in the store.
+func (s *MemoryStore) ListRoles() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	names := make([]string, 0, len(s.records))
+	for name := range s.records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// DeleteRole deletes the record of the role.
+func (s *MemoryStore) DeleteRole(name string) error {
+	s.mutex.Lock()
+	if _, ok := s.records[name]; !ok {
+		s.mutex.Unlock()
+		return ErrNoRole
+	}
+	delete(s.records, name)
+	s.mutex.Unlock()
+
+	s.watchers.notify(name, nil)
+	return nil
+}
+
+// Watch calls fn for every change of the store until cancel is called.
+func (s *MemoryStore) Watch(fn func(StoreEvent)) (cancel func()) {
+	return s.watchers.add(fn)
+}
+
+func copyRecord(rec RoleRecord) RoleRecord {
+	return RoleRecord{
+		Name:        rec.Name,
+		Permissions: append([]string(nil), rec.Permissions...),
+		Denials:     append([]string(nil), rec.Denials...),
+		Parents:     append([]string(nil), rec.Parents...),
+	}
+}
+
+// FileStore is a Store that keeps the records in a JSON file in the Policy
+// format, so the file can also be read by Import.
+//
+// Every change rewrites the whole file through a temporary file and
+// a rename, so the file always holds either the old or the new records.
+// Watch reports only the changes made through this FileStore.
+type FileStore struct {
+	path string
+	mem  *MemoryStore
+
+	mutex sync.Mutex
+}
+
+// NewFileStore opens the store in the file. The file is created on the
+// first change if it does not exist.
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path, mem: NewMemoryStore()}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var p Policy
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+
+	for _, rec := range p.Roles {
+		s.mem.records[rec.Name] = rec
+	}
+	return s, nil
+}
+
+// LoadRole returns the record of the role.
+func (s *FileStore) LoadRole(name string) (RoleRecord, error) {
+	return s.mem.LoadRole(name)
+}
+
+// SaveRole adds or replaces the record of the role and writes the file.
+func (s *FileStore) SaveRole(rec RoleRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	old, hadOld := s.mem.records[rec.Name]
+
+	s.mem.mutex.Lock()
+	s.mem.records[rec.Name] = copyRecord(rec)
+	s.mem.mutex.Unlock()
+
+	if err := s.write(); err != nil {
+		s.mem.mutex.Lock()
+		if hadOld {
+			s.mem.records[rec.Name] = old
+		} else {
+			delete(s.mem.records, rec.Name)
+		}
+		s.mem.mutex.Unlock()
+		return err
+	}
+
+	rec = copyRecord(rec)
+	s.mem.watchers.notify(rec.Name, &rec)
+	return nil
+}
+
+// ListRoles returns the sorted names of all the roles in the store.
+func (s *FileStore) ListRoles() ([]string, error) {
+	return s.mem.ListRoles()
+}
+
+// DeleteRole deletes the record of the role and writes the file.
+func (s *FileStore) DeleteRole(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.mem.mutex.Lock()
+	old, ok := s.mem.records[name]
+	delete(s.mem.records, name)
+	s.mem.mutex.Unlock()
+
+	if !ok {
+		return ErrNoRole
+	}
+
+	if err := s.write(); err != nil {
+		s.mem.mutex.Lock()
+		s.mem.records[name] = old
+		s.mem.mutex.Unlock()
+		return err
+	}
+
+	s.mem.watchers.notify(name, nil)
+	return nil
+}
+
+// Watch calls fn for every change made through the store until cancel is
+// called.
+func (s *FileStore) Watch(fn func(StoreEvent)) (cancel func()) {
+	return s.mem.Watch(fn)
+}
+
+// write replaces the file with the current records.
+// The caller must hold the lock of the store.
+func (s *FileStore) write() error {
+	s.mem.mutex.RLock()
+	p := Policy{Roles: make([]RoleRecord, 0, len(s.mem.records))}
+	for _, rec := range s.mem.records {
+		p.Roles = append(p.Roles, rec)
+	}
+	s.mem.mutex.RUnlock()
+
+	sort.Sort(recordsByName(p.Roles))
+
+	data, err := json.MarshalIndent(&p, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(s.path, data)
+}
+
+type recordsByName []RoleRecord
+
+func (r recordsByName) Len() int           { return len(r) }
+func (r recordsByName) Less(i, j int) bool { return r[i].Name < r[j].Name }
+func (r recordsByName) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// writeFileAtomic writes data to a temporary file next to path, syncs it,
+// renames it to path and syncs the directory.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	// The rename is durable only once the directory is synced.
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs the directory, so the entries renamed in it survive
+// a crash. Windows cannot sync directories and makes renames durable itself.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// StoredRole is a Roler that writes every change of the wrapped role
+// through to a store.
+//
+// If the store fails to save the change, the change is undone and the error
+// of the store is returned.
+type StoredRole struct {
+	Roler
+	store Store
+}
+
+// NewStoredRole wraps the role. The role is not saved until it is changed.
+func NewStoredRole(role Roler, store Store) *StoredRole {
+	return &StoredRole{Roler: role, store: store}
+}
+
+// Unwrap returns the wrapped role.
+func (r *StoredRole) Unwrap() Roler {
+	return r.Roler
+}
+
+// save writes the record of the role. If it fails, undo is called.
+func (r *StoredRole) save(undo func() error) error {
+	if r.store == nil {
+		return nil
+	}
+
+	if err := r.store.SaveRole(RecordOf(r.Roler)); err != nil {
+		undo()
+		return err
+	}
+	return nil
+}
+
+// Permit adds the permission to the role and saves the role.
+func (r *StoredRole) Permit(perm string) error {
+	if err := r.Roler.Permit(perm); err != nil {
+		return err
+	}
+	return r.save(func() error { return r.Roler.Revoke(perm) })
+}
+
+// Revoke revokes the permission from the role and saves the role.
+func (r *StoredRole) Revoke(perm string) error {
+	if err := r.Roler.Revoke(perm); err != nil {
+		return err
+	}
+	return r.save(func() error { return r.Roler.Permit(perm) })
+}
+
+// Deny adds the denial to the role and saves the role.
+func (r *StoredRole) Deny(perm string) error {
+	if err := deny(r.Roler, perm); err != nil {
+		return err
+	}
+	return r.save(func() error { return undeny(r.Roler, perm) })
+}
+
+// Undeny removes the denial from the role and saves the role.
+func (r *StoredRole) Undeny(perm string) error {
+	if err := undeny(r.Roler, perm); err != nil {
+		return err
+	}
+	return r.save(func() error { return deny(r.Roler, perm) })
+}
+
+// IsGranted checks the grant like the wrapped role, see Denier.
+func (r *StoredRole) IsGranted(perm string) bool {
+	return isGranted(r.Roler, perm)
+}
+
+// IsDenied checks the denial like the wrapped role, see Denier.
+func (r *StoredRole) IsDenied(perm string) bool {
+	return isDenied(r.Roler, perm)
+}
+
+// Denials returns the denials of the wrapped role, see Denier.
+func (r *StoredRole) Denials() map[string]bool {
+	return denialsOf(r.Roler)
+}
+
+// AllDenials returns the denials of the wrapped role and its parents.
+func (r *StoredRole) AllDenials() map[string]bool {
+	return allDenialsOf(r.Roler)
+}
+
+// EffectivePermissions returns the effective permissions of the wrapped
+// role, see Role.EffectivePermissions.
+func (r *StoredRole) EffectivePermissions() map[string]bool {
+	return effectivePermissions(r.Roler.AllPermissions(), allDenialsOf(r.Roler))
+}
+
+// SetParent adds the parent to the role and saves the role.
+func (r *StoredRole) SetParent(role Roler) error {
+	if err := r.Roler.SetParent(role); err != nil {
+		return err
+	}
+	return r.save(func() error { return r.Roler.RemoveParent(role.Name()) })
+}
+
+// RemoveParent removes the parent from the role and saves the role.
+func (r *StoredRole) RemoveParent(name string) error {
+	parent := r.Roler.GetParent(name)
+	if err := r.Roler.RemoveParent(name); err != nil {
+		return err
+	}
+	return r.save(func() error { return r.Roler.SetParent(parent) })
+}
+
+// LoadRegistry builds a registry from the roles of the store. The roles are
+// made with factory, see NewRegistry, and wrapped into StoredRole, so their
+// changes are written through to the store. Roles created in and removed from
+// the registry are saved to and deleted from the store as well, and so are
+// assignments if the store is an AssignmentStore.
+func LoadRegistry(store Store, factory RoleFactory) (*Registry, error) {
+	p, err := loadPolicy(store)
+	if err != nil {
+		return nil, err
+	}
+
+	if factory == nil {
+		factory = func(name string) Roler { return NewRole(name) }
+	}
+
+	// The roles are not bound to the store while the graph is built, so
+	// loading does not write the records back.
+	reg, err := p.Build(func(name string) Roler {
+		return &StoredRole{Roler: factory(name)}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	for _, role := range reg.roles {
+		role.(*StoredRole).store = store
+	}
+
+	reg.store = store
+	reg.factory = func(name string) Roler {
+		return NewStoredRole(factory(name), store)
+	}
+	return reg, nil
+}
+
+// loadPolicy reads all the role records of the store.
+func loadPolicy(store Store) (*Policy, error) {
+	if loader, ok := store.(PolicyLoader); ok {
+		return loader.LoadPolicy()
+	}
+
+	names, err := store.ListRoles()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policy{Roles: make([]RoleRecord, len(names))}
+	for i, name := range names {
+		if p.Roles[i], err = store.LoadRole(name); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
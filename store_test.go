@@ -0,0 +1,139 @@
+package grbac
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func storeRoles(store Store, t *testing.T) {
+	var events []StoreEvent
+	cancel := store.Watch(func(e StoreEvent) { events = append(events, e) })
+
+	user := RoleRecord{Name: "User", Permissions: []string{"ReadMsg"}}
+	if err := store.SaveRole(user); err != nil {
+		t.Fatal(err)
+	}
+
+	admin := RoleRecord{Name: "Admin", Parents: []string{"User"}}
+	if err := store.SaveRole(admin); err != nil {
+		t.Fatal(err)
+	}
+
+	rec, err := store.LoadRole("User")
+	if err != nil || !reflect.DeepEqual(rec.Permissions, user.Permissions) {
+		t.Errorf("LoadRole returned an incorrect record: %#v, %v", rec, err)
+	}
+
+	names, err := store.ListRoles()
+	if err != nil || !reflect.DeepEqual(names, []string{"Admin", "User"}) {
+		t.Errorf("ListRoles returned incorrect names: %v, %v", names, err)
+	}
+
+	if err := store.DeleteRole("Admin"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := store.LoadRole("Admin"); err != ErrNoRole {
+		t.Errorf("expected \"%v\"", ErrNoRole)
+	}
+
+	if err := store.DeleteRole("Admin"); err != ErrNoRole {
+		t.Errorf("expected \"%v\"", ErrNoRole)
+	}
+
+	cancel()
+	store.SaveRole(admin)
+
+	if len(events) != 3 || events[2].Role != "Admin" || events[2].Record != nil {
+		t.Errorf("Watch reported incorrect events: %#v", events)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	storeRoles(NewMemoryStore(), t)
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grbac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "roles.json")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storeRoles(store, t)
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if names, _ := reopened.ListRoles(); !reflect.DeepEqual(names, []string{"Admin", "User"}) {
+		t.Errorf("expected that the reopened store has Admin and User roles: %v", names)
+	}
+
+	data, _ := ioutil.ReadFile(path)
+	if reg, err := Import(data, nil); err != nil || !reg.IsAllowed("Admin", "ReadMsg") {
+		t.Errorf("expected that the file can be imported as a policy: %v", err)
+	}
+}
+
+func loadRegistry(newFunc NewFunc, t *testing.T) {
+	store := NewMemoryStore()
+
+	reg, err := LoadRegistry(store, RoleFactory(newFunc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roleUser, _ := reg.Create("User")
+	roleUser.Permit("ReadMsg")
+	roleUser.Permit("SendMsg")
+	roleUser.Revoke("SendMsg")
+
+	roleAdmin, _ := reg.Create("Admin")
+	roleAdmin.(Denier).Deny("DelMsg")
+	if err := reg.SetParent("Admin", "User"); err != nil {
+		t.Fatal(err)
+	}
+
+	reg.Create("Guest")
+	reg.SetParent("Guest", "User")
+	reg.Remove("Guest")
+
+	// A restarted service loads the same graph.
+	restarted, err := LoadRegistry(store, RoleFactory(newFunc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(reg.Policy(), restarted.Policy()) {
+		t.Errorf("expected that the store keeps all the changes")
+		t.Logf("before: %#v", reg.Policy())
+		t.Logf("after: %#v", restarted.Policy())
+	}
+
+	if !restarted.IsAllowed("Admin", "ReadMsg") || restarted.IsAllowed("Admin", "SendMsg") {
+		t.Errorf("expected that the loaded Admin role has only ReadMsg")
+	}
+
+	restarted.RemoveParent("Admin", "User")
+	if rec, _ := store.LoadRole("Admin"); len(rec.Parents) != 0 {
+		t.Errorf("expected that RemoveParent is written through: %#v", rec)
+	}
+}
+
+func TestDefaultRoleLoadRegistry(t *testing.T) {
+	loadRegistry(newRole, t)
+}
+
+func TestCachedRoleLoadRegistry(t *testing.T) {
+	loadRegistry(newCachedRole, t)
+}
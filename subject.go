@@ -0,0 +1,211 @@
+package grbac
+
+import (
+	"context"
+	"errors"
+)
+
+// Error codes returned by failures to assign roles to subjects.
+var (
+	ErrRoleAssigned    = errors.New("role is already assigned to the subject")
+	ErrRoleNotAssigned = errors.New("role is not assigned to the subject")
+)
+
+// A subject is anything roles are assigned to: a user, a service account,
+// an API key. Subjects are identified by strings and exist in a registry as
+// long as they have at least one assigned role.
+
+// Assign assigns the role with the name to the subject.
+//
+// Returns ErrNoRole if the registry does not have the role,
+// ErrRoleAssigned if the subject already has it and a SoDError if the
+// assignment would violate a static separation of duty constraint.
+func (reg *Registry) Assign(subject, role string) error {
+	return reg.AssignContext(context.Background(), subject, role)
+}
+
+// AssignContext is like Assign, the change reported to the auditor of
+// the registry has the actor of ctx.
+func (reg *Registry) AssignContext(ctx context.Context, subject, role string) error {
+	defer reg.refreshSubject(subject)
+
+	reg.writeMutex.Lock()
+	defer reg.writeMutex.Unlock()
+
+	auditor, err := reg.assign(subject, role)
+	if err != nil {
+		return err
+	}
+
+	auditAssignment(ctx, auditor, EventAssign, subject, role)
+	return nil
+}
+
+// assign assigns the role to the subject and returns the auditor to report
+// the change to once the registry is unlocked.
+// The caller must hold writeMutex.
+func (reg *Registry) assign(subject, role string) (Auditor, error) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	if _, ok := reg.roles[role]; !ok {
+		return nil, ErrNoRole
+	}
+
+	roles := reg.assignments[subject]
+	if roles[role] {
+		return nil, ErrRoleAssigned
+	}
+
+	if err := reg.checkAssignSSD(subject, role); err != nil {
+		return nil, err
+	}
+
+	if store, ok := reg.store.(AssignmentStore); ok {
+		if err := store.SaveAssignment(subject, role); err != nil {
+			return nil, err
+		}
+	}
+
+	if roles == nil {
+		roles = make(map[string]bool)
+		reg.assignments[subject] = roles
+	}
+	roles[role] = true
+	return reg.auditor, nil
+}
+
+// Unassign takes the role with the name away from the subject and
+// deactivates it in the sessions of the subject.
+//
+// Returns ErrRoleNotAssigned if the subject does not have the role.
+func (reg *Registry) Unassign(subject, role string) error {
+	return reg.UnassignContext(context.Background(), subject, role)
+}
+
+// UnassignContext is like Unassign, the change reported to the auditor of
+// the registry has the actor of ctx.
+func (reg *Registry) UnassignContext(ctx context.Context, subject, role string) error {
+	defer reg.refreshSubject(subject)
+
+	reg.writeMutex.Lock()
+	defer reg.writeMutex.Unlock()
+
+	auditor, err := reg.unassign(subject, role)
+	if err != nil {
+		return err
+	}
+
+	auditAssignment(ctx, auditor, EventUnassign, subject, role)
+	return nil
+}
+
+// unassign is assign for Unassign.
+// The caller must hold writeMutex.
+func (reg *Registry) unassign(subject, role string) (Auditor, error) {
+	reg.mutex.Lock()
+	defer reg.mutex.Unlock()
+
+	roles := reg.assignments[subject]
+	if !roles[role] {
+		return nil, ErrRoleNotAssigned
+	}
+
+	if store, ok := reg.store.(AssignmentStore); ok {
+		if err := store.DeleteAssignment(subject, role); err != nil {
+			return nil, err
+		}
+	}
+
+	delete(roles, role)
+	if len(roles) == 0 {
+		delete(reg.assignments, subject)
+	}
+
+	reg.deactivateRole(subject, role)
+	return reg.auditor, nil
+}
+
+// RolesOf returns a map of the roles directly assigned to the subject.
+//
+// Key of the map - a name of the role.
+func (reg *Registry) RolesOf(subject string) map[string]Roler {
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	return reg.assignedRoles(subject)
+}
+
+// SubjectsOf returns a set of the subjects the role with the name is
+// directly assigned to.
+func (reg *Registry) SubjectsOf(role string) map[string]bool {
+	subjects := make(map[string]bool)
+
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	for subject, roles := range reg.assignments {
+		if roles[role] {
+			subjects[subject] = true
+		}
+	}
+	return subjects
+}
+
+// Subjects returns a set of all the subjects that have assigned roles.
+func (reg *Registry) Subjects() map[string]bool {
+	subjects := make(map[string]bool)
+
+	reg.mutex.RLock()
+	defer reg.mutex.RUnlock()
+
+	for subject := range reg.assignments {
+		subjects[subject] = true
+	}
+	return subjects
+}
+
+// Can checks permissions of the subject.
+// Can returns true only if every permission from perms is granted by at
+// least one of the roles assigned to the subject and denied by none of them.
+// The decision is reported to the auditor of the registry, see SetAuditor.
+func (reg *Registry) Can(subject string, perms ...string) bool {
+	return reg.CanContext(context.Background(), subject, perms...)
+}
+
+// CanContext is like Can, the decision has the actor of ctx.
+func (reg *Registry) CanContext(ctx context.Context, subject string, perms ...string) bool {
+	reg.mutex.RLock()
+	roles := reg.assignedRoles(subject)
+	auditor := reg.auditor
+	reg.mutex.RUnlock()
+
+	allowed := anyAllowed(roles, perms)
+	auditCheck(ctx, auditor, subject, roles, perms, allowed)
+	return allowed
+}
+
+// anyAllowed returns true only if every permission from perms is granted by
+// at least one of the roles and denied by none of them.
+func anyAllowed(roles map[string]Roler, perms []string) bool {
+	if len(roles) == 0 {
+		return false
+	}
+
+	for _, perm := range perms {
+		isFound := false
+		for _, role := range roles {
+			granted, denied := checkPerm(role, perm)
+			if denied {
+				return false
+			}
+			isFound = isFound || granted
+		}
+
+		if !isFound {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,120 @@
+package grbac
+
+import "testing"
+
+func newSubjectRegistry(newFunc NewFunc, t *testing.T) *Registry {
+	reg := NewRegistry(RoleFactory(newFunc))
+
+	roleUser, _ := reg.Create("User")
+	roleUser.Permit("ReadMsg")
+
+	roleWriter, _ := reg.Create("Writer")
+	roleWriter.Permit("CreateMsg")
+
+	roleAdmin, _ := reg.Create("Admin")
+	roleAdmin.Permit("DelMsg")
+
+	if err := reg.SetParent("Admin", "User"); err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+func assignRoles(newFunc NewFunc, t *testing.T) {
+	reg := newSubjectRegistry(newFunc, t)
+
+	if err := reg.Assign("alice", "User"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reg.Assign("alice", "Writer"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reg.Assign("bob", "User"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reg.Assign("alice", "User"); err != ErrRoleAssigned {
+		t.Errorf("expected \"%v\"", ErrRoleAssigned)
+	}
+
+	if err := reg.Assign("alice", "No Role!"); err != ErrNoRole {
+		t.Errorf("expected \"%v\"", ErrNoRole)
+	}
+
+	roles := reg.RolesOf("alice")
+	if _, ok := roles["Writer"]; !ok || len(roles) != 2 {
+		t.Errorf("expected that alice has User and Writer roles")
+		t.Log(roles)
+	}
+
+	subjects := reg.SubjectsOf("User")
+	if !(subjects["alice"] && subjects["bob"]) || len(subjects) != 2 {
+		t.Errorf("expected that User role is assigned to alice and bob")
+		t.Log(subjects)
+	}
+
+	if err := reg.Unassign("bob", "User"); err != nil {
+		t.Error(err)
+	}
+
+	if err := reg.Unassign("bob", "User"); err != ErrRoleNotAssigned {
+		t.Errorf("expected \"%v\"", ErrRoleNotAssigned)
+	}
+
+	if s := reg.Subjects(); s["bob"] || !s["alice"] {
+		t.Errorf("expected that only alice has roles")
+		t.Log(s)
+	}
+
+	reg.Remove("Writer")
+	if _, ok := reg.RolesOf("alice")["Writer"]; ok {
+		t.Errorf("expected that removed Writer role is not assigned to alice")
+	}
+}
+
+func subjectCan(newFunc NewFunc, t *testing.T) {
+	reg := newSubjectRegistry(newFunc, t)
+
+	reg.Assign("alice", "Admin")
+	reg.Assign("alice", "Writer")
+
+	if !reg.Can("alice", "ReadMsg", "CreateMsg", "DelMsg") {
+		t.Errorf("expected that alice has permissions of all assigned roles")
+	}
+
+	reg.Unassign("alice", "Writer")
+
+	if reg.Can("alice", "ReadMsg", "CreateMsg") {
+		t.Errorf("expected that alice does not have CreateMsg permission")
+	}
+
+	roleGuest, _ := reg.Create("Guest")
+	roleGuest.(Denier).Deny("ReadMsg")
+	reg.Assign("alice", "Guest")
+
+	if reg.Can("alice", "ReadMsg") {
+		t.Errorf("expected that the denial of an assigned role overrides grants")
+	}
+
+	if reg.Can("bob", "ReadMsg") {
+		t.Errorf("expected that bob without roles has no permissions")
+	}
+}
+
+func TestDefaultRoleAssignRoles(t *testing.T) {
+	assignRoles(newRole, t)
+}
+
+func TestCachedRoleAssignRoles(t *testing.T) {
+	assignRoles(newCachedRole, t)
+}
+
+func TestDefaultRoleSubjectCan(t *testing.T) {
+	subjectCan(newRole, t)
+}
+
+func TestCachedRoleSubjectCan(t *testing.T) {
+	subjectCan(newCachedRole, t)
+}
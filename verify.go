@@ -0,0 +1,186 @@
+package grbac
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Inconsistencies of CachedRole graphs found by Verify.
+var (
+	ErrOrphanChild  = errors.New("child does not have the role as a parent")
+	ErrMissingChild = errors.New("parent does not have the role as a child")
+	ErrStaleCache   = errors.New("cache does not match the rules")
+)
+
+// Inconsistency is a broken invariant of a CachedRole graph.
+type Inconsistency struct {
+	Role string
+
+	// Related is the parent or the child the inconsistency is about,
+	// if any.
+	Related string
+
+	Err error
+}
+
+func (i Inconsistency) String() string {
+	if i.Related == "" {
+		return fmt.Sprintf("role %q: %v", i.Role, i.Err)
+	}
+	return fmt.Sprintf("role %q: %q: %v", i.Role, i.Related, i.Err)
+}
+
+// VerifyError is returned by Verify with all the inconsistencies found.
+type VerifyError struct {
+	Inconsistencies []Inconsistency
+}
+
+func (e *VerifyError) Error() string {
+	list := make([]string, len(e.Inconsistencies))
+	for i, inc := range e.Inconsistencies {
+		list[i] = inc.String()
+	}
+	return fmt.Sprintf("graph has %d inconsistencies: %s", len(list), strings.Join(list, "; "))
+}
+
+// Verify audits the graph of the CachedRole roles connected to the role
+// through parents and children: every child must have its parent as
+// a parent, every CachedRoler parent must have its child as a child, and
+// the caches and the live roles of every role must match its own rules and
+// its parents.
+//
+// The pending background rebuilds of the graph are done first, see
+// SetRebuildDelay. Returns nil if the graph is consistent and a VerifyError
+// with every inconsistency otherwise.
+func (r *CachedRole) Verify() error {
+	for _, c := range cachedGraph(r) {
+		c.rebuild()
+	}
+
+	hierarchyMutex.Lock()
+	defer hierarchyMutex.Unlock()
+
+	var list []Inconsistency
+	for _, c := range cachedGraph(r) {
+		list = append(list, c.verify()...)
+	}
+
+	if len(list) == 0 {
+		return nil
+	}
+	return &VerifyError{Inconsistencies: list}
+}
+
+// cachedGraph returns the CachedRole roles connected to the role, sorted by
+// their names.
+func cachedGraph(r *CachedRole) []*CachedRole {
+	seen := map[*CachedRole]bool{r: true}
+	queue := []*CachedRole{r}
+
+	visit := func(role Roler) {
+		if c, ok := unwrapRole(role).(*CachedRole); ok && !seen[c] {
+			seen[c] = true
+			queue = append(queue, c)
+		}
+	}
+
+	for i := 0; i < len(queue); i++ {
+		for _, parent := range queue[i].Role.Parents() {
+			visit(parent)
+		}
+		for _, child := range queue[i].Children() {
+			visit(child)
+		}
+	}
+
+	sort.Sort(cachedByName(queue))
+	return queue
+}
+
+type cachedByName []*CachedRole
+
+func (c cachedByName) Len() int           { return len(c) }
+func (c cachedByName) Less(i, j int) bool { return c[i].Name() < c[j].Name() }
+func (c cachedByName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// verify checks the links and the caches of the role.
+// The caller must hold hierarchyMutex.
+func (r *CachedRole) verify() []Inconsistency {
+	var list []Inconsistency
+	add := func(related string, err error) {
+		list = append(list, Inconsistency{Role: r.Name(), Related: related, Err: err})
+	}
+
+	children := r.Children()
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		child := children[name]
+		if parent := child.GetParent(r.Name()); parent == nil || unwrapRole(parent) != Roler(r) {
+			add(name, ErrOrphanChild)
+		}
+	}
+
+	parents := r.Role.Parents()
+	names = names[:0]
+	for name := range parents {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		// Only CachedRoler parents have child links.
+		c, ok := unwrapRole(parents[name]).(CachedRoler)
+		if !ok {
+			continue
+		}
+
+		if c.Children()[r.Name()] != CachedRoler(r) {
+			add(name, ErrMissingChild)
+		}
+	}
+
+	grants, denials, ownLive := r.sources()
+	live := r.inheritLive(ownLive)
+	ownGrants, ownDenials := ruleSetOf(r.Role.Permissions()), ruleSetOf(r.Role.Denials())
+	expGrants, expGrantExtra := recountRules(grants)
+	expDenials, expDenyExtra := recountRules(denials)
+
+	r.mutex.RLock()
+	stale := !sameBits(&r.ownGrants.bits, &ownGrants.bits) ||
+		!sameBits(&r.ownDenials.bits, &ownDenials.bits) ||
+		!sameBits(&r.permsCache.bits, &expGrants.bits) ||
+		!sameBits(&r.denyCache.bits, &expDenials.bits) ||
+		!sameCounts(r.grantExtra, expGrantExtra) ||
+		!sameCounts(r.denyExtra, expDenyExtra) ||
+		!sameRoles(r.ownLive, ownLive) ||
+		!sameRoles(r.live, live)
+	r.mutex.RUnlock()
+
+	if stale {
+		add("", ErrStaleCache)
+	}
+	return list
+}
+
+func sameBits(a, b *bitset) bool {
+	return a.containsAll(b) && b.containsAll(a)
+}
+
+func sameCounts(a, b map[permID]int32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id, n := range a {
+		if b[id] != n {
+			return false
+		}
+	}
+	return true
+}
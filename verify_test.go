@@ -0,0 +1,98 @@
+package grbac
+
+import (
+	"reflect"
+	"testing"
+)
+
+func failedSetParent(newFunc NewCachedFunc, t *testing.T) {
+	roleUser := newFunc("User")
+	roleOtherUser := newFunc("User")
+	roleAdmin := newFunc("Admin")
+
+	if err := roleAdmin.SetParent(roleUser); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := roleAdmin.SetParent(roleOtherUser); err != ErrRoleHasParent {
+		t.Fatalf("expected \"%v\", got \"%v\"", ErrRoleHasParent, err)
+	}
+
+	if _, ok := roleOtherUser.Children()["Admin"]; ok {
+		t.Errorf("expected that the failed SetParent does not leave a child link")
+	}
+
+	// Another role with the name of a child cannot take its place.
+	roleOtherAdmin := newFunc("Admin")
+	if err := roleOtherAdmin.SetParent(roleUser); err != ErrChildExists {
+		t.Errorf("expected \"%v\", got \"%v\"", ErrChildExists, err)
+	}
+
+	if err := roleAdmin.(*CachedRole).Verify(); err != nil {
+		t.Error(err)
+	}
+}
+
+func removePlainParent(newFunc NewCachedFunc, t *testing.T) {
+	rolePlain := NewRole("Plain")
+	rolePlain.Permit("ReadMsg")
+
+	roleUser := newFunc("User")
+	roleUser.(*CachedRole).Role.SetParent(rolePlain)
+	roleUser.UpdateCache()
+
+	if !roleUser.IsAllowed("ReadMsg") {
+		t.Fatalf("expected that User inherits ReadMsg after UpdateCache")
+	}
+
+	if err := roleUser.RemoveParent("Plain"); err != nil {
+		t.Fatal(err)
+	}
+
+	if roleUser.IsAllowed("ReadMsg") {
+		t.Errorf("expected that User does not inherit ReadMsg")
+	}
+}
+
+func TestCachedRoleFailedSetParent(t *testing.T) {
+	failedSetParent(newCachedRoleCR, t)
+}
+
+func TestCachedRoleRemovePlainParent(t *testing.T) {
+	removePlainParent(newCachedRoleCR, t)
+}
+
+func TestCachedRoleVerify(t *testing.T) {
+	roleGeneral := NewCachedRole("General")
+	roleGeneral.Permit("ReadMsg")
+
+	roleUser := NewCachedRole("User")
+	roleUser.SetParent(roleGeneral)
+
+	roleAdmin := NewCachedRole("Admin")
+	roleAdmin.SetParent(roleUser)
+
+	if err := roleAdmin.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Links and rules changed behind the back of CachedRole.
+	roleGeneral.SetChild(NewCachedRole("Orphan"))
+	roleAdmin.Role.SetParent(NewCachedRole("Hidden"))
+	roleUser.Role.Permit("SendMsg")
+
+	err := roleGeneral.Verify()
+	verr, ok := err.(*VerifyError)
+	if !ok {
+		t.Fatalf("expected a VerifyError, got %v", err)
+	}
+
+	expected := []Inconsistency{
+		{Role: "Admin", Related: "Hidden", Err: ErrMissingChild},
+		{Role: "General", Related: "Orphan", Err: ErrOrphanChild},
+		{Role: "User", Err: ErrStaleCache},
+	}
+	if !reflect.DeepEqual(verr.Inconsistencies, expected) {
+		t.Errorf("unexpected inconsistencies: %v", verr)
+	}
+}
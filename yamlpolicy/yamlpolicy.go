@@ -0,0 +1,569 @@
+// Package yamlpolicy loads grbac policies from YAML files.
+//
+// A policy file looks like this:
+//
+//	include:
+//	  - common.yaml
+//
+//	permissions:
+//	  messaging: &messaging [ReadMsg, SendMsg]
+//
+//	roles:
+//	  User:
+//	    permissions: [*messaging, "report:*"]
+//	  Contractor:
+//	    parents: [User]
+//	    denials: [ExportData]
+//	  Moderator:
+//	    permissions: ["@messaging", DelMsg]
+//	    parents: [User]
+//
+//	assignments:
+//	  alice: [Contractor]
+//
+//	ssd:
+//	  - name: payments
+//	    roles: [Approver, Requester]
+//	    cardinality: 2
+//
+//	dsd: []
+//
+// Included files are resolved relative to the including file and merged into
+// one policy; a role may be described only once across all of them.
+//
+// Permission lists may be reused with YAML anchors inside one file. Lists
+// named in the "permissions" section can also be referred to from any file
+// as "@name". Nested lists are flattened.
+//
+// Every error found in the files is reported with the file and the line.
+package yamlpolicy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/deterok/grbac"
+	"gopkg.in/yaml.v3"
+)
+
+// Error codes returned by failures to load policy files.
+var (
+	ErrIncludeCycle = errors.New("include cycle")
+	ErrDuplicate    = errors.New("described twice")
+	ErrUnknownList  = errors.New("unknown permission list")
+	ErrUnknownKey   = errors.New("unknown key")
+	ErrUnexpected   = errors.New("unexpected value")
+)
+
+// Error is an error at a position in a policy file.
+type Error struct {
+	File   string
+	Line   int
+	Column int
+
+	// Msg tells what the error is about, if Err alone is not enough.
+	Msg string
+
+	Err error
+}
+
+func (e *Error) Error() string {
+	msg := e.File
+	if e.Line != 0 {
+		msg += fmt.Sprintf(":%d:%d", e.Line, e.Column)
+	}
+	if e.Msg != "" {
+		msg += ": " + e.Msg
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// pos is a position of a node in a file.
+type pos struct {
+	file   string
+	line   int
+	column int
+}
+
+func posOf(file string, n *yaml.Node) pos {
+	return pos{file: file, line: n.Line, column: n.Column}
+}
+
+func (p pos) errorf(err error, format string, args ...interface{}) *Error {
+	return &Error{
+		File:   p.file,
+		Line:   p.line,
+		Column: p.column,
+		Msg:    fmt.Sprintf(format, args...),
+		Err:    err,
+	}
+}
+
+// item is a permission or a reference to a named list.
+type item struct {
+	value string
+	pos   pos
+}
+
+type role struct {
+	pos         pos
+	permissions []item
+	denials     []item
+	parents     []item
+}
+
+type constraint struct {
+	grbac.SoDConstraint
+	pos pos
+}
+
+// loader collects the policy from the files.
+type loader struct {
+	roles       map[string]*role
+	order       []string
+	lists       map[string][]item
+	listPos     map[string]pos
+	assignments map[string][]item
+	subjects    []string
+	ssd         []constraint
+	dsd         []constraint
+
+	loaded  map[string]bool
+	loading map[string]bool
+}
+
+func newLoader() *loader {
+	return &loader{
+		roles:       make(map[string]*role),
+		lists:       make(map[string][]item),
+		listPos:     make(map[string]pos),
+		assignments: make(map[string][]item),
+		loaded:      make(map[string]bool),
+		loading:     make(map[string]bool),
+	}
+}
+
+// Load reads the policy file with its includes and builds a registry.
+// The roles are made with factory, see grbac.NewRegistry.
+func Load(path string, factory grbac.RoleFactory) (*grbac.Registry, error) {
+	l := newLoader()
+	if err := l.load(path, pos{}); err != nil {
+		return nil, err
+	}
+
+	p, err := l.policy()
+	if err != nil {
+		return nil, err
+	}
+
+	reg, err := p.Build(factory)
+	if err != nil {
+		return nil, l.locate(err)
+	}
+	return reg, nil
+}
+
+// LoadPolicy reads the policy file with its includes.
+//
+// Unlike Load it does not build the role graph, so it does not find cycles
+// and violations of constraints.
+func LoadPolicy(path string) (*grbac.Policy, error) {
+	l := newLoader()
+	if err := l.load(path, pos{}); err != nil {
+		return nil, err
+	}
+
+	return l.policy()
+}
+
+func (l *loader) load(path string, from pos) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return from.errorf(err, "")
+	}
+
+	if l.loading[abs] {
+		return from.errorf(ErrIncludeCycle, "include %q", path)
+	}
+
+	if l.loaded[abs] {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if from.file == "" {
+			return &Error{File: path, Err: err}
+		}
+		return from.errorf(err, "")
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return &Error{File: path, Err: err}
+	}
+
+	l.loading[abs] = true
+	defer delete(l.loading, abs)
+	l.loaded[abs] = true
+
+	if len(doc.Content) == 0 {
+		return nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return posOf(path, root).errorf(ErrUnexpected, "policy must be a mapping")
+	}
+
+	for i := 0; i < len(root.Content); i += 2 {
+		key, value := root.Content[i], resolve(root.Content[i+1])
+
+		switch key.Value {
+		case "include":
+			err = l.loadIncludes(path, value)
+		case "permissions":
+			err = l.loadLists(path, value)
+		case "roles":
+			err = l.loadRoles(path, value)
+		case "assignments":
+			err = l.loadAssignments(path, value)
+		case "ssd":
+			l.ssd, err = loadConstraints(path, value, l.ssd)
+		case "dsd":
+			l.dsd, err = loadConstraints(path, value, l.dsd)
+		default:
+			err = posOf(path, key).errorf(ErrUnknownKey, "%q", key.Value)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *loader) loadIncludes(file string, n *yaml.Node) error {
+	includes, err := items(file, n)
+	if err != nil {
+		return err
+	}
+
+	for _, inc := range includes {
+		path := inc.value
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(file), path)
+		}
+
+		if err := l.load(path, inc.pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *loader) loadLists(file string, n *yaml.Node) error {
+	if isNull(n) {
+		return nil
+	}
+
+	if n.Kind != yaml.MappingNode {
+		return posOf(file, n).errorf(ErrUnexpected, "permissions must be a mapping of lists")
+	}
+
+	for i := 0; i < len(n.Content); i += 2 {
+		key := n.Content[i]
+		if p, ok := l.listPos[key.Value]; ok {
+			return posOf(file, key).errorf(ErrDuplicate,
+				"permission list %q, first at %s:%d", key.Value, p.file, p.line)
+		}
+
+		list, err := items(file, n.Content[i+1])
+		if err != nil {
+			return err
+		}
+
+		l.lists[key.Value] = list
+		l.listPos[key.Value] = posOf(file, key)
+	}
+	return nil
+}
+
+func (l *loader) loadRoles(file string, n *yaml.Node) error {
+	if isNull(n) {
+		return nil
+	}
+
+	if n.Kind != yaml.MappingNode {
+		return posOf(file, n).errorf(ErrUnexpected, "roles must be a mapping")
+	}
+
+	for i := 0; i < len(n.Content); i += 2 {
+		key, value := n.Content[i], resolve(n.Content[i+1])
+
+		if r, ok := l.roles[key.Value]; ok {
+			return posOf(file, key).errorf(ErrDuplicate,
+				"role %q, first at %s:%d", key.Value, r.pos.file, r.pos.line)
+		}
+
+		r := &role{pos: posOf(file, key)}
+		if !isNull(value) {
+			if value.Kind != yaml.MappingNode {
+				return posOf(file, value).errorf(ErrUnexpected, "role %q must be a mapping", key.Value)
+			}
+
+			for j := 0; j < len(value.Content); j += 2 {
+				field := value.Content[j]
+
+				var err error
+				switch field.Value {
+				case "permissions":
+					r.permissions, err = items(file, value.Content[j+1])
+				case "denials":
+					r.denials, err = items(file, value.Content[j+1])
+				case "parents":
+					r.parents, err = items(file, value.Content[j+1])
+				default:
+					err = posOf(file, field).errorf(ErrUnknownKey, "%q", field.Value)
+				}
+
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		l.roles[key.Value] = r
+		l.order = append(l.order, key.Value)
+	}
+	return nil
+}
+
+func (l *loader) loadAssignments(file string, n *yaml.Node) error {
+	if isNull(n) {
+		return nil
+	}
+
+	if n.Kind != yaml.MappingNode {
+		return posOf(file, n).errorf(ErrUnexpected, "assignments must be a mapping")
+	}
+
+	for i := 0; i < len(n.Content); i += 2 {
+		subject := n.Content[i].Value
+		roles, err := items(file, n.Content[i+1])
+		if err != nil {
+			return err
+		}
+
+		if _, ok := l.assignments[subject]; !ok {
+			l.subjects = append(l.subjects, subject)
+		}
+		l.assignments[subject] = append(l.assignments[subject], roles...)
+	}
+	return nil
+}
+
+func loadConstraints(file string, n *yaml.Node, list []constraint) ([]constraint, error) {
+	if isNull(n) {
+		return list, nil
+	}
+
+	if n.Kind != yaml.SequenceNode {
+		return nil, posOf(file, n).errorf(ErrUnexpected, "constraints must be a list")
+	}
+
+	for _, c := range n.Content {
+		var value struct {
+			Name        string   `yaml:"name"`
+			Roles       []string `yaml:"roles"`
+			Cardinality int      `yaml:"cardinality"`
+		}
+
+		if err := resolve(c).Decode(&value); err != nil {
+			return nil, posOf(file, c).errorf(err, "")
+		}
+
+		list = append(list, constraint{
+			SoDConstraint: grbac.SoDConstraint{
+				Name:        value.Name,
+				Roles:       value.Roles,
+				Cardinality: value.Cardinality,
+			},
+			pos: posOf(file, c),
+		})
+	}
+	return list, nil
+}
+
+// items reads a list of strings, flattening nested lists and aliases.
+// A single scalar is read as a list of one item.
+func items(file string, n *yaml.Node) ([]item, error) {
+	n = resolve(n)
+
+	switch {
+	case isNull(n):
+		return nil, nil
+	case n.Kind == yaml.ScalarNode:
+		return []item{{value: n.Value, pos: posOf(file, n)}}, nil
+	case n.Kind == yaml.SequenceNode:
+		var list []item
+		for _, c := range n.Content {
+			sub, err := items(file, c)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, sub...)
+		}
+		return list, nil
+	}
+
+	return nil, posOf(file, n).errorf(ErrUnexpected, "expected a list of strings")
+}
+
+func resolve(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	return n
+}
+
+func isNull(n *yaml.Node) bool {
+	return n.Kind == yaml.ScalarNode && n.Tag == "!!null"
+}
+
+// expand replaces references to named lists with their permissions.
+func (l *loader) expand(list []item) ([]string, error) {
+	var perms []string
+	for _, it := range list {
+		if !strings.HasPrefix(it.value, "@") {
+			perms = append(perms, it.value)
+			continue
+		}
+
+		named, ok := l.lists[it.value[1:]]
+		if !ok {
+			return nil, it.pos.errorf(ErrUnknownList, "%q", it.value[1:])
+		}
+
+		for _, p := range named {
+			if strings.HasPrefix(p.value, "@") {
+				return nil, p.pos.errorf(ErrUnexpected, "permission lists cannot refer to other lists")
+			}
+			perms = append(perms, p.value)
+		}
+	}
+	return perms, nil
+}
+
+func values(list []item) []string {
+	values := make([]string, len(list))
+	for i, it := range list {
+		values[i] = it.value
+	}
+	return values
+}
+
+// policy converts the collected description into a grbac policy and checks
+// that all referred roles exist.
+func (l *loader) policy() (*grbac.Policy, error) {
+	p := &grbac.Policy{}
+
+	for _, name := range l.order {
+		r := l.roles[name]
+
+		perms, err := l.expand(r.permissions)
+		if err != nil {
+			return nil, err
+		}
+
+		denials, err := l.expand(r.denials)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, parent := range r.parents {
+			if _, ok := l.roles[parent.value]; !ok {
+				return nil, parent.pos.errorf(grbac.ErrNoRole, "parent %q of role %q", parent.value, name)
+			}
+		}
+
+		p.Roles = append(p.Roles, grbac.RoleRecord{
+			Name:        name,
+			Permissions: perms,
+			Denials:     denials,
+			Parents:     values(r.parents),
+		})
+	}
+
+	if len(l.subjects) > 0 {
+		p.Assignments = make(map[string][]string)
+	}
+
+	for _, subject := range l.subjects {
+		for _, r := range l.assignments[subject] {
+			if _, ok := l.roles[r.value]; !ok {
+				return nil, r.pos.errorf(grbac.ErrNoRole, "role %q of subject %q", r.value, subject)
+			}
+		}
+		p.Assignments[subject] = values(l.assignments[subject])
+	}
+
+	for _, c := range l.ssd {
+		p.SSD = append(p.SSD, c.SoDConstraint)
+	}
+
+	for _, c := range l.dsd {
+		p.DSD = append(p.DSD, c.SoDConstraint)
+	}
+	return p, nil
+}
+
+// locate attaches the position of the described item to an error of
+// building the policy.
+func (l *loader) locate(err error) error {
+	policyErr, ok := err.(*grbac.PolicyError)
+	if !ok {
+		return err
+	}
+
+	if sodErr, ok := policyErr.Err.(*grbac.SoDError); ok && policyErr.Role == "" &&
+		policyErr.Subject == "" {
+		list := l.ssd
+		if sodErr.Dynamic {
+			list = l.dsd
+		}
+
+		for _, c := range list {
+			if c.Name == sodErr.Constraint.Name {
+				return c.pos.errorf(err, "")
+			}
+		}
+	}
+
+	if policyErr.Subject != "" {
+		for _, r := range l.assignments[policyErr.Subject] {
+			if r.value == policyErr.Role {
+				return r.pos.errorf(err, "")
+			}
+		}
+	}
+
+	if r, ok := l.roles[policyErr.Role]; ok {
+		for _, parent := range r.parents {
+			if policyErr.Parent != "" && parent.value == policyErr.Parent {
+				return parent.pos.errorf(err, "")
+			}
+		}
+		return r.pos.errorf(err, "")
+	}
+
+	return err
+}
@@ -0,0 +1,62 @@
+package yamlpolicy
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/deterok/grbac"
+)
+
+func newCachedRole(name string) grbac.Roler {
+	return grbac.NewCachedRole(name)
+}
+
+func TestLoad(t *testing.T) {
+	for _, factory := range []grbac.RoleFactory{nil, newCachedRole} {
+		reg, err := Load(filepath.Join("testdata", "policy.yaml"), factory)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reg.IsAllowed("Contractor", "ReadMsg", "SendMsg", "report:sales") {
+			t.Errorf("expected that Contractor role inherits the permissions")
+			t.Log(reg.Get("Contractor").AllPermissions())
+		}
+
+		if reg.IsAllowed("Contractor", "report:salary") {
+			t.Errorf("expected that Contractor role denies report:salary")
+		}
+
+		if !reg.Can("bob", "Approve", "ReadMsg") || !reg.Can("alice", "SendMsg") {
+			t.Errorf("expected that the assignments are loaded")
+		}
+
+		if _, ok := reg.SSD()["payments"]; !ok {
+			t.Errorf("expected that the constraints are loaded")
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	expected := map[string]string{
+		"unknown_parent.yaml": `testdata/unknown_parent.yaml:5:24: parent "Admin" of role "User": role does not exist`,
+		"duplicate.yaml":      `testdata/duplicate.yaml:4:3: role "General", first at testdata/common.yaml:5: described twice`,
+		"cycle_a.yaml":        `testdata/cycle_b.yaml:1:11: include "testdata/cycle_a.yaml": include cycle`,
+		"role_cycle.yaml":     `testdata/role_cycle.yaml:5:15: policy: role "B": parent "A": parent would create a cycle: B -> A -> B`,
+		"constraint.yaml":     `testdata/constraint.yaml:6:14: policy: subject "alice": role "B": static separation of duty "ab" is violated: subject "alice" would hold A, B, but less than 2 of [A, B] are allowed`,
+		"syntax.yaml":         `testdata/syntax.yaml: yaml: line 2: did not find expected node content`,
+		"missing.yaml":        `testdata/missing.yaml: open testdata/missing.yaml: no such file or directory`,
+	}
+
+	for file, msg := range expected {
+		_, err := Load(filepath.Join("testdata", file), nil)
+		if _, ok := err.(*Error); !ok {
+			t.Errorf("%s: expected Error, got \"%v\"", file, err)
+			continue
+		}
+
+		if err.Error() != msg {
+			t.Errorf("%s: incorrect error:\n%v\nexpected:\n%v", file, err, msg)
+		}
+	}
+}